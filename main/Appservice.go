@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//ghostPrefix is the localpart prefix of the puppets, eg. @_email_alice=40example.com:server
+const ghostPrefix = "_email_"
+
+//appserviceEnabled returns true if emails are posted by a puppet of their sender
+func appserviceEnabled() bool {
+	return viper.GetBool("appservice") && len(viper.GetString("asToken")) > 0
+}
+
+//matrixDomain returns the server name of the bot
+func matrixDomain() string {
+	host, _ := getHostFromMatrixID(viper.GetString("matrixuserid"))
+	return host
+}
+
+//ghostUserID returns the puppet of an email address
+func ghostUserID(address string) id.UserID {
+	return id.NewUserID(ghostPrefix+id.EncodeUserLocalpart(strings.ToLower(address)), matrixDomain())
+}
+
+//isGhost returns true if the user is a puppet of the bridge
+func isGhost(userID id.UserID) bool {
+	localpart, host, err := userID.Parse()
+	return err == nil && strings.HasPrefix(localpart, ghostPrefix) && host == matrixDomain()
+}
+
+func randomToken() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+//generateRegistration writes the registration file for the homeserver and stores its tokens in the config
+func generateRegistration() error {
+	url := viper.GetString("appserviceURL")
+	if len(url) == 0 {
+		url = "http://localhost:8093"
+	}
+	asToken, hsToken := randomToken(), randomToken()
+	registration := "id: matrix-emailbridge\n" +
+		"url: " + url + "\n" +
+		"as_token: " + asToken + "\n" +
+		"hs_token: " + hsToken + "\n" +
+		"sender_localpart: " + ghostPrefix + "bridge\n" +
+		"rate_limited: false\n" +
+		"namespaces:\n" +
+		"  users:\n" +
+		"  - exclusive: true\n" +
+		"    regex: '@" + ghostPrefix + ".*:" + regexp.QuoteMeta(matrixDomain()) + "'\n" +
+		"  aliases: []\n" +
+		"  rooms: []\n"
+	err := ioutil.WriteFile(dirPrefix+"registration.yaml", []byte(registration), 0600)
+	if err != nil {
+		return err
+	}
+	viper.Set("appservice", true)
+	viper.Set("appserviceURL", url)
+	viper.Set("asToken", asToken)
+	viper.Set("hsToken", hsToken)
+	return viper.WriteConfigAs(dirPrefix + "cfg.json")
+}
+
+//ghostIntent returns a client acting as the puppet
+func ghostIntent(userID id.UserID) (*mautrix.Client, error) {
+	intent, err := mautrix.NewClient(matrixClient.HomeserverURL.String(), userID, viper.GetString("asToken"))
+	if err != nil {
+		return nil, err
+	}
+	intent.AppServiceUserID = userID
+	return intent, nil
+}
+
+func registerGhost(userID id.UserID) error {
+	localpart, _, err := userID.Parse()
+	if err != nil {
+		return err
+	}
+	asClient, err := mautrix.NewClient(matrixClient.HomeserverURL.String(), "", viper.GetString("asToken"))
+	if err != nil {
+		return err
+	}
+	_, err = asClient.MakeRequest("POST", asClient.BuildURL("register"), map[string]string{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}, nil)
+	if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_USER_IN_USE" {
+		return nil
+	}
+	return err
+}
+
+//ensureGhost registers the puppet of an email sender, updates its profile and makes it join the room
+func ensureGhost(roomID id.RoomID, address, name string, face []byte) (*mautrix.Client, error) {
+	userID := ghostUserID(address)
+	intent, err := ghostIntent(userID)
+	if err != nil {
+		return nil, err
+	}
+	ghost, err := getGhost(userID.String())
+	if err != nil {
+		return nil, err
+	}
+	if ghost == nil {
+		if err := registerGhost(userID); err != nil {
+			return nil, err
+		}
+		ghost = &ghostUser{userID: userID.String()}
+	}
+
+	if len(name) == 0 {
+		name = address
+	}
+	changed := false
+	if ghost.displayName != name {
+		if err := intent.SetDisplayName(name); err != nil {
+			WriteLog(warn, "Couldn't set the name of "+userID.String()+": "+err.Error())
+		} else {
+			ghost.displayName = name
+			changed = true
+		}
+	}
+	if len(face) > 0 {
+		hash := sha256.Sum256(face)
+		if avatarHash := hex.EncodeToString(hash[:]); ghost.avatarHash != avatarHash {
+			resp, err := intent.UploadBytes(face, http.DetectContentType(face))
+			if err == nil {
+				err = intent.SetAvatarURL(resp.ContentURI)
+			}
+			if err != nil {
+				WriteLog(warn, "Couldn't set the avatar of "+userID.String()+": "+err.Error())
+			} else {
+				ghost.avatarHash = avatarHash
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := saveGhost(ghost); err != nil {
+			WriteLog(logError, "#120 saveGhost: "+err.Error())
+		}
+	}
+
+	members, err := getRoomMembers(roomID.String())
+	if err != nil {
+		return nil, err
+	}
+	if !contains(members, userID.String()) {
+		_, err = matrixClient.InviteUser(roomID, &mautrix.ReqInviteUser{UserID: userID})
+		if err != nil {
+			return nil, err
+		}
+		_, err = intent.JoinRoomByID(roomID)
+		if err != nil {
+			return nil, err
+		}
+		setRoomMember(roomID.String(), userID.String(), string(event.MembershipJoin))
+	}
+	return intent, nil
+}
+
+//getMailSender returns the client posting an email: the puppet of its sender in appservice mode, the bot otherwise.
+//Encrypted rooms always get the bot, the puppets have no devices to encrypt with
+func getMailSender(roomID string, content *email) *mautrix.Client {
+	if !appserviceEnabled() || len(content.sendermails) == 0 || (roomStateStore{}).IsEncrypted(id.RoomID(roomID)) {
+		return matrixClient
+	}
+	intent, err := ensureGhost(id.RoomID(roomID), content.sendermails[0], content.sendernames[0], content.face)
+	if err != nil {
+		WriteLog(logError, "#121 ensureGhost: "+err.Error())
+		return matrixClient
+	}
+	return intent
+}
+
+//startAppservice listens for the requests of the homeserver
+func startAppservice() {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"", "/_matrix/app/v1"} {
+		mux.HandleFunc(prefix+"/transactions/", handleTransaction)
+		mux.HandleFunc(prefix+"/users/", handleUserQuery)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAppserviceError(w, http.StatusNotFound, "M_NOT_FOUND", "Not found")
+	})
+	WriteLog(info, "appservice listening on "+viper.GetString("appserviceListen"))
+	err := http.ListenAndServe(viper.GetString("appserviceListen"), mux)
+	WriteLog(critical, "#122 appservice listener: "+err.Error())
+}
+
+func writeAppserviceError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"errcode": code, "error": message})
+}
+
+//checkHSToken makes sure the request comes from the homeserver
+func checkHSToken(w http.ResponseWriter, r *http.Request) bool {
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(viper.GetString("hsToken"))) != 1 {
+		writeAppserviceError(w, http.StatusForbidden, "M_FORBIDDEN", "Bad hs_token")
+		return false
+	}
+	return true
+}
+
+//handleTransaction receives the events of the puppets' rooms.
+//Room messages and commands reach the bot through its sync, only invites for puppets are handled here
+func handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !checkHSToken(w, r) {
+		return
+	}
+	if r.Method != http.MethodPut {
+		writeAppserviceError(w, http.StatusMethodNotAllowed, "M_UNRECOGNIZED", "Use PUT")
+		return
+	}
+	var txn struct {
+		Events []*event.Event `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeAppserviceError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	for _, evt := range txn.Events {
+		if evt.Type.Type != event.StateMember.Type || evt.StateKey == nil {
+			continue
+		}
+		userID := id.UserID(*evt.StateKey)
+		if membership, _ := evt.Content.Raw["membership"].(string); membership == "invite" && isGhost(userID) {
+			handleGhostInvite(evt.RoomID, userID, evt.Sender)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+//handleGhostInvite lets puppets join bridged rooms and rejects other invites
+func handleGhostInvite(roomID id.RoomID, userID, inviter id.UserID) {
+	intent, err := ghostIntent(userID)
+	if err != nil {
+		return
+	}
+	if bridged, err := hasRoom(roomID.String()); err == nil && bridged {
+		if _, err := intent.JoinRoomByID(roomID); err != nil {
+			WriteLog(warn, userID.String()+" couldn't join "+roomID.String()+": "+err.Error())
+		}
+		return
+	}
+	WriteLog(info, "Rejected invite of "+userID.String()+" by "+inviter.String()+": room isn't bridged")
+	intent.LeaveRoom(roomID)
+}
+
+//handleUserQuery creates puppets the homeserver asks for
+func handleUserQuery(w http.ResponseWriter, r *http.Request) {
+	if !checkHSToken(w, r) {
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	userID := id.UserID(parts[len(parts)-1])
+	if !isGhost(userID) {
+		writeAppserviceError(w, http.StatusNotFound, "M_NOT_FOUND", "Not a puppet of this bridge")
+		return
+	}
+	if err := registerGhost(userID); err != nil {
+		WriteLog(logError, "#123 registerGhost: "+err.Error())
+		writeAppserviceError(w, http.StatusInternalServerError, "M_UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//message types which get attached to the email currently written
+var mediaTypes = map[event.MessageType]bool{
+	event.MsgFile:  true,
+	event.MsgImage: true,
+	event.MsgVideo: true,
+	event.MsgAudio: true,
+}
+
+//headers and body of an email with attachments
+const mailOverhead = 16 * 1024
+
+//maxMediaSize is the largest file which gets downloaded if the smtp server has no size limit
+const maxMediaSize = 64 * 1024 * 1024
+
+func isMediaMessage(content *event.MessageEventContent) bool {
+	return mediaTypes[content.MsgType]
+}
+
+//formatSize formats a size in bytes for humans
+func formatSize(size int64) string {
+	if size < 1024*1024 {
+		return strconv.FormatInt(size/1024, 10) + " KB"
+	}
+	return strconv.FormatFloat(float64(size)/(1024*1024), 'f', 1, 64) + " MB"
+}
+
+//attachmentName returns the filename of a media message.
+//Voice messages often have no filename, so its extension gets guessed by the mime type
+func attachmentName(content *event.MessageEventContent) string {
+	name := filepath.Base(strings.ReplaceAll(strings.Trim(content.Body, " "), "\\", "/"))
+	if name == "." || name == "/" || len(name) == 0 {
+		name = strings.TrimPrefix(string(content.MsgType), "m.")
+	}
+	if len(filepath.Ext(name)) == 0 && content.Info != nil {
+		if extensions, err := mime.ExtensionsByType(content.Info.MimeType); err == nil && len(extensions) > 0 {
+			name += extensions[0]
+		}
+	}
+	return name
+}
+
+//downloadMedia downloads the file of a media message. Files from encrypted rooms get decrypted.
+//Files larger than maxSize are refused before they are read completely
+func downloadMedia(client *mautrix.Client, content *event.MessageEventContent, maxSize int64) ([]byte, error) {
+	if content.Info != nil && int64(content.Info.Size) > maxSize {
+		return nil, errors.New("the file is larger than " + formatSize(maxSize))
+	}
+	url := content.URL
+	if content.File != nil {
+		url = content.File.URL
+	}
+	uri, err := url.Parse()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Client.Get(client.GetDownloadURL(uri))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("the homeserver responded with " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errors.New("the file is larger than " + formatSize(maxSize))
+	}
+	if content.File != nil {
+		return content.File.Decrypt(data)
+	}
+	return data, nil
+}
+
+//checkAttachmentSize returns an error if an email with an additional file of the given size
+//would be larger than the smtp server accepts
+func checkAttachmentSize(roomID string, writeTemp *emailTemp, size int64) error {
+	account, err := getSMTPAccount(roomID)
+	if err != nil {
+		return err
+	}
+	limit, err := getSMTPSizeLimit(account)
+	if err != nil {
+		WriteLog(warn, "couldn't get the size limit of "+account.host+": "+err.Error())
+		return nil
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	total := size + int64(len(writeTemp.body))
+	attachments, err := getAttachments(writeTemp.pkID)
+	if err != nil {
+		return err
+	}
+	for _, file := range attachments {
+		if stat, err := os.Stat(tempDir + file.fileName); err == nil {
+			total += stat.Size()
+		}
+	}
+	//attachments get base64 encoded, which adds a third
+	total = total*4/3 + mailOverhead
+	if total > limit {
+		return errors.New("The email would be too large (" + formatSize(total) + "). Your smtp server accepts up to " + formatSize(limit))
+	}
+	return nil
+}
+
+//attachMedia downloads a file, image, video or audio message and attaches it to the email currently written.
+//It's run in a goroutine, the download and the size limit of the smtp server mustn't block the sync
+func attachMedia(roomID id.RoomID, writeTemp *emailTemp, content *event.MessageEventContent, client *mautrix.Client) {
+	//refuse files which are too large before downloading them
+	if content.Info != nil && content.Info.Size > 0 {
+		if err := checkAttachmentSize(roomID.String(), writeTemp, int64(content.Info.Size)); err != nil {
+			client.SendText(roomID, "Couldn't attach file: "+err.Error())
+			return
+		}
+	}
+	data, err := downloadMedia(client, content, maxMediaSize)
+	if err != nil {
+		client.SendText(roomID, "Couldn't download file: "+err.Error())
+		return
+	}
+
+	err = checkAttachmentSize(roomID.String(), writeTemp, int64(len(data)))
+	if err != nil {
+		client.SendText(roomID, "Couldn't attach file: "+err.Error())
+		return
+	}
+	//the email may have been sent or canceled during the download
+	if _, err := getWritingTempByID(writeTemp.pkID); err != nil {
+		client.SendText(roomID, "Couldn't attach file: the email was sent or canceled before the file was downloaded")
+		return
+	}
+
+	file := attachment{
+		name:     attachmentName(content),
+		mimeType: content.GetInfo().MimeType,
+	}
+	if len(file.mimeType) == 0 {
+		file.mimeType = http.DetectContentType(data)
+	}
+	file.fileName = strconv.FormatInt(time.Now().Unix(), 10) + "_" + file.name
+
+	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
+		os.Mkdir(tempDir, os.ModePerm)
+	}
+	err = ioutil.WriteFile(tempDir+file.fileName, data, 0600)
+	if err != nil {
+		client.SendText(roomID, "Couldn't save file: "+err.Error())
+		return
+	}
+	err = addEmailAttachment(writeTemp.pkID, file)
+	if err != nil {
+		WriteLog(critical, "#94 addEmailAttachment: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #94")
+		deleteTempFile(file.fileName)
+		return
+	}
+	client.SendText(roomID, "File "+file.name+" ("+formatSize(int64(len(data)))+") attached! Use "+commandPrefix()+"rm "+file.name+" to remove it")
+}
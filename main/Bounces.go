@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//deliveryStatus is the delivery status of one receiver in a bounce
+type deliveryStatus struct {
+	recipient, action, status, diagnostic string
+}
+
+//deliveryReport is a parsed multipart/report delivery-status message (RFC 3464)
+type deliveryReport struct {
+	envelopeID, messageID string
+	recipients            []deliveryStatus
+}
+
+//threadRelation relates a message to a thread (MSC3440). Clients without threads show it as reply.
+//The mautrix version used doesn't know threads yet
+type threadRelation struct {
+	Type          string     `json:"rel_type"`
+	EventID       id.EventID `json:"event_id"`
+	IsFallingBack bool       `json:"is_falling_back"`
+	InReplyTo     struct {
+		EventID id.EventID `json:"event_id"`
+	} `json:"m.in_reply_to"`
+}
+
+type threadedMessage struct {
+	event.MessageEventContent
+	RelatesTo threadRelation `json:"m.relates_to"`
+}
+
+//newMessageID creates a Message-ID using the domain of the sender
+func newMessageID(sender string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(sender, "@"); i >= 0 && i < len(sender)-1 {
+		domain = sender[i+1:]
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "@" + domain + ">"
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+//envelopeID returns the id sent as ENVID, which is the local part of the Message-ID
+func envelopeID(messageID string) string {
+	messageID = strings.Trim(messageID, "<> ")
+	if i := strings.LastIndex(messageID, "@"); i >= 0 {
+		return messageID[:i]
+	}
+	return messageID
+}
+
+//readHeaderBlocks reads the header blocks of a delivery-status part, which are separated by blank lines
+func readHeaderBlocks(data []byte) []textproto.MIMEHeader {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	var blocks []textproto.MIMEHeader
+	for {
+		header, err := reader.ReadMIMEHeader()
+		if len(header) > 0 {
+			blocks = append(blocks, header)
+		}
+		if err != nil {
+			return blocks
+		}
+	}
+}
+
+//typedValue removes the type of a delivery-status field, eg. 'rfc822; jane@example.com'
+func typedValue(value string) string {
+	if i := strings.Index(value, ";"); i >= 0 {
+		return strings.Trim(value[i+1:], " ")
+	}
+	return strings.Trim(value, " ")
+}
+
+//parseReportPart reads a part of a delivery report. Returns false if the part doesn't belong to the report
+func parseReportPart(report *deliveryReport, contentType string, body io.Reader) bool {
+	switch strings.ToLower(contentType) {
+	case "message/delivery-status", "message/global-delivery-status":
+		{
+			data, _ := readAllLimited(body)
+			blocks := readHeaderBlocks(data)
+			for i, block := range blocks {
+				//the first block is about the message, the others about its receivers
+				if i == 0 {
+					report.envelopeID = strings.Trim(block.Get("Original-Envelope-Id"), " ")
+					continue
+				}
+				recipient := typedValue(block.Get("Original-Recipient"))
+				if len(recipient) == 0 {
+					recipient = typedValue(block.Get("Final-Recipient"))
+				}
+				report.recipients = append(report.recipients, deliveryStatus{
+					recipient:  recipient,
+					action:     strings.ToLower(strings.Trim(block.Get("Action"), " ")),
+					status:     strings.Trim(block.Get("Status"), " "),
+					diagnostic: typedValue(block.Get("Diagnostic-Code")),
+				})
+			}
+		}
+	case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+		{
+			data, _ := readAllLimited(body)
+			blocks := readHeaderBlocks(data)
+			if len(blocks) > 0 {
+				report.messageID = strings.Trim(blocks[0].Get("Message-Id"), " ")
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+//readAllLimited reads a part of a report. The returned email can be large, but only its headers are needed
+func readAllLimited(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(r, 256*1024))
+	return buf.Bytes(), err
+}
+
+//hasFailed returns true if the email couldn't be delivered to at least one receiver
+func (report *deliveryReport) hasFailed() bool {
+	for _, recipient := range report.recipients {
+		if recipient.action == "failed" {
+			return true
+		}
+	}
+	return len(report.recipients) == 0
+}
+
+//handleBounce posts a bounce in the thread of the message confirming the bounced email.
+//Returns false if the bounce doesn't belong to an email sent from the room
+func handleBounce(roomID string, report *deliveryReport, ref mailRef) bool {
+	sent, err := getSentMail(roomID, report.envelopeID, report.messageID)
+	if err != nil {
+		return false
+	}
+
+	text := "❌ Your email \"" + sent.subject + "\" couldn't be delivered"
+	if !report.hasFailed() {
+		text = "⏳ Your email \"" + sent.subject + "\" is delayed"
+	}
+	for _, recipient := range report.recipients {
+		text += "\n" + recipient.recipient + ": " + recipient.action
+		if len(recipient.status) > 0 {
+			text += " (" + recipient.status + ")"
+		}
+		if len(recipient.diagnostic) > 0 {
+			text += " " + recipient.diagnostic
+		}
+	}
+
+	content := threadedMessage{MessageEventContent: event.MessageEventContent{MsgType: event.MsgText, Body: text}}
+	content.RelatesTo.Type = "m.thread"
+	content.RelatesTo.EventID = id.EventID(sent.eventID)
+	content.RelatesTo.IsFallingBack = true
+	content.RelatesTo.InReplyTo.EventID = id.EventID(sent.eventID)
+	resp, err := matrixClient.SendMessageEvent(id.RoomID(roomID), event.EventMessage, &content)
+	if err != nil {
+		WriteLog(logError, "#105 posting bounce: "+err.Error())
+		return false
+	}
+	saveMailEvent(roomID, resp, nil, ref)
+
+	if report.hasFailed() {
+		if _, err := matrixClient.SendReaction(id.RoomID(roomID), id.EventID(sent.eventID), "❌"); err != nil {
+			WriteLog(logError, "#105 reacting to bounce: "+err.Error())
+		}
+	}
+	return true
+}
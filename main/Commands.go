@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//commandMode tells if a command is used in a room or while writing an email
+type commandMode int
+
+const (
+	modeRoom commandMode = 1 << iota
+	//modeDraft commands edit the email which is being written
+	modeDraft
+)
+
+//commandState is what a room needs before a command can be used
+type commandState int
+
+const (
+	//stateBridged requires the room to be bridged to an account
+	stateBridged commandState = 1 << iota
+	stateIMAP
+	stateSMTP
+)
+
+//permissionLevel is the permission a user needs to use a command
+type permissionLevel int
+
+const (
+	//permMember commands can be used by every member of the room
+	permMember permissionLevel = iota
+	//permManage commands change the settings of the bridge or remove it
+	permManage
+	//permCredentials commands set the login data of the accounts
+	permCredentials
+)
+
+type command struct {
+	name    string
+	aliases []string
+	//usage describes the arguments, eg. <list/add/rm> <nickname>
+	usage       string
+	description string
+	//describe builds the description if it mentions other commands, their prefix is only known once the config is loaded
+	describe   func() string
+	mode       commandMode
+	state      commandState
+	permission permissionLevel
+	//minArgs is the number of arguments the command needs at least
+	minArgs int
+	//rawArgs commands parse the text after their name themselves, quotes aren't removed
+	rawArgs bool
+	//secret returns true if the message contains credentials. It is redacted before the command is checked
+	secret  func(ctx *commandContext) bool
+	handler func(ctx *commandContext)
+}
+
+//commandContext is the message a command was called with
+type commandContext struct {
+	client *mautrix.Client
+	evt    *event.Event
+	roomID id.RoomID
+	cmd    *command
+	//args are the words of the first line after the command name. Double quotes group words
+	args []string
+	//raw is the whole text after the command name
+	raw string
+	//writeTemp is the email being written in modeDraft
+	writeTemp *emailTemp
+}
+
+func (ctx *commandContext) reply(text string) {
+	ctx.client.SendText(ctx.roomID, text)
+}
+
+func (ctx *commandContext) usage() string {
+	return "Usage: " + commandPrefix() + ctx.cmd.name + " " + ctx.cmd.usage
+}
+
+//commands is the registry of all commands. The order is used for !help
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "login", usage: "<imap/smtp>", description: "bridges this room to your email account. Asks for the login data step by step", mode: modeRoom, permission: permCredentials, handler: handleLoginCommand},
+		{name: "set", usage: "<imap/smtp> <host/port/security/certificate/username/password/mailbox> <value>", description: "changes a value of the login data. Without value you are asked for it", mode: modeRoom, state: stateBridged, permission: permCredentials, minArgs: 2, rawArgs: true, secret: hasSecretValue, handler: handleSetCommand},
+		{name: "setup", usage: "imap/smtp, host:port, username(em@ail.com), password, <mailbox (only for imap)>, ignoreSSLcert(true/false)", description: "creates a bridge for this room", mode: modeRoom, permission: permCredentials, minArgs: 1, rawArgs: true, secret: func(ctx *commandContext) bool {
+			return true
+		}, handler: handleSetupCommand},
+		{name: "ping", description: "gets information about the email bridge for this room", mode: modeRoom, state: stateBridged, handler: handlePingCommand},
+		{name: "help", usage: "<command>", description: "shows this command help overview or the help of a command", mode: modeRoom | modeDraft, handler: handleHelpCommand},
+		{name: "verify", usage: "<yes/no>", description: "confirms if the emojis of a device verification match", mode: modeRoom, minArgs: 1, handler: handleVerifyCommand},
+		{name: "write", usage: "<--template name> <--receipt> (receiver(s): emails or contact nicknames, eg. \"Doe, Jane\" <jane@example.com>, bob) <markdown default:true>", description: "sends an email to a given address", mode: modeRoom, state: stateBridged | stateSMTP, minArgs: 1, rawArgs: true, handler: handleWriteCommand},
+		{name: "mailboxes", description: "shows a list with all mailboxes available on your IMAP server", mode: modeRoom, state: stateIMAP, handler: func(ctx *commandContext) {
+			viewMailboxes(ctx.roomID.String(), ctx.client)
+		}},
+		{name: "setmailbox", usage: "(mailbox)", description: "changes the mailbox for the room", mode: modeRoom, state: stateIMAP, permission: permManage, minArgs: 1, handler: handleSetMailboxCommand},
+		{name: "mailbox", description: "shows the currently selected mailbox", mode: modeRoom, state: stateIMAP, handler: func(ctx *commandContext) {
+			viewMailbox(ctx.roomID.String(), ctx.client)
+		}},
+		{name: "setsentfolder", usage: "(mailbox/auto)", description: "sets the mailbox sent emails are saved to", mode: modeRoom, state: stateIMAP, permission: permManage, minArgs: 1, rawArgs: true, handler: handleSetSentFolderCommand},
+		{name: "view", usage: "<mailbox/mailboxes/sentfolder/blocklist>", description: "shows the settings of the imap account", mode: modeRoom, state: stateIMAP, handler: handleViewCommand},
+		{name: "setsmtp", usage: "<security/auth/transport> <value>", description: "sets how emails are sent: TLS/STARTTLS, the login mechanism and smtp, sendmail or lmtp", mode: modeRoom, state: stateSMTP, permission: permManage, handler: func(ctx *commandContext) {
+			handleSetSMTPCommand(ctx.roomID, ctx.evt.Sender, ctx.args, ctx.client)
+		}},
+		{name: "test", usage: "smtp", description: "sends a test email to yourself", mode: modeRoom, state: stateSMTP, minArgs: 1, handler: handleTestCommand},
+		{name: "sethtml", usage: "(on/off or true/false)", description: "sets HTML-rendering for messages on/off", mode: modeRoom, state: stateIMAP, permission: permManage, minArgs: 1, handler: handleSetHTMLCommand},
+		{name: "blocklist", aliases: []string{"bl"}, usage: "<add/delete/clear/view> <email address>", description: "doesn't show emails from the given addresses. Wildcards (like *@evilEmailAddress.com) are supported", mode: modeRoom, state: stateIMAP, handler: handleBlocklistCommand},
+		{name: "outbox", usage: "<list/retry/cancel> <id>", description: "shows, retries or cancels emails which couldn't be sent yet", mode: modeRoom, state: stateSMTP, handler: func(ctx *commandContext) {
+			handleOutboxCommand(ctx.roomID, ctx.args, ctx.client)
+		}},
+		{name: "contact", aliases: []string{"contacts"}, usage: "<list/add/rm/import> <nickname> <email> <name>", describe: func() string {
+			return "manages your contacts. Reply to a bridged email with " + commandPrefix() + "contact add <nickname> to add its sender. Reply to a vCard file with " + commandPrefix() + "contact import to import it"
+		}, mode: modeRoom, state: stateBridged, handler: func(ctx *commandContext) {
+			handleContactCommand(ctx)
+		}},
+		{name: "ack", description: "reply to a bridged email with this to send the read receipt its sender asked for", mode: modeRoom, state: stateIMAP | stateSMTP, handler: func(ctx *commandContext) {
+			//the email is downloaded from the imap server again to read the receipt address, that mustn't block the sync.
+			//Sending the receipt is done by the outbox in the background anyway
+			go handleAckCommand(ctx.roomID, ctx.evt.Content.AsMessage().GetReplyTo(), ctx.client)
+		}},
+		{name: "forward", usage: "<email(s)> [inline/attach]", description: "reply to a bridged email with this to forward it (attach sends it as .eml file)", mode: modeRoom, state: stateIMAP | stateSMTP, rawArgs: true, handler: func(ctx *commandContext) {
+			go handleForwardCommand(ctx.roomID, ctx.evt.Content.AsMessage().GetReplyTo(), ctx.raw, ctx.client)
+		}},
+		{name: "scheduled", usage: "<list/cancel> <id>", description: "shows or cancels scheduled emails", mode: modeRoom, handler: func(ctx *commandContext) {
+			handleScheduledCommand(ctx.roomID, ctx.args, ctx.client)
+		}},
+		{name: "settimezone", usage: "(timezone)", description: "sets the timezone used for scheduled emails", mode: modeRoom, state: stateBridged, permission: permManage, minArgs: 1, handler: handleSetTimezoneCommand},
+		{name: "setundo", usage: "(seconds)", describe: func() string {
+			return "waits the given seconds before sending an email, so it can be canceled with " + commandPrefix() + "undo"
+		}, mode: modeRoom, state: stateBridged, permission: permManage, minArgs: 1, handler: handleSetUndoCommand},
+		{name: "undo", description: "cancels the email sent last if it wasn't sent yet", mode: modeRoom, handler: func(ctx *commandContext) {
+			undoSend(ctx.roomID, ctx.client)
+		}},
+		{name: "signature", usage: "<view/set/setaccount/clear> <signature>", description: "sets the signature added to your emails", mode: modeRoom, state: stateSMTP, rawArgs: true, handler: func(ctx *commandContext) {
+			handleSignatureCommand(ctx.roomID, ctx.raw, ctx.client)
+		}},
+		{name: "template", usage: "<list/show/add/rm> <name>", describe: func() string {
+			return "manages templates for emails. Use them with " + commandPrefix() + "write --template <name> <email>"
+		}, mode: modeRoom, state: stateBridged, rawArgs: true, handler: func(ctx *commandContext) {
+			handleTemplateCommand(ctx.roomID, ctx.raw, ctx.client)
+		}},
+		{name: "space", usage: "<on/sync/off>", description: "creates a space for the account with a room for every imap folder", mode: modeRoom, state: stateIMAP, permission: permManage, minArgs: 1, handler: func(ctx *commandContext) {
+			handleSpaceCommand(ctx.roomID, ctx.args, ctx.client)
+		}},
+		{name: "conversations", usage: "<on/off>", description: "creates a room for every new email thread. Messages in it are sent as replies", mode: modeRoom, state: stateBridged, permission: permManage, minArgs: 1, handler: func(ctx *commandContext) {
+			handleConversationsCommand(ctx.roomID, ctx.args, ctx.client)
+		}},
+		{name: "logout", description: "removes the email bridge from the current room", mode: modeRoom, permission: permManage, handler: handleLogoutCommand},
+		{name: "leave", description: "unbridges the current room and kicks the bot", mode: modeRoom, permission: permManage, handler: handleLeaveCommand},
+
+		{name: "send", usage: "<at 2006-01-02 15:04/in 2h>", description: "sends the email now or at the given time", mode: modeDraft, rawArgs: true, handler: handleSendCommand},
+		{name: "rm", usage: "<file>", description: "removes the given attachment from the email", mode: modeDraft, minArgs: 1, rawArgs: true, handler: handleRemoveAttachmentCommand},
+		{name: "template", usage: "save <name>", description: "saves the email as template", mode: modeDraft, minArgs: 2, handler: handleTemplateSaveCommand},
+		{name: "preview", description: "shows the email like it will be sent", mode: modeDraft, handler: func(ctx *commandContext) {
+			previewDraft(ctx.roomID, ctx.writeTemp, ctx.client)
+		}},
+		{name: "subject", usage: "<subject>", description: "changes the subject", mode: modeDraft, rawArgs: true, handler: handleSubjectCommand},
+		{name: "to", usage: "<email(s)>", description: "changes the receivers", mode: modeDraft, rawArgs: true, handler: handleToCommand},
+		{name: "lines", description: "shows the email with line numbers", mode: modeDraft, handler: func(ctx *commandContext) {
+			viewLines(ctx.roomID, ctx.writeTemp, ctx.client)
+		}},
+		{name: "edit", usage: "<line> <text>", description: "replaces the given line", mode: modeDraft, minArgs: 2, rawArgs: true, handler: handleEditLinesCommand},
+		{name: "insert", usage: "<line> <text>", description: "inserts a line before the given line", mode: modeDraft, minArgs: 2, rawArgs: true, handler: handleEditLinesCommand},
+		{name: "delete-line", usage: "<line>", description: "removes the given line", mode: modeDraft, minArgs: 1, rawArgs: true, handler: handleEditLinesCommand},
+		{name: "undo-line", description: "removes the last line", mode: modeDraft, rawArgs: true, handler: handleEditLinesCommand},
+		{name: "clear", description: "removes all lines", mode: modeDraft, handler: func(ctx *commandContext) {
+			draftUpdated(ctx, saveDraftLines(ctx.writeTemp.pkID, nil))
+		}},
+		{name: "cancel", description: "cancels the email", mode: modeDraft, handler: func(ctx *commandContext) {
+			ctx.reply("Mail canceled")
+			deleteWritingTemp(ctx.roomID.String())
+		}},
+	}
+}
+
+//commandPrefix returns the prefix of the commands, ! by default
+func commandPrefix() string {
+	if prefix := viper.GetString("commandPrefix"); len(prefix) > 0 {
+		return prefix
+	}
+	return "!"
+}
+
+//findCommand returns the command with the given name or alias available in the mode, nil if there is none
+func findCommand(name string, mode commandMode) *command {
+	name = strings.ToLower(name)
+	for _, cmd := range commands {
+		if cmd.mode&mode == 0 {
+			continue
+		}
+		if cmd.name == name || contains(cmd.aliases, name) {
+			return cmd
+		}
+	}
+	return nil
+}
+
+//parseCommand splits a message into the name of the command and the text after it.
+//Returns false if the message doesn't start with the prefix
+func parseCommand(message, prefix string) (name, raw string, ok bool) {
+	if !strings.HasPrefix(message, prefix) || len(message) == len(prefix) {
+		return "", "", false
+	}
+	message = message[len(prefix):]
+	end := strings.IndexAny(message, " \t\r\n")
+	if end == -1 {
+		return message, "", true
+	}
+	return message[:end], strings.Trim(message[end:], " \t\r\n"), true
+}
+
+//splitArgs splits arguments at spaces. Double quotes group words and a backslash escapes the next character
+func splitArgs(text string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg, escaped := false, false
+	quoted := false
+	for _, c := range text {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inArg = true, true
+		case c == '"':
+			quoted, inArg = !quoted, true
+		case quoted:
+			current.WriteRune(c)
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("Missing closing quote")
+	}
+	if escaped {
+		return nil, errors.New("Nothing to escape at the end")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+//handleCommand runs the command of a message. writeTemp is the email being written, if there is one.
+//Returns false if the message isn't a command
+func handleCommand(client *mautrix.Client, evt *event.Event, writeTemp *emailTemp) bool {
+	name, raw, ok := parseCommand(evt.Content.AsMessage().Body, commandPrefix())
+	if !ok {
+		return false
+	}
+	mode := modeRoom
+	if writeTemp != nil {
+		mode = modeDraft
+	}
+	cmd := findCommand(name, mode)
+	if cmd == nil {
+		//while writing, unknown commands are lines of the email
+		if writeTemp != nil || !reportUnknownCommands(evt.RoomID) {
+			return false
+		}
+		client.SendText(evt.RoomID, "Command not found! Use "+commandPrefix()+"help to list the commands")
+		return true
+	}
+
+	ctx := &commandContext{client: client, evt: evt, roomID: evt.RoomID, cmd: cmd, raw: raw, writeTemp: writeTemp}
+	firstLine := strings.SplitN(raw, "\n", 2)[0]
+	var argsErr error
+	if cmd.rawArgs {
+		ctx.args = strings.Fields(firstLine)
+	} else {
+		ctx.args, argsErr = splitArgs(strings.TrimRight(firstLine, "\r"))
+	}
+	//credentials are removed even if the command can't be used
+	if cmd.secret != nil && cmd.secret(ctx) {
+		redactCredentials(client, evt)
+	}
+	if argsErr != nil {
+		ctx.reply(argsErr.Error() + "\r\n" + ctx.usage())
+		return true
+	}
+	if len(ctx.args) < cmd.minArgs {
+		ctx.reply(ctx.usage())
+		return true
+	}
+	//users without permission don't learn how the room is set up
+	if !hasPermission(evt.RoomID, evt.Sender, cmd.permission) {
+		ctx.reply(permissionDenied(evt.RoomID, cmd))
+		return true
+	}
+	if !checkCommandState(ctx) {
+		return true
+	}
+	cmd.handler(ctx)
+	return true
+}
+
+//reportUnknownCommands returns true if the room is told about unknown commands.
+//Rooms which aren't bridged may be shared with other bots, messages in conversation rooms are replies to the email
+func reportUnknownCommands(roomID id.RoomID) bool {
+	if has, err := hasRoom(accountRoomID(roomID.String())); err != nil || !has {
+		return false
+	}
+	conv, err := getConversation(roomID.String())
+	return err == nil && conv == nil
+}
+
+//checkCommandState tells the user if the room isn't set up for a command
+func checkCommandState(ctx *commandContext) bool {
+	state := ctx.cmd.state
+	if state&stateBridged != 0 {
+		if has, err := hasRoom(ctx.roomID.String()); err != nil {
+			WriteLog(logError, "#06 hasRoom: "+err.Error())
+			ctx.reply("An server-error occured Errorcode: #06")
+			return false
+		} else if !has {
+			ctx.reply("You have to login to use this command! Type " + commandPrefix() + "login for more information")
+			return false
+		}
+	}
+	if state&(stateIMAP|stateSMTP) == 0 {
+		return true
+	}
+	imapAccID, smtpAccID, err := getRoomAccounts(ctx.roomID.String())
+	if err != nil {
+		WriteLog(critical, "#48 getRoomAccounts: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #48")
+		return false
+	}
+	missingIMAP := state&stateIMAP != 0 && imapAccID == -1
+	missingSMTP := state&stateSMTP != 0 && smtpAccID == -1
+	switch {
+	case missingIMAP && state&stateSMTP != 0:
+		ctx.reply("You need an imap and an smtp account to use this command. Type " + commandPrefix() + "help or " + commandPrefix() + "login for more information")
+	case missingSMTP && state&stateIMAP != 0:
+		ctx.reply("You need an imap and an smtp account to use this command. Type " + commandPrefix() + "help or " + commandPrefix() + "login for more information")
+	case missingIMAP:
+		ctx.reply("You have to setup an IMAP account to use this command. Use " + commandPrefix() + "setup or " + commandPrefix() + "login for more informations")
+	case missingSMTP:
+		ctx.reply("You have to setup an SMTP account to use this command. Use " + commandPrefix() + "setup or " + commandPrefix() + "login for more informations")
+	default:
+		return true
+	}
+	return false
+}
+
+func handleHelpCommand(ctx *commandContext) {
+	if len(ctx.args) > 0 {
+		name := strings.TrimPrefix(ctx.args[0], commandPrefix())
+		mode := modeRoom
+		if ctx.writeTemp != nil {
+			mode = modeDraft
+		}
+		cmd := findCommand(name, mode)
+		if cmd == nil {
+			cmd = findCommand(name, modeRoom|modeDraft)
+		}
+		if cmd == nil {
+			ctx.reply("There is no command " + name + ". Use " + commandPrefix() + "help to list the commands")
+			return
+		}
+		ctx.reply(commandHelp(cmd))
+		return
+	}
+	ctx.reply(helpText())
+}
+
+//helpText lists all commands
+func helpText() string {
+	text := "-------- Help --------\r\n"
+	for _, cmd := range commands {
+		if cmd.mode&modeRoom != 0 {
+			text += commandLine(cmd) + "\r\n"
+		}
+	}
+	text += "\r\n---- Email writing commands ----\r\n"
+	for _, cmd := range commands {
+		if cmd.mode&modeDraft != 0 {
+			text += commandLine(cmd) + "\r\n"
+		}
+	}
+	return text + "\r\nUse " + commandPrefix() + "help <command> to show the details of a command"
+}
+
+func commandLine(cmd *command) string {
+	line := commandPrefix() + cmd.name
+	if len(cmd.usage) > 0 {
+		line += " " + cmd.usage
+	}
+	description := cmd.description
+	if cmd.describe != nil {
+		description = cmd.describe()
+	}
+	return line + " - " + description
+}
+
+//commandHelp describes a command for '!help <command>'
+func commandHelp(cmd *command) string {
+	text := commandLine(cmd) + "\r\n"
+	if len(cmd.aliases) > 0 {
+		text += "Aliases: " + commandPrefix() + strings.Join(cmd.aliases, ", "+commandPrefix()) + "\r\n"
+	}
+	switch {
+	case cmd.mode == modeDraft:
+		text += "Only available while writing an email\r\n"
+	case cmd.mode == modeRoom|modeDraft:
+		text += "Also available while writing an email\r\n"
+	}
+	var needs []string
+	if cmd.state&stateBridged != 0 {
+		needs = append(needs, "a bridged room")
+	}
+	if cmd.state&stateIMAP != 0 {
+		needs = append(needs, "an imap account")
+	}
+	if cmd.state&stateSMTP != 0 {
+		needs = append(needs, "an smtp account")
+	}
+	if len(needs) > 0 {
+		text += "Needs " + strings.Join(needs, " and ") + "\r\n"
+	}
+	switch cmd.permission {
+	case permManage:
+		text += "Changes the settings of the bridge\r\n"
+	case permCredentials:
+		text += "Changes the login data of the accounts\r\n"
+	}
+	return text
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testUser  = id.UserID("@user:example.com")
+	testAdmin = id.UserID("@admin:example.com")
+)
+
+//testServer is a homeserver which records the messages and redactions of the bridge
+type testServer struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	sent       []string
+	redactions []string
+	//powerLevels are returned for every room
+	powerLevels map[id.UserID]int
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodPut && strings.Contains(path, "/send/m.room.message/"):
+		var content event.MessageEventContent
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.sent = append(s.sent, content.Body)
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	case r.Method == http.MethodPut && strings.Contains(path, "/redact/"):
+		s.redactions = append(s.redactions, path)
+		w.Write([]byte(`{"event_id":"$redaction"}`))
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/state/m.room.power_levels/"):
+		json.NewEncoder(w).Encode(event.PowerLevelsEventContent{Users: s.powerLevels})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+	}
+}
+
+//replies returns the messages sent since the last call
+func (s *testServer) replies() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sent := s.sent
+	s.sent = nil
+	return sent
+}
+
+//setupTestBridge creates an empty database, a log file and a client talking to a test homeserver
+func setupTestBridge(t *testing.T) (*mautrix.Client, *testServer) {
+	dir := t.TempDir()
+	var err error
+	logfile, err = ioutil.TempFile(dir, "test*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = sql.Open("sqlite3", dir+"/data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createAllTables()
+
+	server := &testServer{powerLevels: map[id.UserID]int{testAdmin: 100}}
+	server.Server = httptest.NewServer(server)
+	client, err := mautrix.NewClient(server.URL, "@bot:example.com", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrixClient = client
+	viper.Set("managePowerLevel", 50)
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+		logfile.Close()
+		viper.Reset()
+	})
+	return client, server
+}
+
+//addTestRoom bridges a room to the given accounts. -1 means no account
+func addTestRoom(t *testing.T, roomID string, imapAccount, smtpAccount int) {
+	if insertNewRoom(roomID, testAdmin.String(), 30) == -1 {
+		t.Fatal("couldn't insert room " + roomID)
+	}
+	if err := saveImapAcc(roomID, imapAccount); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSMTPAcc(roomID, smtpAccount); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMessage(roomID id.RoomID, sender id.UserID, body string) *event.Event {
+	return &event.Event{
+		ID:     "$message",
+		RoomID: roomID,
+		Sender: sender,
+		Type:   event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    body,
+		}},
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		message, prefix string
+		name, raw       string
+		ok              bool
+	}{
+		{"!send", "!", "send", "", true},
+		{"!write jane@example.com false", "!", "write", "jane@example.com false", true},
+		{"!help  setup ", "!", "help", "setup", true},
+		{"mail:help setup", "mail:", "help", "setup", true},
+		{"!help setup", "mail:", "", "", false},
+		{"!", "!", "", "", false},
+		{"mail:", "mail:", "", "", false},
+		{"hello !send", "!", "", "", false},
+		{"!lines\r\n2", "!", "lines", "2", true},
+		{"!template add news\nSubject\nBody", "!", "template", "add news\nSubject\nBody", true},
+	}
+	for _, test := range tests {
+		name, raw, ok := parseCommand(test.message, test.prefix)
+		if name != test.name || raw != test.raw || ok != test.ok {
+			t.Errorf("parseCommand(%q, %q) = %q, %q, %v; want %q, %q, %v", test.message, test.prefix, name, raw, ok, test.name, test.raw, test.ok)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		args []string
+		err  string
+	}{
+		{"", nil, ""},
+		{"add  bob\tbob@example.com", []string{"add", "bob", "bob@example.com"}, ""},
+		{`"Doe, Jane" <jane@example.com>`, []string{"Doe, Jane", "<jane@example.com>"}, ""},
+		{`set "" x`, []string{"set", "", "x"}, ""},
+		{`a" "b`, []string{"a b"}, ""},
+		{`say\ hi`, []string{"say hi"}, ""},
+		{`\"quoted\"`, []string{`"quoted"`}, ""},
+		{`back\\slash`, []string{`back\slash`}, ""},
+		{`add "Doe, Jane`, nil, "Missing closing quote"},
+		{`add bob\`, nil, "Nothing to escape at the end"},
+	}
+	for _, test := range tests {
+		args, err := splitArgs(test.text)
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("splitArgs(%q) error = %v; want %q", test.text, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitArgs(%q) failed: %v", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArgs(%q) = %q; want %q", test.text, args, test.args)
+		}
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  commandMode
+		found string
+		usage string
+	}{
+		{"write", modeRoom, "write", ""},
+		{"WRITE", modeRoom, "write", ""},
+		{"bl", modeRoom, "blocklist", ""},
+		{"contacts", modeRoom, "contact", ""},
+		{"write", modeDraft, "", ""},
+		{"send", modeRoom, "", ""},
+		{"send", modeDraft, "send", ""},
+		{"undo", modeRoom, "undo", ""},
+		{"undo", modeDraft, "", ""},
+		{"template", modeRoom, "template", "<list/show/add/rm> <name>"},
+		{"template", modeDraft, "template", "save <name>"},
+		{"template", modeRoom | modeDraft, "template", "<list/show/add/rm> <name>"},
+		{"unknown", modeRoom | modeDraft, "", ""},
+	}
+	for _, test := range tests {
+		cmd := findCommand(test.name, test.mode)
+		if len(test.found) == 0 {
+			if cmd != nil {
+				t.Errorf("findCommand(%q, %d) = %s; want none", test.name, test.mode, cmd.name)
+			}
+			continue
+		}
+		if cmd == nil || cmd.name != test.found {
+			t.Errorf("findCommand(%q, %d) = %v; want %s", test.name, test.mode, cmd, test.found)
+			continue
+		}
+		if len(test.usage) > 0 && cmd.usage != test.usage {
+			t.Errorf("findCommand(%q, %d) found usage %q; want %q", test.name, test.mode, cmd.usage, test.usage)
+		}
+	}
+}
+
+func TestRegisteredCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       commandMode
+		state      commandState
+		permission permissionLevel
+		minArgs    int
+		secret     bool
+	}{
+		{"login", modeRoom, 0, permCredentials, 0, false},
+		{"set", modeRoom, stateBridged, permCredentials, 2, true},
+		{"setup", modeRoom, 0, permCredentials, 1, true},
+		{"help", modeRoom | modeDraft, 0, permMember, 0, false},
+		{"write", modeRoom, stateBridged | stateSMTP, permMember, 1, false},
+		{"setmailbox", modeRoom, stateIMAP, permManage, 1, false},
+		{"setsmtp", modeRoom, stateSMTP, permManage, 0, false},
+		{"ack", modeRoom, stateIMAP | stateSMTP, permMember, 0, false},
+		{"forward", modeRoom, stateIMAP | stateSMTP, permMember, 0, false},
+		{"setundo", modeRoom, stateBridged, permManage, 1, false},
+		{"undo", modeRoom, 0, permMember, 0, false},
+		{"space", modeRoom, stateIMAP, permManage, 1, false},
+		{"logout", modeRoom, 0, permManage, 0, false},
+		{"leave", modeRoom, 0, permManage, 0, false},
+		{"send", modeDraft, 0, permMember, 0, false},
+		{"rm", modeDraft, 0, permMember, 1, false},
+		{"edit", modeDraft, 0, permMember, 2, false},
+	}
+	for _, test := range tests {
+		var cmd *command
+		for _, c := range commands {
+			if c.name == test.name && c.mode&test.mode != 0 {
+				cmd = c
+				break
+			}
+		}
+		if cmd == nil {
+			t.Errorf("%s isn't registered", test.name)
+			continue
+		}
+		if cmd.mode != test.mode {
+			t.Errorf("%s: mode = %d; want %d", test.name, cmd.mode, test.mode)
+		}
+		if cmd.state != test.state {
+			t.Errorf("%s: state = %d; want %d", test.name, cmd.state, test.state)
+		}
+		if cmd.permission != test.permission {
+			t.Errorf("%s: permission = %d; want %d", test.name, cmd.permission, test.permission)
+		}
+		if cmd.minArgs != test.minArgs {
+			t.Errorf("%s: minArgs = %d; want %d", test.name, cmd.minArgs, test.minArgs)
+		}
+		if secret := cmd.secret != nil; secret != test.secret {
+			t.Errorf("%s: secret = %v; want %v", test.name, secret, test.secret)
+		}
+	}
+
+	//every command needs a handler and a description
+	for _, cmd := range commands {
+		if cmd.handler == nil {
+			t.Errorf("%s has no handler", cmd.name)
+		}
+		if len(cmd.description) == 0 && cmd.describe == nil {
+			t.Errorf("%s has no description", cmd.name)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("commandPrefix", "mail:")
+	tests := []struct {
+		name string
+		mode commandMode
+		line string
+	}{
+		{"setundo", modeRoom, "mail:setundo (seconds) - waits the given seconds before sending an email, so it can be canceled with mail:undo"},
+		{"template", modeRoom, "mail:template <list/show/add/rm> <name> - manages templates for emails. Use them with mail:write --template <name> <email>"},
+		{"cancel", modeDraft, "mail:cancel - cancels the email"},
+	}
+	for _, test := range tests {
+		cmd := findCommand(test.name, test.mode)
+		if cmd == nil {
+			t.Errorf("%s isn't registered", test.name)
+			continue
+		}
+		if line := commandLine(cmd); !strings.HasPrefix(line, test.line) {
+			t.Errorf("commandLine(%s) = %q; want %q", test.name, line, test.line)
+		}
+	}
+}
+
+func TestCheckCommandState(t *testing.T) {
+	client, server := setupTestBridge(t)
+	addTestRoom(t, "!imap:example.com", 1, -1)
+	addTestRoom(t, "!smtp:example.com", -1, 1)
+	addTestRoom(t, "!both:example.com", 1, 1)
+
+	tests := []struct {
+		roomID id.RoomID
+		state  commandState
+		ok     bool
+		reply  string
+	}{
+		{"!new:example.com", 0, true, ""},
+		{"!new:example.com", stateBridged, false, "You have to login"},
+		{"!new:example.com", stateIMAP, false, "You have to setup an IMAP account"},
+		{"!imap:example.com", stateBridged, true, ""},
+		{"!imap:example.com", stateIMAP, true, ""},
+		{"!imap:example.com", stateSMTP, false, "You have to setup an SMTP account"},
+		{"!smtp:example.com", stateBridged | stateSMTP, true, ""},
+		{"!smtp:example.com", stateIMAP | stateSMTP, false, "You need an imap and an smtp account"},
+		{"!imap:example.com", stateIMAP | stateSMTP, false, "You need an imap and an smtp account"},
+		{"!both:example.com", stateIMAP | stateSMTP, true, ""},
+	}
+	for _, test := range tests {
+		ctx := &commandContext{client: client, roomID: test.roomID, cmd: &command{name: "test", state: test.state}}
+		ok := checkCommandState(ctx)
+		replies := server.replies()
+		if ok != test.ok {
+			t.Errorf("checkCommandState(%s, %d) = %v; want %v", test.roomID, test.state, ok, test.ok)
+		}
+		if len(test.reply) == 0 && len(replies) > 0 {
+			t.Errorf("checkCommandState(%s, %d) replied %q", test.roomID, test.state, replies)
+		} else if len(test.reply) > 0 && (len(replies) != 1 || !strings.HasPrefix(replies[0], test.reply)) {
+			t.Errorf("checkCommandState(%s, %d) replied %q; want %q", test.roomID, test.state, replies, test.reply)
+		}
+	}
+}
+
+func TestHandleCommand(t *testing.T) {
+	client, server := setupTestBridge(t)
+	addTestRoom(t, "!bridged:example.com", 1, 1)
+	if _, err := insertConversation(&conversation{parentRoomID: "!bridged:example.com", roomID: "!conv:example.com", subject: "Hi", address: "bob@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var called []string
+	record := func(ctx *commandContext) {
+		called = append(called, ctx.cmd.name+" "+strings.Join(ctx.args, "|"))
+	}
+	registry := commands
+	commands = []*command{
+		{name: "echo", usage: "<text>", mode: modeRoom | modeDraft, minArgs: 1, handler: record},
+		{name: "raw", usage: "<text>", mode: modeRoom, minArgs: 2, rawArgs: true, handler: record},
+		{name: "draft", mode: modeDraft, handler: record},
+		{name: "manage", usage: "<value>", mode: modeRoom, state: stateBridged, permission: permManage, minArgs: 1, handler: record},
+		{name: "secret", mode: modeRoom, permission: permManage, handler: record, secret: func(ctx *commandContext) bool {
+			return true
+		}},
+	}
+	defer func() {
+		commands = registry
+	}()
+
+	tests := []struct {
+		prefix, body string
+		roomID       id.RoomID
+		sender       id.UserID
+		writing      bool
+		handled      bool
+		called       string
+		reply        string
+		redacted     bool
+	}{
+		{body: "hello", handled: false},
+		{body: "!echo a \"b c\"", handled: true, called: "echo a|b c"},
+		{body: "!ECHO a", handled: true, called: "echo a"},
+		{body: "!echo", handled: true, reply: "Usage: !echo <text>"},
+		{body: "!echo \"a", handled: true, reply: "Missing closing quote\r\nUsage: !echo <text>"},
+		{body: "!raw \"a b\"", handled: true, called: "raw \"a|b\""},
+		{body: "!raw a\nb", handled: true, reply: "Usage: !raw <text>"},
+		{prefix: "mail:", body: "mail:echo", handled: true, reply: "Usage: mail:echo <text>"},
+		{prefix: "mail:", body: "!echo a", handled: false},
+		{body: "!unknown", handled: true, reply: "Command not found! Use !help to list the commands"},
+		{body: "!unknown", writing: true, handled: false},
+		//rooms which aren't bridged may be shared with other bots
+		{body: "!unknown", roomID: "!new:example.com", handled: false},
+		//text in conversation rooms is sent as reply
+		{body: "!unknown", roomID: "!conv:example.com", handled: false},
+		{body: "!draft", handled: true, reply: "Command not found! Use !help to list the commands"},
+		{body: "!draft", writing: true, handled: true, called: "draft "},
+		//the permission is checked before the state of the room
+		{body: "!manage x", roomID: "!new:example.com", handled: true, reply: "You aren't allowed to use !manage"},
+		{body: "!manage x", roomID: "!new:example.com", sender: testAdmin, handled: true, reply: "You have to login"},
+		{body: "!manage x", roomID: "!bridged:example.com", handled: true, reply: "You aren't allowed to use !manage"},
+		{body: "!manage x", roomID: "!bridged:example.com", sender: testAdmin, handled: true, called: "manage x"},
+		{body: "!secret", handled: true, reply: "You aren't allowed to use !secret", redacted: true},
+	}
+	for _, test := range tests {
+		called = nil
+		server.redactions = nil
+		viper.Set("commandPrefix", test.prefix)
+		roomID, sender := test.roomID, test.sender
+		if len(roomID) == 0 {
+			roomID = "!bridged:example.com"
+		}
+		if len(sender) == 0 {
+			sender = testUser
+		}
+		var writeTemp *emailTemp
+		if test.writing {
+			writeTemp = &emailTemp{roomID: roomID.String()}
+		}
+
+		handled := handleCommand(client, testMessage(roomID, sender, test.body), writeTemp)
+		replies := server.replies()
+		if handled != test.handled {
+			t.Errorf("%q: handled = %v; want %v", test.body, handled, test.handled)
+		}
+		if len(test.called) > 0 && (len(called) != 1 || called[0] != test.called) {
+			t.Errorf("%q: called %q; want %q", test.body, called, test.called)
+		} else if len(test.called) == 0 && len(called) > 0 {
+			t.Errorf("%q: called %q; want no handler", test.body, called)
+		}
+		if len(test.reply) > 0 && (len(replies) != 1 || !strings.HasPrefix(replies[0], test.reply)) {
+			t.Errorf("%q: replied %q; want %q", test.body, replies, test.reply)
+		} else if len(test.reply) == 0 && len(replies) > 0 {
+			t.Errorf("%q: replied %q; want no reply", test.body, replies)
+		}
+		if redacted := len(server.redactions) > 0; redacted != test.redacted {
+			t.Errorf("%q: redacted = %v; want %v", test.body, redacted, test.redacted)
+		}
+	}
+}
+
+func TestUndoSend(t *testing.T) {
+	client, server := setupTestBridge(t)
+	roomID := id.RoomID("!bridged:example.com")
+	addTestRoom(t, roomID.String(), 1, 1)
+
+	//an email waiting for the undo delay and one scheduled with !send in after it
+	var temps []*emailTemp
+	for _, undoable := range []bool{true, false} {
+		if err := newWritingTemp(roomID.String(), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveWritingtemp(roomID.String(), "markdown", "1"); err != nil {
+			t.Fatal(err)
+		}
+		temp, err := getWritingTemp(roomID.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := scheduleWritingTemp(temp.pkID, time.Now().Add(time.Hour).Unix(), undoable); err != nil {
+			t.Fatal(err)
+		}
+		temps = append(temps, temp)
+	}
+
+	undoSend(roomID, client)
+	if replies := server.replies(); len(replies) != 1 || !strings.HasPrefix(replies[0], "Sending") {
+		t.Errorf("undo replied %q; want the email to be canceled", replies)
+	}
+	temp, err := getWritingTemp(roomID.String())
+	if err != nil || temp.pkID != temps[0].pkID {
+		t.Fatalf("undo restored %v, %v; want #%d", temp, err, temps[0].pkID)
+	}
+
+	deleteWritingTemp(roomID.String())
+	undoSend(roomID, client)
+	if replies := server.replies(); len(replies) != 1 || replies[0] != "There is no email to undo" {
+		t.Errorf("undo replied %q; want the scheduled email to stay scheduled", replies)
+	}
+	if temp, err := getWritingTempByID(temps[1].pkID); err != nil || temp.sendAt == 0 {
+		t.Errorf("scheduled email = %v, %v; want it to stay scheduled", temp, err)
+	}
+}
+
+func TestParseWriteArgs(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		args    string
+		options writeOptions
+		err     string
+	}{
+		{"jane@example.com", writeOptions{receivers: "jane@example.com"}, ""},
+		{"jane@example.com false", writeOptions{receivers: "jane@example.com", markdown: &no}, ""},
+		{"jane@example.com, bob true", writeOptions{receivers: "jane@example.com, bob", markdown: &yes}, ""},
+		//a single word is a receiver, even if it looks like a flag
+		{"true", writeOptions{receivers: "true"}, ""},
+		{"--receipt jane@example.com", writeOptions{receipt: true, receivers: "jane@example.com"}, ""},
+		{"--template news --receipt \"Doe, Jane\" <jane@example.com> false", writeOptions{template: "news", receipt: true, receivers: "\"Doe, Jane\" <jane@example.com>", markdown: &no}, ""},
+		{"--template news", writeOptions{template: "news"}, ""},
+		{"--template", writeOptions{}, "Missing template name. Use --template <name>"},
+		{"--cc bob jane@example.com", writeOptions{}, "Unknown option --cc. Use --template <name> or --receipt"},
+	}
+	for _, test := range tests {
+		options, err := parseWriteArgs(test.args)
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseWriteArgs(%q) error = %v; want %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseWriteArgs(%q) failed: %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(*options, test.options) {
+			t.Errorf("parseWriteArgs(%q) = %+v; want %+v", test.args, *options, test.options)
+		}
+	}
+}
+
+func TestSetCommandValue(t *testing.T) {
+	tests := []struct {
+		raw   string
+		value string
+	}{
+		{"imap host", ""},
+		{"imap host imap.example.com", "imap.example.com"},
+		{"smtp password  my secret pass ", "my secret pass"},
+		{"imap mailbox Archive\nignored", "Archive"},
+		{"imap mailbox\r\nignored", ""},
+		//the value may contain the field name
+		{"smtp username username@example.com", "username@example.com"},
+	}
+	for _, test := range tests {
+		args := strings.Fields(strings.SplitN(test.raw, "\n", 2)[0])
+		if value := setCommandValue(test.raw, args); value != test.value {
+			t.Errorf("setCommandValue(%q) = %q; want %q", test.raw, value, test.value)
+		}
+	}
+}
+
+func TestEditLines(t *testing.T) {
+	draft := func(texts ...string) []draftLine {
+		lines := make([]draftLine, len(texts))
+		for i, text := range texts {
+			lines[i] = draftLine{"$" + text, text, ""}
+		}
+		return lines
+	}
+	texts := func(lines []draftLine) []string {
+		result := make([]string, len(lines))
+		for i, line := range lines {
+			result[i] = line.line
+		}
+		return result
+	}
+	tests := []struct {
+		command string
+		args    []string
+		lines   []string
+		err     string
+	}{
+		{"undo-line", nil, []string{"a", "b"}, ""},
+		{"edit", []string{"2", "new b"}, []string{"a", "new b", "c"}, ""},
+		{"edit", []string{"4", "d"}, nil, "There is no line 4"},
+		{"edit", []string{"2"}, nil, "Usage: !edit <line> <text>"},
+		{"insert", []string{"1", "first"}, []string{"first", "a", "b", "c"}, ""},
+		{"insert", []string{"4", "last"}, []string{"a", "b", "c", "last"}, ""},
+		{"insert", []string{"5", "after"}, nil, "There is no line 5"},
+		{"delete-line", []string{"3"}, []string{"a", "b"}, ""},
+		{"delete-line", []string{"0"}, nil, "There is no line 0"},
+		{"delete-line", []string{"two"}, nil, "There is no line two"},
+		{"delete-line", nil, nil, "Usage: !edit <line> <text>"},
+	}
+	for _, test := range tests {
+		lines, err := editLines(draft("a", "b", "c"), test.command, test.args)
+		if len(test.err) > 0 {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("editLines(%s %q) error = %v; want %q", test.command, test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("editLines(%s %q) failed: %v", test.command, test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(texts(lines), test.lines) {
+			t.Errorf("editLines(%s %q) = %q; want %q", test.command, test.args, texts(lines), test.lines)
+		}
+	}
+
+	//edited lines keep their event, so edits of the message still find them
+	lines, _ := editLines(draft("a", "b"), "edit", []string{"1", "x"})
+	if lines[0].eventID != "$a" {
+		t.Errorf("edit changed the event of the line to %q", lines[0].eventID)
+	}
+	if _, err := editLines(nil, "undo-line", nil); err == nil {
+		t.Error("undo-line on an empty email didn't fail")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//bodyLines splits the body of a writing temp into its lines. One line is one message
+func bodyLines(body string) []string {
+	if len(strings.Trim(body, " ")) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n")
+}
+
+func joinBodyLines(lines []string) string {
+	if len(lines) == 0 {
+		return " "
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+//loadDraftLines returns the lines of an email. Emails without saved lines get split up by their body
+func loadDraftLines(writeTemp *emailTemp) ([]draftLine, error) {
+	lines, err := getDraftLines(writeTemp.pkID)
+	if err != nil || len(lines) > 0 {
+		return lines, err
+	}
+	return toDraftLines(writeTemp.body), nil
+}
+
+func toDraftLines(body string) []draftLine {
+	var lines []draftLine
+	for _, line := range bodyLines(body) {
+		lines = append(lines, draftLine{"", line, ""})
+	}
+	return lines
+}
+
+//setDraftBody replaces the body of an email, eg. with the body of a template
+func setDraftBody(writeTempID int, body string) error {
+	return saveDraftLines(writeTempID, toDraftLines(body))
+}
+
+//appendDraftLine adds a message to the email. Its event ID is kept, so it can be edited or redacted later
+func appendDraftLine(writeTemp *emailTemp, eventID id.EventID, content *event.MessageEventContent) error {
+	lines, err := loadDraftLines(writeTemp)
+	if err != nil {
+		return err
+	}
+	return saveDraftLines(writeTemp.pkID, append(lines, draftLine{string(eventID), content.Body, formattedBody(content)}))
+}
+
+//handleDraftEdit applies a Matrix edit (m.replace) to the line it belongs to
+func handleDraftEdit(writeTemp *emailTemp, content *event.MessageEventContent) error {
+	if content.NewContent == nil {
+		return nil
+	}
+	lines, err := loadDraftLines(writeTemp)
+	if err != nil {
+		return err
+	}
+	for i, line := range lines {
+		if len(line.eventID) > 0 && line.eventID == string(content.RelatesTo.EventID) {
+			lines[i].line = content.NewContent.Body
+			lines[i].html = formattedBody(content.NewContent)
+			return saveDraftLines(writeTemp.pkID, lines)
+		}
+	}
+	return nil
+}
+
+//removeDraftLine removes the line of a redacted message from the email currently written in a room
+func removeDraftLine(roomID string, eventID id.EventID) error {
+	writeTemp, err := getWritingTemp(roomID)
+	if err != nil {
+		//nothing written currently
+		return nil
+	}
+	lines, err := loadDraftLines(writeTemp)
+	if err != nil {
+		return err
+	}
+	for i, line := range lines {
+		if len(line.eventID) > 0 && line.eventID == string(eventID) {
+			return saveDraftLines(writeTemp.pkID, append(lines[:i], lines[i+1:]...))
+		}
+	}
+	return nil
+}
+
+//parseLineNumber parses a 1-based line number
+func parseLineNumber(value string, lineCount int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > lineCount {
+		return -1, errors.New("There is no line " + value + ". Use " + commandPrefix() + "lines to view the line numbers")
+	}
+	return n - 1, nil
+}
+
+func viewLines(roomID id.RoomID, writeTemp *emailTemp, client *mautrix.Client) {
+	lines, err := loadDraftLines(writeTemp)
+	if err != nil {
+		WriteLog(critical, "#90 loadDraftLines: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #90")
+		return
+	}
+	if len(lines) == 0 {
+		client.SendText(roomID, "The email is empty")
+		return
+	}
+	msg := ""
+	for i, line := range lines {
+		msg += strconv.Itoa(i+1) + ": " + line.line + "\r\n"
+	}
+	client.SendText(roomID, msg)
+}
+
+//previewDraft shows the email exactly like it would be sent
+func previewDraft(roomID id.RoomID, writeTemp *emailTemp, client *mautrix.Client) {
+	account, err := getSMTPAccount(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #52")
+		return
+	}
+
+	recipients, err := loadRecipients(writeTemp)
+	if err != nil {
+		WriteLog(critical, "#102 loadRecipients: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #102")
+		return
+	}
+	headers := []string{
+		"From: " + account.username,
+		"To: " + formatRecipients(recipients),
+		"Subject: " + writeTemp.subject,
+	}
+	if writeTemp.receipt {
+		headers = append(headers, "Read receipt: requested")
+	}
+	attachments, err := getAttachments(writeTemp.pkID)
+	if err != nil {
+		WriteLog(logError, "#88 getAttachments: "+err.Error())
+	}
+	for _, file := range attachments {
+		details := file.mimeType
+		if stat, err := os.Stat(tempDir + file.fileName); err == nil {
+			details += ", " + formatSize(stat.Size())
+		}
+		headers = append(headers, "Attachment: "+file.name+" ("+strings.TrimPrefix(details, ", ")+")")
+	}
+
+	htmlHeaders := make([]string, len(headers))
+	for i, header := range headers {
+		htmlHeaders[i] = html.EscapeString(header)
+	}
+
+	htmlBody, plainBody := renderBody(roomID.String(), writeTemp)
+	plainText := strings.Join(headers, "\r\n") + "\r\n────────────────────────────────────\r\n" + plainBody
+	if len(htmlBody) == 0 {
+		client.SendText(roomID, plainText)
+		return
+	}
+
+	client.SendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          plainText,
+		Format:        event.FormatHTML,
+		FormattedBody: "<b>HTML:</b><br>" + strings.Join(htmlHeaders, "<br>") + "<hr>" + htmlBody,
+	})
+	client.SendText(roomID, "Plain text:\r\n"+plainText)
+}
+
+//draftUpdated tells the user that the email was changed or that saving the change failed
+func draftUpdated(ctx *commandContext, err error) {
+	if err != nil {
+		WriteLog(critical, "#89 saveWritingtemp: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #89")
+		return
+	}
+	ctx.reply("Email updated. Use " + commandPrefix() + "preview to view it")
+}
+
+func handleSubjectCommand(ctx *commandContext) {
+	if len(ctx.raw) == 0 {
+		ctx.reply("Subject: " + ctx.writeTemp.subject + "\r\nUse " + commandPrefix() + "subject <new subject> to change it")
+		return
+	}
+	draftUpdated(ctx, saveWritingtemp(ctx.roomID.String(), "subject", ctx.raw))
+}
+
+func handleToCommand(ctx *commandContext) {
+	if len(ctx.raw) == 0 {
+		recipients, err := loadRecipients(ctx.writeTemp)
+		if err != nil {
+			WriteLog(critical, "#102 loadRecipients: "+err.Error())
+		}
+		ctx.reply("To: " + formatRecipients(recipients) + "\r\nUse " + commandPrefix() + "to <email(s)> to change the receivers")
+		return
+	}
+	recipients, errs := parseRecipients(ctx.roomID.String(), ctx.raw)
+	if len(errs) > 0 {
+		ctx.reply(invalidRecipientsMessage(errs))
+		return
+	}
+	draftUpdated(ctx, saveRecipients(ctx.writeTemp.pkID, recipients))
+}
+
+//handleEditLinesCommand handles !undo-line, !edit, !insert and !delete-line
+func handleEditLinesCommand(ctx *commandContext) {
+	lines, err := loadDraftLines(ctx.writeTemp)
+	if err != nil {
+		WriteLog(critical, "#90 loadDraftLines: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #90")
+		return
+	}
+	var args []string
+	if len(ctx.raw) > 0 {
+		args = strings.SplitN(ctx.raw, " ", 2)
+	}
+	lines, err = editLines(lines, ctx.cmd.name, args)
+	if err != nil {
+		ctx.reply(err.Error())
+		return
+	}
+	draftUpdated(ctx, saveDraftLines(ctx.writeTemp.pkID, lines))
+}
+
+//editLines applies !undo-line, !edit, !insert or !delete-line to the lines of an email
+func editLines(lines []draftLine, command string, args []string) ([]draftLine, error) {
+	if command == "undo-line" {
+		if len(lines) == 0 {
+			return nil, errors.New("The email is empty")
+		}
+		return lines[:len(lines)-1], nil
+	}
+
+	if len(args) < 1 || (command != "delete-line" && len(args) < 2) {
+		return nil, errors.New("Usage: " + commandPrefix() + "edit <line> <text>, " + commandPrefix() + "insert <line> <text> or " + commandPrefix() + "delete-line <line>")
+	}
+	lineCount := len(lines)
+	if command == "insert" {
+		//inserting after the last line appends the text
+		lineCount++
+	}
+	n, err := parseLineNumber(args[0], lineCount)
+	if err != nil {
+		return nil, err
+	}
+	switch command {
+	case "edit":
+		lines[n] = draftLine{lines[n].eventID, args[1], ""}
+	case "insert":
+		lines = append(lines[:n], append([]draftLine{{"", args[1], ""}}, lines[n:]...)...)
+	case "delete-line":
+		lines = append(lines[:n], lines[n+1:]...)
+	}
+	return lines, nil
+}
+
+//handleSendCommand handles '!send <at 2006-01-02 15:04/in 2h>'
+func handleSendCommand(ctx *commandContext) {
+	roomID, writeTemp := ctx.roomID, ctx.writeTemp
+	if len(ctx.raw) > 0 {
+		loc := getRoomLocation(string(roomID))
+		sendAt, err := parseSendTime(ctx.raw, loc, time.Now())
+		if err != nil {
+			ctx.reply(err.Error() + "\r\nUsage: " + commandPrefix() + "send at 2006-01-02 15:04 or " + commandPrefix() + "send in 2h")
+			return
+		}
+		err = scheduleDraft(writeTemp, sendAt, false)
+		if err != nil {
+			WriteLog(critical, "#75 scheduleDraft: "+err.Error())
+			ctx.reply("An server-error occured Errorcode: #75")
+			return
+		}
+		ctx.reply("The email will be sent at " + sendAt.In(loc).Format(scheduleTimeLayout) + ". Use " + commandPrefix() + "scheduled to view or cancel scheduled emails")
+		return
+	}
+
+	undoDelay, err := getUndoDelay(string(roomID))
+	if err != nil {
+		WriteLog(critical, "#76 getUndoDelay: "+err.Error())
+	}
+	if undoDelay > 0 {
+		err = scheduleDraft(writeTemp, time.Now().Add(time.Duration(undoDelay)*time.Second), true)
+		if err != nil {
+			WriteLog(critical, "#75 scheduleDraft: "+err.Error())
+			ctx.reply("An server-error occured Errorcode: #75")
+			return
+		}
+		ctx.reply("Sending in " + strconv.Itoa(undoDelay) + " seconds. Type " + commandPrefix() + "undo to cancel")
+		return
+	}
+	sendDraft(roomID, writeTemp)
+}
+
+func handleTemplateSaveCommand(ctx *commandContext) {
+	if len(ctx.args) != 2 || ctx.args[0] != "save" {
+		ctx.reply(ctx.usage())
+		return
+	}
+	name := ctx.args[1]
+	err := saveTemplate(ctx.roomID.String(), name, ctx.writeTemp.subject, ctx.writeTemp.body)
+	if err != nil {
+		WriteLog(critical, "#86 saveTemplate: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #86")
+		return
+	}
+	ctx.reply("Template " + name + " saved. Placeholders like {{to}}, {{name}}, {{from}} and {{date}} get filled in when using it")
+}
+
+func handleRemoveAttachmentCommand(ctx *commandContext) {
+	attachments, err := getAttachments(ctx.writeTemp.pkID)
+	if err != nil {
+		WriteLog(critical, "#148 getAttachments: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #148")
+		return
+	}
+	//only files attached to this email can be removed, the name mustn't point anywhere else
+	var file *attachment
+	for i := range attachments {
+		if attachments[i].name == ctx.raw || attachments[i].fileName == ctx.raw {
+			file = &attachments[i]
+			break
+		}
+	}
+	if file == nil {
+		ctx.reply("There is no attachment " + ctx.raw + ". Use " + commandPrefix() + "preview to view the attachments")
+		return
+	}
+	err = deleteAttachment(file.fileName, ctx.writeTemp.pkID)
+	if err != nil {
+		ctx.reply("Couldn't delete attachment: " + err.Error())
+		return
+	}
+	deleteTempFile(file.fileName)
+	ctx.reply("Attachment " + file.name + " deleted!")
+}
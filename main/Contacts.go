@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//isValidNickname returns true if a nickname can't be confused with an email address or a !write option
+func isValidNickname(nickname string) bool {
+	if len(nickname) == 0 || strings.ContainsAny(nickname, "@ ,<>\"") || strings.HasPrefix(nickname, "-") {
+		return false
+	}
+	_, err := strconv.ParseBool(nickname)
+	return err != nil
+}
+
+func viewContacts(roomID string, client *mautrix.Client) {
+	contacts, err := getContacts(roomID)
+	if err != nil {
+		WriteLog(critical, "#99 getContacts: "+err.Error())
+		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #99")
+		return
+	}
+	if len(contacts) == 0 {
+		client.SendText(id.RoomID(roomID), "Your address book is empty. Use "+commandPrefix()+"contact add <nickname> <email> <name> to add a contact")
+		return
+	}
+	msg := "Contacts:\n"
+	for _, contact := range contacts {
+		msg += "> " + contact.nickname + ": " + contact.address
+		if len(contact.name) > 0 {
+			msg += " (" + contact.name + ")"
+		}
+		msg += "\n"
+	}
+	client.SendText(id.RoomID(roomID), msg+"\nUse "+commandPrefix()+"write <nickname> to write an email to a contact")
+}
+
+//parseContactAddress returns the address of a contact with its domain in punycode, the same way recipients are parsed.
+//Otherwise contacts with international domains wouldn't match the addresses of received emails
+func parseContactAddress(value string) (string, error) {
+	address, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", err
+	}
+	return toASCIIAddress(address.Address)
+}
+
+//saveContact adds a contact or updates the contact with the same nickname
+func saveContact(roomID id.RoomID, newContact contact, client *mautrix.Client) {
+	if !isValidNickname(newContact.nickname) {
+		client.SendText(roomID, "The nickname "+newContact.nickname+" is invalid. It can't contain spaces or an @")
+		return
+	}
+	address, err := parseContactAddress(newContact.address)
+	if err != nil {
+		client.SendText(roomID, newContact.address+" is no valid email address: "+err.Error())
+		return
+	}
+	newContact.address = address
+	err = addContact(roomID.String(), newContact)
+	if err != nil {
+		WriteLog(critical, "#100 addContact: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #100")
+		return
+	}
+	client.SendText(roomID, "Contact "+newContact.nickname+" ("+newContact.address+") saved")
+}
+
+//handleContactCommand handles '!contact <list/add/rm>'.
+//'!contact add <nickname>' sent as reply to a bridged email adds its sender
+func handleContactCommand(ctx *commandContext) {
+	roomID, args, client := ctx.roomID, ctx.args, ctx.client
+	replyTo := ctx.evt.Content.AsMessage().GetReplyTo()
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "list" || args[0] == "view")) {
+		viewContacts(roomID.String(), client)
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "add":
+		{
+			if len(args) == 2 && len(replyTo) > 0 {
+				ref, err := getMailEvent(roomID.String(), replyTo.String())
+				if err != nil || len(ref.sender) == 0 {
+					client.SendText(roomID, "This message isn't a bridged email. Reply to an email to add its sender")
+					return
+				}
+				saveContact(roomID, contact{args[1], ref.senderName, ref.sender}, client)
+				return
+			}
+			if len(args) < 3 {
+				client.SendText(roomID, "Usage: "+commandPrefix()+"contact add <nickname> <email> <name (optional)>\r\nor reply to a bridged email with "+commandPrefix()+"contact add <nickname> to add its sender")
+				return
+			}
+			saveContact(roomID, contact{args[1], strings.Join(args[3:], " "), args[2]}, client)
+		}
+	case "import":
+		{
+			if !hasPermission(roomID, ctx.evt.Sender, permManage) {
+				ctx.reply(permissionDenied(roomID, ctx.cmd))
+				return
+			}
+			content, err := getReplyMessage(client, roomID, replyTo)
+			if err != nil || !isVCard(content) {
+				client.SendText(roomID, "Reply to a vCard file (.vcf) with "+commandPrefix()+"contact import to import its contacts")
+				return
+			}
+			importVCard(roomID, content, client)
+		}
+	case "rm", "delete", "remove":
+		{
+			if len(args) != 2 {
+				client.SendText(roomID, "Usage: "+commandPrefix()+"contact rm <nickname>")
+				return
+			}
+			if _, err := getContact(roomID.String(), args[1]); err != nil {
+				client.SendText(roomID, "Contact "+args[1]+" not found")
+				return
+			}
+			err := deleteContact(roomID.String(), args[1])
+			if err != nil {
+				WriteLog(critical, "#101 deleteContact: "+err.Error())
+				client.SendText(roomID, "An server-error occured Errorcode: #101")
+				return
+			}
+			client.SendText(roomID, "Contact "+args[1]+" deleted")
+		}
+	default:
+		{
+			client.SendText(roomID, "Usage: "+commandPrefix()+"contact <list/add/rm/import> <nickname> <email> <name>\r\nReply to a vCard file (.vcf) with "+commandPrefix()+"contact import to import its contacts")
+		}
+	}
+}
+
+//isVCard returns true if an uploaded file is a vCard
+func isVCard(content *event.MessageEventContent) bool {
+	if content.MsgType != event.MsgFile {
+		return false
+	}
+	mimeType := ""
+	if content.Info != nil {
+		mimeType = strings.ToLower(content.Info.MimeType)
+	}
+	return mimeType == "text/vcard" || mimeType == "text/x-vcard" || strings.HasSuffix(strings.ToLower(content.Body), ".vcf")
+}
+
+//maxVCardSize is the largest vCard file which gets imported
+const maxVCardSize = 1024 * 1024
+
+//getReplyMessage returns the content of the message a command replied to
+func getReplyMessage(client *mautrix.Client, roomID id.RoomID, eventID id.EventID) (*event.MessageEventContent, error) {
+	if len(eventID) == 0 {
+		return nil, errors.New("not a reply")
+	}
+	evt, err := client.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if err = evt.Content.ParseRaw(evt.Type); err != nil {
+		return nil, err
+	}
+	evt.RoomID = roomID
+	evt, err = decryptEvent(evt)
+	if err != nil {
+		return nil, err
+	}
+	if evt.Type != event.EventMessage {
+		return nil, errors.New("not a message")
+	}
+	return evt.Content.AsMessage(), nil
+}
+
+//parseVCards reads the contacts of a vCard file. Contacts with multiple email addresses are added once per address
+func parseVCards(data []byte) []contact {
+	//unfold lines continued with a space or tab
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	unescape := strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\\`, `\`)
+	var contacts []contact
+	var name, nickname string
+	var addresses []string
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		property := strings.ToUpper(strings.Split(line[:i], ";")[0])
+		//properties may be grouped, eg. item1.EMAIL
+		if dot := strings.LastIndex(property, "."); dot >= 0 {
+			property = property[dot+1:]
+		}
+		value := strings.Trim(unescape.Replace(line[i+1:]), " ")
+		switch property {
+		case "BEGIN":
+			name, nickname, addresses = "", "", nil
+		case "FN":
+			name = value
+		case "NICKNAME":
+			nickname = strings.Split(value, ",")[0]
+		case "EMAIL":
+			addresses = append(addresses, value)
+		case "END":
+			for _, address := range addresses {
+				contacts = append(contacts, contact{nickname, name, address})
+			}
+		}
+	}
+	return contacts
+}
+
+//contactNickname creates a nickname for an imported contact
+func contactNickname(c contact) string {
+	nickname := c.nickname
+	if len(nickname) == 0 && len(c.name) > 0 {
+		nickname = strings.Fields(c.name)[0]
+	}
+	if len(nickname) == 0 {
+		nickname = strings.Split(c.address, "@")[0]
+	}
+	nickname = strings.ToLower(strings.NewReplacer(" ", "", "@", "", ",", "", "<", "", ">", "", "\"", "").Replace(nickname))
+	if !isValidNickname(nickname) {
+		nickname = "contact"
+	}
+	return nickname
+}
+
+//importVCard downloads an uploaded vCard file and adds its contacts. Existing nicknames are kept by numbering the new ones
+func importVCard(roomID id.RoomID, content *event.MessageEventContent, client *mautrix.Client) {
+	data, err := downloadMedia(client, content, maxVCardSize)
+	if err != nil {
+		client.SendText(roomID, "Couldn't download file: "+err.Error())
+		return
+	}
+	existing, err := getContacts(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#99 getContacts: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #99")
+		return
+	}
+	nicknames := map[string]bool{}
+	addresses := map[string]bool{}
+	for _, c := range existing {
+		nicknames[c.nickname] = true
+		addresses[strings.ToLower(c.address)] = true
+	}
+
+	imported, skipped := 0, 0
+	for _, c := range parseVCards(data) {
+		address, err := parseContactAddress(c.address)
+		if err != nil || addresses[strings.ToLower(address)] {
+			skipped++
+			continue
+		}
+		c.address = address
+		base := contactNickname(c)
+		c.nickname = base
+		for n := 2; nicknames[c.nickname]; n++ {
+			c.nickname = base + strconv.Itoa(n)
+		}
+		if err := addContact(roomID.String(), c); err != nil {
+			WriteLog(critical, "#100 addContact: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #100")
+			return
+		}
+		nicknames[c.nickname] = true
+		addresses[strings.ToLower(c.address)] = true
+		imported++
+	}
+	msg := strconv.Itoa(imported) + " contacts imported"
+	if skipped > 0 {
+		msg += ", " + strconv.Itoa(skipped) + " skipped (invalid or already saved)"
+	}
+	client.SendText(roomID, msg+". Use "+commandPrefix()+"contact list to view them")
+}
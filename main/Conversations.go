@@ -0,0 +1,150 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//replyPrefix matches the Re:/Fwd: prefixes of a subject
+var replyPrefix = regexp.MustCompile(`(?i)^((re|aw|fwd?|wg)\s*:\s*)+`)
+
+//getConversationRoom returns the room of the thread an email belongs to.
+//New threads get their own room, which is announced in the parent room
+func getConversationRoom(parentRoomID string, content *email) (string, error) {
+	conv, err := findConversation(parentRoomID, append([]string{content.inReplyTo}, content.references...))
+	if err != nil {
+		return "", err
+	}
+	if conv == nil {
+		conv, err = createConversation(parentRoomID, content)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(content.messageID) > 0 {
+		if err := insertConversationMail(conv.pkID, content.messageID); err != nil {
+			return "", err
+		}
+	}
+	return conv.roomID, nil
+}
+
+//createConversation creates a room for a new thread and invites the members of the parent room
+func createConversation(parentRoomID string, content *email) (*conversation, error) {
+	subject := strings.Trim(replyPrefix.ReplaceAllString(content.subject, ""), " ")
+	if len(subject) == 0 {
+		subject = "(no subject)"
+	}
+	address := ""
+	if len(content.sendermails) > 0 {
+		address = content.sendermails[0]
+	}
+
+	roomID, err := createLinkedRoom(parentRoomID, &mautrix.ReqCreateRoom{
+		Name:   subject,
+		Topic:  "Email conversation with " + content.from,
+		Preset: "private_chat",
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	conv := &conversation{parentRoomID: parentRoomID, roomID: roomID.String(), subject: subject, address: address}
+	conv.pkID, err = insertConversation(conv)
+	if err != nil {
+		return nil, err
+	}
+
+	matrixClient.SendText(id.RoomID(parentRoomID), "📨 New conversation \""+subject+"\" with "+content.from+": https://matrix.to/#/"+conv.roomID)
+	return conv, nil
+}
+
+//handleConversationMessage sends a message typed in a conversation room as reply to its thread.
+//Returns false if the room isn't a conversation
+func handleConversationMessage(roomID id.RoomID, content *event.MessageEventContent, client *mautrix.Client) bool {
+	conv, err := getConversation(roomID.String())
+	if err != nil {
+		WriteLog(logError, "#124 getConversation: "+err.Error())
+		return false
+	}
+	if conv == nil {
+		return false
+	}
+	if content.MsgType != event.MsgText && content.MsgType != event.MsgEmote {
+		client.SendText(roomID, "Only text can be sent as reply. Use "+commandPrefix()+"write to send files")
+		return true
+	}
+	account, err := getSMTPAccount(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #52")
+		return true
+	}
+	references, err := getConversationMails(conv.pkID)
+	if err != nil {
+		WriteLog(logError, "#125 getConversationMails: "+err.Error())
+	}
+
+	subject := "Re: " + conv.subject
+	m := gomail.NewMessage()
+	m.SetHeader("From", account.username)
+	m.SetHeader("To", conv.address)
+	m.SetHeader("Subject", subject)
+	if len(references) > 0 {
+		m.SetHeader("In-Reply-To", references[len(references)-1])
+		m.SetHeader("References", strings.Join(references, " "))
+	}
+	writeTemp := &emailTemp{
+		roomID:   roomID.String(),
+		body:     joinBodyLines(strings.Split(content.Body, "\n")),
+		markdown: viper.GetBool("markdownEnabledByDefault"),
+	}
+	htmlBody, plainBody := renderBody(roomID.String(), writeTemp)
+	m.SetBody("text/plain", plainBody)
+	if len(htmlBody) > 0 {
+		m.AddAlternative("text/html", htmlBody)
+	}
+
+	outboxID, err := queueMail(roomID.String(), account, m, []string{conv.address}, subject, time.Now().Unix())
+	if err != nil {
+		WriteLog(critical, "#46 queueMail: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #46\r\n"+err.Error())
+		return true
+	}
+	//answers to the reply belong to the conversation as well
+	if mail, err := getOutboxMail(outboxID); err == nil && len(mail.messageID) > 0 {
+		if err := insertConversationMail(conv.pkID, mail.messageID); err != nil {
+			WriteLog(logError, "#126 insertConversationMail: "+err.Error())
+		}
+	}
+	go deliverOutboxMail(outboxID)
+	return true
+}
+
+func handleConversationsCommand(roomID id.RoomID, args []string, client *mautrix.Client) {
+	switch strings.ToLower(args[0]) {
+	case "on":
+		if err := saveConversationMode(roomID.String(), true); err != nil {
+			WriteLog(critical, "#127 saveConversationMode: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #127")
+			return
+		}
+		client.SendText(roomID, "Every new email thread gets its own room now. This room shows a list of them. Messages written in a conversation room are sent as replies")
+	case "off":
+		if err := saveConversationMode(roomID.String(), false); err != nil {
+			WriteLog(critical, "#127 saveConversationMode: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #127")
+			return
+		}
+		client.SendText(roomID, "New emails are posted in this room again")
+	default:
+		client.SendText(roomID, "Usage: "+commandPrefix()+"conversations <on/off>")
+	}
+}
@@ -0,0 +1,382 @@
+//go:build olm
+// +build olm
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var olmMachine *crypto.OlmMachine
+
+//encryptLock prevents sharing the same room key twice when several messages are sent at once
+var encryptLock sync.Mutex
+
+//legacyPickleKey encrypted the olm accounts created before the pickle key was generated
+var legacyPickleKey = []byte("Matrix-EmailBridge")
+
+//sasConfirmTimeout is how long a verification waits for the user to compare the emojis
+const sasConfirmTimeout = 5 * time.Minute
+
+//pendingVerifications are the verifications waiting for '!verify yes/no' of the user
+var (
+	pendingVerifications     = make(map[verificationKey]chan bool)
+	pendingVerificationMutex sync.Mutex
+)
+
+type verificationKey struct {
+	roomID id.RoomID
+	userID id.UserID
+}
+
+//cryptoLogger writes the logs of the olm machine into the bridge log
+type cryptoLogger struct{}
+
+func (cryptoLogger) Error(message string, args ...interface{}) {
+	WriteLog(logError, "crypto: "+fmt.Sprintf(message, args...))
+}
+
+func (cryptoLogger) Warn(message string, args ...interface{}) {
+	WriteLog(warn, "crypto: "+fmt.Sprintf(message, args...))
+}
+
+func (cryptoLogger) Debug(message string, args ...interface{}) {}
+
+func (cryptoLogger) Trace(message string, args ...interface{}) {}
+
+//initCrypto loads the olm account of the bot and hooks en- and decryption into the client.
+//handleEvent gets the decrypted events
+func initCrypto(client *mautrix.Client, syncer *mautrix.DefaultSyncer, handleEvent func(mautrix.EventSource, *event.Event)) error {
+	if err := sql_store_upgrade.Upgrade(db, "sqlite3"); err != nil {
+		return fmt.Errorf("upgrading crypto store: %w", err)
+	}
+	pickleKey, err := loadPickleKey(client.UserID)
+	if err != nil {
+		return fmt.Errorf("loading pickle key: %w", err)
+	}
+	store := crypto.NewSQLCryptoStore(db, "sqlite3", client.UserID.String(), client.DeviceID, pickleKey, cryptoLogger{})
+	mach := crypto.NewOlmMachine(client, cryptoLogger{}, store, roomStateStore{})
+	mach.AcceptVerificationFrom = acceptVerification
+	if err := mach.Load(); err != nil {
+		return fmt.Errorf("loading olm account: %w", err)
+	}
+
+	if err := initCrossSigning(mach); err != nil {
+		WriteLog(warn, "Couldn't set up cross-signing: "+err.Error())
+	}
+
+	client.Client = &http.Client{Transport: &encryptingTransport{base: http.DefaultTransport}}
+
+	//to-device events have to be handled before the room events, they contain the room keys
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		mach.ProcessSyncResponse(resp, since)
+		return true
+	})
+	syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
+		mach.HandleMemberEvent(evt)
+	})
+	syncer.OnEventType(event.EventEncrypted, func(source mautrix.EventSource, evt *event.Event) {
+		if evt.Sender == client.UserID {
+			return
+		}
+		decrypted, err := mach.DecryptMegolmEvent(evt)
+		if errors.Is(err, crypto.NoSessionFound) {
+			//the key might come with one of the next syncs, which can't happen while blocking this one
+			go func() {
+				content := evt.Content.AsEncrypted()
+				if mach.WaitForSession(evt.RoomID, content.SenderKey, content.SessionID, 30*time.Second) {
+					if decrypted, err := mach.DecryptMegolmEvent(evt); err == nil {
+						handleEvent(source, decrypted)
+						return
+					}
+				}
+				WriteLog(warn, "Couldn't decrypt "+evt.ID.String()+": no session found")
+				client.SendText(evt.RoomID, "I couldn't decrypt your message. Please verify my device or send it again")
+			}()
+			return
+		} else if err != nil {
+			WriteLog(logError, "#112 DecryptMegolmEvent: "+err.Error())
+			return
+		}
+		handleEvent(source, decrypted)
+	})
+	olmMachine = mach
+	WriteLog(success, "end-to-end encryption enabled for device "+client.DeviceID.String())
+	return nil
+}
+
+//decryptEvent decrypts an encrypted event fetched from the server. Other events are returned unchanged
+func decryptEvent(evt *event.Event) (*event.Event, error) {
+	if evt.Type != event.EventEncrypted {
+		return evt, nil
+	}
+	if olmMachine == nil {
+		return nil, errors.New("encryption isn't enabled")
+	}
+	return olmMachine.DecryptMegolmEvent(evt)
+}
+
+//loadPickleKey returns the key encrypting the olm account and sessions in the db. A random one is generated on the first start
+func loadPickleKey(userID id.UserID) ([]byte, error) {
+	key, err := getBotSetting("pickleKey")
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		return base64.StdEncoding.DecodeString(key)
+	}
+	var accounts int
+	err = db.QueryRow("SELECT COUNT(*) FROM crypto_account WHERE account_id=?", userID.String()).Scan(&accounts)
+	if err != nil {
+		return nil, err
+	}
+	var pickleKey []byte
+	if accounts > 0 {
+		//an existing account can't be read with a new key
+		pickleKey = legacyPickleKey
+	} else {
+		pickleKey = make([]byte, 32)
+		if _, err := rand.Read(pickleKey); err != nil {
+			return nil, err
+		}
+	}
+	return pickleKey, setBotSetting("pickleKey", base64.StdEncoding.EncodeToString(pickleKey))
+}
+
+//encryptionSupported returns true if the bridge can read and write the messages of the room
+func encryptionSupported(roomID id.RoomID) bool {
+	if olmMachine == nil {
+		return false
+	}
+	encryption := roomStateStore{}.GetEncryptionEvent(roomID)
+	return encryption == nil || encryption.Algorithm == id.AlgorithmMegolmV1
+}
+
+//initCrossSigning creates the cross-signing keys of the bot or loads them from the db and signs the device with them
+func initCrossSigning(mach *crypto.OlmMachine) error {
+	seeds, err := getBotSetting("crossSigningSeeds")
+	if err != nil {
+		return err
+	}
+	if len(seeds) > 0 {
+		var keys crypto.CrossSigningSeeds
+		if err := json.Unmarshal([]byte(seeds), &keys); err != nil {
+			return err
+		}
+		if err := mach.ImportCrossSigningKeys(keys); err != nil {
+			return err
+		}
+	} else {
+		keys, err := mach.GenerateCrossSigningKeys()
+		if err != nil {
+			return err
+		}
+		if err := mach.PublishCrossSigningKeys(keys, passwordAuth); err != nil {
+			return fmt.Errorf("publishing cross-signing keys: %w", err)
+		}
+		data, err := json.Marshal(mach.ExportCrossSigningKeys())
+		if err != nil {
+			return err
+		}
+		if err := setBotSetting("crossSigningSeeds", string(data)); err != nil {
+			return err
+		}
+		if err := mach.SignOwnMasterKey(); err != nil {
+			return fmt.Errorf("signing master key: %w", err)
+		}
+		WriteLog(success, "published cross-signing keys")
+	}
+	return mach.SignOwnDevice(mach.OwnIdentity())
+}
+
+//passwordAuth answers the user-interactive auth needed to publish the cross-signing keys
+func passwordAuth(uia *mautrix.RespUserInteractive) interface{} {
+	return &mautrix.ReqUIAuthLogin{
+		BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: uia.Session},
+		User:         matrixClient.UserID.String(),
+		Password:     viper.GetString("matrixuserpassword"),
+	}
+}
+
+//encryptingTransport encrypts the events the bridge sends to encrypted rooms
+type encryptingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *encryptingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//PUT .../rooms/{roomID}/send/{eventType}/{txnID}
+	parts := strings.Split(req.URL.EscapedPath(), "/")
+	n := len(parts)
+	if req.Method != http.MethodPut || req.Body == nil || n < 5 || parts[n-5] != "rooms" || parts[n-3] != "send" {
+		return t.base.RoundTrip(req)
+	}
+	roomID, err := url.PathUnescape(parts[n-4])
+	if err != nil {
+		return t.base.RoundTrip(req)
+	}
+	eventType, err := url.PathUnescape(parts[n-2])
+	if err != nil || eventType == event.EventEncrypted.Type || !(roomStateStore{}).IsEncrypted(id.RoomID(roomID)) {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptContent(id.RoomID(roomID), event.NewEventType(eventType), body)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting %s event: %w", eventType, err)
+	}
+
+	parts[n-2] = url.PathEscape(event.EventEncrypted.Type)
+	encReq := req.Clone(req.Context())
+	encReq.URL.RawPath = strings.Join(parts, "/")
+	encReq.URL.Path, _ = url.PathUnescape(encReq.URL.RawPath)
+	encReq.Body = ioutil.NopCloser(bytes.NewReader(encrypted))
+	encReq.ContentLength = int64(len(encrypted))
+	encReq.GetBody = nil
+	return t.base.RoundTrip(encReq)
+}
+
+//encryptContent encrypts the json content of an event for a room, sharing a new room key if needed
+func encryptContent(roomID id.RoomID, evtType event.Type, content []byte) ([]byte, error) {
+	encryptLock.Lock()
+	defer encryptLock.Unlock()
+	encrypted, err := olmMachine.EncryptMegolmEvent(roomID, evtType, json.RawMessage(content))
+	if crypto.IsShareError(err) {
+		err = olmMachine.ShareGroupSession(roomID, getJoinedMembers(roomID))
+		if err != nil {
+			return nil, fmt.Errorf("sharing room key: %w", err)
+		}
+		encrypted, err = olmMachine.EncryptMegolmEvent(roomID, evtType, json.RawMessage(content))
+	}
+	if err != nil {
+		return nil, err
+	}
+	//relations stay unencrypted so the servers can aggregate them
+	var relation struct {
+		RelatesTo *event.RelatesTo `json:"m.relates_to"`
+	}
+	if json.Unmarshal(content, &relation) == nil {
+		encrypted.RelatesTo = relation.RelatesTo
+	}
+	return json.Marshal(encrypted)
+}
+
+//acceptVerification accepts verification requests from the users allowed to use the bridge
+func acceptVerification(txnID string, device *crypto.DeviceIdentity, roomID id.RoomID) (crypto.VerificationRequestResponse, crypto.VerificationHooks) {
+	if !isAllowedUser(device.UserID) {
+		WriteLog(info, "Rejected verification request from "+device.UserID.String()+": user not allowed")
+		return crypto.RejectRequest, nil
+	}
+	return crypto.AcceptRequest, &verificationHooks{roomID: roomID, device: device}
+}
+
+//verificationHooks shows the SAS of a verification. The bot can't compare it, so the user has to confirm it with !verify
+type verificationHooks struct {
+	roomID id.RoomID
+	device *crypto.DeviceIdentity
+}
+
+func (hooks *verificationHooks) notify(text string) {
+	WriteLog(info, text)
+	if len(hooks.roomID) > 0 {
+		matrixClient.SendText(hooks.roomID, text)
+	}
+}
+
+func (hooks *verificationHooks) VerifySASMatch(otherDevice *crypto.DeviceIdentity, sas crypto.SASData) bool {
+	var code string
+	switch sas := sas.(type) {
+	case crypto.EmojiSASData:
+		emojis := make([]string, len(sas))
+		for i, emoji := range sas {
+			emojis[i] = string(emoji.Emoji) + " " + emoji.Description
+		}
+		code = strings.Join(emojis, ", ")
+	case crypto.DecimalSASData:
+		code = fmt.Sprintf("%d %d %d", sas[0], sas[1], sas[2])
+	}
+	//verifications sent to the device have no room, the user gets asked in a direct chat then
+	if len(hooks.roomID) == 0 {
+		resp, err := matrixClient.CreateRoom(&mautrix.ReqCreateRoom{
+			Name:     "Verification",
+			Invite:   []id.UserID{otherDevice.UserID},
+			Preset:   "trusted_private_chat",
+			IsDirect: true,
+		})
+		if err != nil {
+			WriteLog(logError, "#147 CreateRoom: "+err.Error())
+			return false
+		}
+		hooks.roomID = resp.RoomID
+	}
+
+	key := verificationKey{roomID: hooks.roomID, userID: otherDevice.UserID}
+	answer := make(chan bool, 1)
+	pendingVerificationMutex.Lock()
+	pendingVerifications[key] = answer
+	pendingVerificationMutex.Unlock()
+	defer func() {
+		pendingVerificationMutex.Lock()
+		if pendingVerifications[key] == answer {
+			delete(pendingVerifications, key)
+		}
+		pendingVerificationMutex.Unlock()
+	}()
+
+	hooks.notify("Verifying " + otherDevice.UserID.String() + " (" + otherDevice.DeviceID.String() + "). Does your device show: " + code +
+		"\r\nEnter " + commandPrefix() + "verify yes if it does or " + commandPrefix() + "verify no if it doesn't")
+	select {
+	case confirmed := <-answer:
+		return confirmed
+	case <-time.After(sasConfirmTimeout):
+		hooks.notify("The verification of " + otherDevice.UserID.String() + " timed out")
+		return false
+	}
+}
+
+//answerVerification passes the answer of a user to the verification waiting in the room.
+//Returns false if there is none
+func answerVerification(roomID id.RoomID, userID id.UserID, confirmed bool) bool {
+	pendingVerificationMutex.Lock()
+	defer pendingVerificationMutex.Unlock()
+	key := verificationKey{roomID: roomID, userID: userID}
+	answer, ok := pendingVerifications[key]
+	if ok {
+		delete(pendingVerifications, key)
+		answer <- confirmed
+	}
+	return ok
+}
+
+func (hooks *verificationHooks) VerificationMethods() []crypto.VerificationMethod {
+	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
+}
+
+func (hooks *verificationHooks) OnCancel(cancelledByUs bool, reason string, reasonCode event.VerificationCancelCode) {
+	hooks.notify("Verification of " + hooks.device.UserID.String() + " cancelled: " + reason)
+}
+
+func (hooks *verificationHooks) OnSuccess() {
+	hooks.notify("Verified " + hooks.device.UserID.String() + " (" + hooks.device.DeviceID.String() + ")")
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
+	"net/mail"
 	"strconv"
 	"strings"
 
@@ -19,6 +21,9 @@ type emailTemp struct {
 	pkID                            int
 	roomID, receiver, subject, body string
 	markdown                        bool
+	sendAt                          int64
+	//receipt requests a read receipt (Disposition-Notification-To)
+	receipt bool
 }
 
 type imapAccountount struct {
@@ -26,12 +31,76 @@ type imapAccountount struct {
 	ignoreSSL                                 bool
 	roomPKID, mailCheckInterval               int
 	silence                                   bool
+	//security is tls or starttls, empty means tls
+	security string
 }
 
 type smtpAccount struct {
 	host, username, password, roomID string
 	ignoreSSL                        bool
 	roomPKID, port, pk               int
+	security, authMech, transport    string
+}
+
+type outboxMail struct {
+	pkID                                      int64
+	roomID, sender, receiver, subject, status string
+	raw                                       []byte
+	attempts                                  int
+	nextTry                                   int64
+	lastError                                 string
+	messageID                                 string
+}
+
+//sentMail links a sent email to the message confirming it, so bounces can be posted there
+type sentMail struct {
+	messageID, envelopeID, eventID, subject string
+}
+
+//draftLine is a message of an email. html contains its formatted body, if the message had one
+type draftLine struct {
+	eventID, line, html string
+}
+
+//attachment is a file attached to an email. fileName is the name of the file in the temp dir
+type attachment struct {
+	fileName, name, mimeType string
+}
+
+//mailRef points to a bridged email on the imap server
+type mailRef struct {
+	mailbox            string
+	uid, uidValidity   uint32
+	sender, senderName string
+}
+
+type contact struct {
+	nickname, name, address string
+}
+
+//ghostUser is a puppet posting the emails of a sender in appservice mode
+type ghostUser struct {
+	userID, displayName, avatarHash string
+}
+
+//conversation is a room created for an email thread. Its emails come from and get sent with the accounts of the parent room
+type conversation struct {
+	pkID                                   int64
+	parentRoomID, roomID, subject, address string
+}
+
+//folderRoom is the room of an imap folder in the space of an account
+type folderRoom struct {
+	pkID                          int64
+	parentRoomID, mailbox, roomID string
+	//archived is set if the folder was deleted on the server
+	archived bool
+	//synced is set after the existing emails of the folder were marked as seen
+	synced bool
+}
+
+type mailTemplate struct {
+	name, subject, body string
 }
 
 type dbChange struct {
@@ -41,12 +110,27 @@ type dbChange struct {
 
 var tables = []table{
 	{"mail", "mail TEXT, room INTEGER"},
-	{"rooms", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, imapAccount INTEGER DEFAULT -1, smtpAccount INTEGER DEFAULT -1, mailCheckInterval INTEGER, isHTMLenabled INTEGER"},
-	{"imapAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, username TEXT, password TEXT, ignoreSSL INTEGER, mailbox TEXT"},
-	{"smtpAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, port int, username TEXT, password TEXT, ignoreSSL INTEGER"},
-	{"emailWritingTemp", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, receiver TEXT, subject TEXT DEFAULT ' ', body TEXT DEFAULT ' ', markdown INTEGER"},
+	{"rooms", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, imapAccount INTEGER DEFAULT -1, smtpAccount INTEGER DEFAULT -1, mailCheckInterval INTEGER, isHTMLenabled INTEGER, sentFolder TEXT DEFAULT '', timezone TEXT DEFAULT '', undoDelay INTEGER DEFAULT 0, signature TEXT DEFAULT '', conversationMode INTEGER DEFAULT 0, spaceID TEXT DEFAULT '', setupUser TEXT DEFAULT '', emptySince INTEGER DEFAULT 0, leftAt INTEGER DEFAULT 0"},
+	{"imapAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, username TEXT, password TEXT, ignoreSSL INTEGER, mailbox TEXT, security TEXT DEFAULT ''"},
+	{"smtpAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, port int, username TEXT, password TEXT, ignoreSSL INTEGER, signature TEXT DEFAULT '', security TEXT DEFAULT '', authMech TEXT DEFAULT '', transport TEXT DEFAULT ''"},
+	{"emailWritingTemp", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, receiver TEXT, subject TEXT DEFAULT ' ', body TEXT DEFAULT ' ', markdown INTEGER, sendAt INTEGER DEFAULT 0, receipt INTEGER DEFAULT 0, undoable INTEGER DEFAULT 0"},
 	{"version", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, version INTEGER"},
-	{"emailAttachments", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, writeTempID INTEGER, fileName TEXT"},
+	{"emailAttachments", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, writeTempID INTEGER, fileName TEXT, name TEXT DEFAULT '', mimeType TEXT DEFAULT ''"},
+	{"emailRecipients", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, writeTempID INTEGER, position INTEGER, name TEXT, address TEXT"},
+	{"emailLines", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, writeTempID INTEGER, eventID TEXT, position INTEGER, line TEXT, html TEXT DEFAULT ''"},
+	{"templates", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, name TEXT, subject TEXT, body TEXT"},
+	{"mailEvents", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, eventID TEXT, mailbox TEXT, uid INTEGER, uidValidity INTEGER, sender TEXT DEFAULT '', senderName TEXT DEFAULT ''"},
+	{"contacts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, nickname TEXT, name TEXT, address TEXT"},
+	{"outbox", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, sender TEXT, receiver TEXT, subject TEXT, raw BLOB, attempts INTEGER DEFAULT 0, nextTry INTEGER, status TEXT, lastError TEXT DEFAULT '', messageID TEXT DEFAULT ''"},
+	{"sentMails", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, messageID TEXT, envelopeID TEXT, eventID TEXT, subject TEXT"},
+	{"botSettings", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, value TEXT"},
+	{"roomEncryption", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, content TEXT"},
+	{"roomMembers", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, userID TEXT, membership TEXT"},
+	{"ghosts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, userID TEXT, displayName TEXT DEFAULT '', avatarHash TEXT DEFAULT ''"},
+	{"conversations", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, parentRoomID TEXT, roomID TEXT, subject TEXT, address TEXT"},
+	{"conversationMails", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, conversationID INTEGER, messageID TEXT"},
+	{"folderRooms", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, parentRoomID TEXT, mailbox TEXT, roomID TEXT, archived INTEGER DEFAULT 0, synced INTEGER DEFAULT 0"},
+	{"handledEvents", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, eventID TEXT UNIQUE, timestamp INTEGER"},
 }
 
 func handleDBVersion() {
@@ -104,21 +188,38 @@ var dbChanges = []dbChange{
 	{2, "ALTER TABLE rooms ADD isHTMLenabled INTEGER"},
 	{2, "UPDATE rooms SET isHTMLenabled=0"},
 	{7, "CREATE TABLE `blocklist` (`pkID` INTEGER PRIMARY KEY AUTOINCREMENT, `imapAccount` INTEGER, `address` INTEGER);"},
+	{8, "ALTER TABLE rooms ADD sentFolder TEXT DEFAULT ''"},
+	{9, "ALTER TABLE rooms ADD timezone TEXT DEFAULT ''"},
+	{9, "ALTER TABLE rooms ADD undoDelay INTEGER DEFAULT 0"},
+	{9, "ALTER TABLE emailWritingTemp ADD sendAt INTEGER DEFAULT 0"},
+	{10, "ALTER TABLE rooms ADD signature TEXT DEFAULT ''"},
+	{10, "ALTER TABLE smtpAccounts ADD signature TEXT DEFAULT ''"},
+	{12, "ALTER TABLE emailAttachments ADD name TEXT DEFAULT ''"},
+	{12, "ALTER TABLE emailAttachments ADD mimeType TEXT DEFAULT ''"},
+	{14, "ALTER TABLE smtpAccounts ADD security TEXT DEFAULT ''"},
+	{14, "ALTER TABLE smtpAccounts ADD authMech TEXT DEFAULT ''"},
+	{14, "ALTER TABLE smtpAccounts ADD transport TEXT DEFAULT ''"},
+	{16, "ALTER TABLE emailWritingTemp ADD receipt INTEGER DEFAULT 0"},
+	{17, "ALTER TABLE rooms ADD conversationMode INTEGER DEFAULT 0"},
+	{18, "ALTER TABLE rooms ADD spaceID TEXT DEFAULT ''"},
+	{19, "ALTER TABLE imapAccounts ADD security TEXT DEFAULT ''"},
+	{20, "ALTER TABLE rooms ADD setupUser TEXT DEFAULT ''"},
+	{21, "ALTER TABLE rooms ADD emptySince INTEGER DEFAULT 0"},
+	{21, "ALTER TABLE rooms ADD leftAt INTEGER DEFAULT 0"},
+	{22, "ALTER TABLE emailWritingTemp ADD undoable INTEGER DEFAULT 0"},
 }
 
 func startDBupgrader(oldVers int) {
 	WriteLog(info, "starting db upgrade from version "+strconv.Itoa(oldVers)+" to "+strconv.Itoa(version))
-	var err error
 	for _, change := range dbChanges {
 		if change.version > oldVers {
 			fmt.Println("Update Database:", change.changes)
-			_, err = db.Exec(change.changes)
+			if _, err := db.Exec(change.changes); err != nil {
+				WriteLog(critical, "#63 Error upgrading db with '"+change.changes+"': "+err.Error())
+			}
 		}
 	}
-	if err != nil {
-		WriteLog(critical, "#63 Error upgrading db: "+err.Error())
-	}
-	err = saveVersion(version)
+	err := saveVersion(version)
 	if err != nil {
 		WriteLog(critical, "#64 Error upgrading/saveVersion db: "+err.Error())
 		return
@@ -182,28 +283,43 @@ func dbContainsMail(mail string, roomPK int) (bool, error) {
 }
 
 func deleteAttachments(roomID string) {
-	stmt, err := db.Prepare("SELECT pk_id FROM emailWritingTemp WHERE roomID=?")
+	stmt, err := db.Prepare("SELECT pk_id FROM emailWritingTemp WHERE roomID=? AND sendAt=0")
 	if err == nil {
 		var pkid int
 		err = stmt.QueryRow(roomID).Scan(&pkid)
 		if err == nil {
-			attachments, err := getAttachments(pkid)
-			if err == nil {
-				for _, i := range attachments {
-					deleteTempFile(i)
-				}
-			}
-			stmt, err = db.Prepare("DELETE FROM emailAttachments WHERE writeTempID=?")
-			if err == nil {
-				stmt.Exec(pkid)
-			}
+			deleteAttachmentsByID(pkid)
+		}
+	}
+}
+
+func deleteAttachmentsByID(writeTempID int) {
+	attachments, err := getAttachments(writeTempID)
+	if err == nil {
+		for _, i := range attachments {
+			deleteTempFile(i.fileName)
 		}
 	}
+	stmt, err := db.Prepare("DELETE FROM emailAttachments WHERE writeTempID=?")
+	if err == nil {
+		stmt.Exec(writeTempID)
+	}
 }
 
+//deleteWritingTemp deletes the email which is currently written in a room
 func deleteWritingTemp(roomID string) error {
 	deleteAttachments(roomID)
-	stmt, err := db.Prepare("DELETE FROM emailWritingTemp WHERE roomID=?")
+	stmt, err := db.Prepare("DELETE FROM emailLines WHERE writeTempID=(SELECT pk_id FROM emailWritingTemp WHERE roomID=? AND sendAt=0)")
+	if err != nil {
+		return err
+	}
+	stmt.Exec(roomID)
+	stmt, err = db.Prepare("DELETE FROM emailRecipients WHERE writeTempID=(SELECT pk_id FROM emailWritingTemp WHERE roomID=? AND sendAt=0)")
+	if err != nil {
+		return err
+	}
+	stmt.Exec(roomID)
+	stmt, err = db.Prepare("DELETE FROM emailWritingTemp WHERE roomID=? AND sendAt=0")
 	if err != nil {
 		return err
 	}
@@ -211,26 +327,111 @@ func deleteWritingTemp(roomID string) error {
 	return err
 }
 
-func deleteAllWritingTemps() error {
-	_, err := db.Exec("DELETE FROM emailWritingTemp")
+func deleteWritingTempByID(pkID int) error {
+	deleteAttachmentsByID(pkID)
+	stmt, err := db.Prepare("DELETE FROM emailLines WHERE writeTempID=?")
+	if err != nil {
+		return err
+	}
+	stmt.Exec(pkID)
+	stmt, err = db.Prepare("DELETE FROM emailRecipients WHERE writeTempID=?")
+	if err != nil {
+		return err
+	}
+	stmt.Exec(pkID)
+	stmt, err = db.Prepare("DELETE FROM emailWritingTemp WHERE pk_id=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(pkID)
 	return err
 }
 
-func newWritingTemp(roomID, receiver string) error {
-	stmt, err := db.Prepare("INSERT INTO emailWritingTemp (roomID, receiver) VALUES(?,?)")
+func deleteScheduledWritingTemps(roomID string) {
+	temps, err := getScheduledWritingTemps(roomID)
+	if err != nil {
+		return
+	}
+	for _, temp := range temps {
+		deleteWritingTempByID(temp.pkID)
+	}
+}
+
+//deleteAllWritingTemps deletes all unfinished emails. Scheduled emails are kept
+func deleteAllWritingTemps() error {
+	_, err := db.Exec("DELETE FROM emailLines WHERE writeTempID NOT IN (SELECT pk_id FROM emailWritingTemp WHERE sendAt>0)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM emailRecipients WHERE writeTempID NOT IN (SELECT pk_id FROM emailWritingTemp WHERE sendAt>0)")
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(roomID, receiver)
+	_, err = db.Exec("DELETE FROM emailWritingTemp WHERE sendAt=0")
 	return err
 }
 
-func addEmailAttachment(emailid int, filename string) error {
-	stmt, err := db.Prepare("INSERT INTO emailAttachments (writeTempID, fileName) VALUES(?,?)")
+func newWritingTemp(roomID string, recipients []*mail.Address) error {
+	stmt, err := db.Prepare("INSERT INTO emailWritingTemp (roomID, receiver) VALUES(?,'')")
+	if err != nil {
+		return err
+	}
+	res, err := stmt.Exec(roomID)
+	if err != nil {
+		return err
+	}
+	pkID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return saveRecipients(int(pkID), recipients)
+}
+
+func getRecipients(writeTempID int) ([]*mail.Address, error) {
+	rows, err := db.Query("SELECT name, address FROM emailRecipients WHERE writeTempID=? ORDER BY position", writeTempID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []*mail.Address
+	for rows.Next() {
+		var recipient mail.Address
+		if err := rows.Scan(&recipient.Name, &recipient.Address); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, &recipient)
+	}
+	return recipients, nil
+}
+
+//saveRecipients replaces the recipients of an email
+func saveRecipients(writeTempID int, recipients []*mail.Address) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM emailRecipients WHERE writeTempID=?", writeTempID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, recipient := range recipients {
+		_, err = tx.Exec("INSERT INTO emailRecipients (writeTempID, position, name, address) VALUES(?,?,?,?)", writeTempID, i, recipient.Name, recipient.Address)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addEmailAttachment(emailid int, file attachment) error {
+	stmt, err := db.Prepare("INSERT INTO emailAttachments (writeTempID, fileName, name, mimeType) VALUES(?,?,?,?)")
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(emailid, filename)
+	_, err = stmt.Exec(emailid, file.fileName, file.name, file.mimeType)
 	return err
 }
 
@@ -239,46 +440,160 @@ func deleteAttachment(fileName string, writeTempID int) error {
 	if err != nil {
 		return err
 	}
-	stmt.Exec(fileName, writeTempID)
-	return nil
+	defer stmt.Close()
+	_, err = stmt.Exec(fileName, writeTempID)
+	return err
 }
 
-func getAttachments(writingTempID int) ([]string, error) {
-	rows, err := db.Query("SELECT fileName FROM emailAttachments WHERE writeTempID=?", writingTempID)
+func getAttachments(writingTempID int) ([]attachment, error) {
+	rows, err := db.Query("SELECT fileName, name, mimeType FROM emailAttachments WHERE writeTempID=?", writingTempID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var attachments []string
-	var name string
+	var attachments []attachment
 	for rows.Next() {
-		rows.Scan(&name)
-		attachments = append(attachments, name)
+		var file attachment
+		rows.Scan(&file.fileName, &file.name, &file.mimeType)
+		if len(file.name) == 0 {
+			//attached before the original name was saved
+			file.name = file.fileName
+		}
+		attachments = append(attachments, file)
 	}
 	return attachments, nil
 }
 
+func scanWritingTemp(row interface{ Scan(...interface{}) error }) (*emailTemp, error) {
+	var pkID, markdown, receipt int
+	var rID, receiver, subject, body string
+	var sendAt int64
+	err := row.Scan(&pkID, &rID, &receiver, &subject, &body, &markdown, &sendAt, &receipt)
+	if err != nil {
+		return nil, err
+	}
+	mrkdwn := false
+	if markdown == 1 {
+		mrkdwn = true
+	}
+	return &emailTemp{pkID, rID, receiver, subject, body, mrkdwn, sendAt, receipt == 1}, nil
+}
+
+func queryWritingTemps(query string, args ...interface{}) ([]emailTemp, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []emailTemp
+	for rows.Next() {
+		temp, err := scanWritingTemp(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *temp)
+	}
+	return list, nil
+}
+
+//getWritingTemp returns the email which is currently written in a room
 func getWritingTemp(roomID string) (*emailTemp, error) {
-	stmt, err := db.Prepare("SELECT pk_id, roomID, receiver, subject, body, markdown FROM emailWritingTemp WHERE roomID=?")
+	stmt, err := db.Prepare("SELECT pk_id, roomID, receiver, subject, body, markdown, sendAt, IFNULL(receipt, 0) FROM emailWritingTemp WHERE roomID=? AND sendAt=0")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	var pkID, markdown int
-	var rID, receiver, subject, body string
-	err = stmt.QueryRow(roomID).Scan(&pkID, &rID, &receiver, &subject, &body, &markdown)
+	return scanWritingTemp(stmt.QueryRow(roomID))
+}
+
+func getWritingTempByID(pkID int) (*emailTemp, error) {
+	stmt, err := db.Prepare("SELECT pk_id, roomID, receiver, subject, body, markdown, sendAt, IFNULL(receipt, 0) FROM emailWritingTemp WHERE pk_id=?")
 	if err != nil {
 		return nil, err
 	}
-	mrkdwn := false
-	if markdown == 1 {
-		mrkdwn = true
+	defer stmt.Close()
+	return scanWritingTemp(stmt.QueryRow(pkID))
+}
+
+func getScheduledWritingTemps(roomID string) ([]emailTemp, error) {
+	return queryWritingTemps("SELECT pk_id, roomID, receiver, subject, body, markdown, sendAt, IFNULL(receipt, 0) FROM emailWritingTemp WHERE roomID=? AND sendAt>0 ORDER BY sendAt", roomID)
+}
+
+func getDueWritingTemps(now int64) ([]emailTemp, error) {
+	return queryWritingTemps("SELECT pk_id, roomID, receiver, subject, body, markdown, sendAt, IFNULL(receipt, 0) FROM emailWritingTemp WHERE sendAt>0 AND sendAt<=? ORDER BY sendAt", now)
+}
+
+//getUndoableWritingTemp returns the email sent last in a room which waits for the undo delay
+func getUndoableWritingTemp(roomID string) (*emailTemp, error) {
+	stmt, err := db.Prepare("SELECT pk_id, roomID, receiver, subject, body, markdown, sendAt, IFNULL(receipt, 0) FROM emailWritingTemp WHERE roomID=? AND sendAt>0 AND undoable=1 ORDER BY pk_id DESC LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return scanWritingTemp(stmt.QueryRow(roomID))
+}
+
+//scheduleWritingTemp sets the time an email gets sent. 0 makes it the email currently written.
+//undoable emails were sent with the undo delay and can be canceled with !undo
+func scheduleWritingTemp(pkID int, sendAt int64, undoable bool) error {
+	undo := 0
+	if undoable {
+		undo = 1
+	}
+	_, err := db.Exec("UPDATE emailWritingTemp SET sendAt=?, undoable=? WHERE pk_id=?", sendAt, undo, pkID)
+	return err
+}
+
+func getDraftLines(writeTempID int) ([]draftLine, error) {
+	rows, err := db.Query("SELECT eventID, line, html FROM emailLines WHERE writeTempID=? ORDER BY position", writeTempID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []draftLine
+	for rows.Next() {
+		var line draftLine
+		if err := rows.Scan(&line.eventID, &line.line, &line.html); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+//saveDraftLines replaces the lines of an email and updates its body
+func saveDraftLines(writeTempID int, lines []draftLine) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM emailLines WHERE writeTempID=?", writeTempID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		_, err = tx.Exec("INSERT INTO emailLines (writeTempID, eventID, position, line, html) VALUES(?,?,?,?,?)", writeTempID, line.eventID, i, line.line, line.html)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		texts[i] = line.line
+	}
+	_, err = tx.Exec("UPDATE emailWritingTemp SET body=? WHERE pk_id=?", joinBodyLines(texts), writeTempID)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	return &emailTemp{pkID, rID, receiver, subject, body, mrkdwn}, nil
+	return tx.Commit()
 }
 
 func saveWritingtemp(roomID, key, value string) error {
-	stmt, err := db.Prepare("UPDATE emailWritingTemp SET " + key + "=? WHERE roomID=?")
+	stmt, err := db.Prepare("UPDATE emailWritingTemp SET " + key + "=? WHERE roomID=? AND sendAt=0")
 	if err != nil {
 		return err
 	}
@@ -287,7 +602,7 @@ func saveWritingtemp(roomID, key, value string) error {
 }
 
 func isUserWritingEmail(roomID string) (bool, error) {
-	stmt, err := db.Prepare("SELECT COUNT(*) FROM emailWritingTemp WHERE roomID=?")
+	stmt, err := db.Prepare("SELECT COUNT(*) FROM emailWritingTemp WHERE roomID=? AND sendAt=0")
 	if err != nil {
 		return false, err
 	}
@@ -311,6 +626,40 @@ func deleteRoomAndEmailByRoomID(roomID string) {
 
 	deleteMails(roomID)
 
+	deleteScheduledWritingTemps(roomID)
+
+	stmt5, err := db.Prepare("DELETE FROM outbox WHERE roomID=?")
+	checkErr(err)
+	stmt5.Exec(roomID)
+
+	stmt6, err := db.Prepare("DELETE FROM templates WHERE roomID=?")
+	checkErr(err)
+	stmt6.Exec(roomID)
+
+	stmt7, err := db.Prepare("DELETE FROM mailEvents WHERE roomID=?")
+	checkErr(err)
+	stmt7.Exec(roomID)
+
+	stmt8, err := db.Prepare("DELETE FROM contacts WHERE roomID=?")
+	checkErr(err)
+	stmt8.Exec(roomID)
+
+	stmt9, err := db.Prepare("DELETE FROM sentMails WHERE roomID=?")
+	checkErr(err)
+	stmt9.Exec(roomID)
+
+	stmt10, err := db.Prepare("DELETE FROM conversationMails WHERE conversationID IN (SELECT pk_id FROM conversations WHERE parentRoomID=?)")
+	checkErr(err)
+	stmt10.Exec(roomID)
+
+	stmt11, err := db.Prepare("DELETE FROM conversations WHERE parentRoomID=?")
+	checkErr(err)
+	stmt11.Exec(roomID)
+
+	stmt12, err := db.Prepare("DELETE FROM folderRooms WHERE parentRoomID=?")
+	checkErr(err)
+	stmt12.Exec(roomID)
+
 	stmt2, err := db.Prepare("DELETE FROM rooms WHERE roomID=?")
 	checkErr(err)
 	stmt2.Exec(roomID)
@@ -374,7 +723,7 @@ func getRoomAccounts(roomID string) (imapAccount, smtpAccount int, err error) {
 		return
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(roomID).Scan(&imapAccount, &smtpAccount)
+	err = stmt.QueryRow(accountRoomID(roomID)).Scan(&imapAccount, &smtpAccount)
 	if err != nil {
 		err = nil
 		return
@@ -382,8 +731,9 @@ func getRoomAccounts(roomID string) (imapAccount, smtpAccount int, err error) {
 	return
 }
 
-func insertNewRoom(roomID string, mailCheckInterval int) int64 {
-	stmt, err := db.Prepare("INSERT INTO rooms (roomID, mailCheckInterval, isHTMLenabled) VALUES(?,?,?)")
+//insertNewRoom adds a bridged room. setupUser is the user who created the bridge
+func insertNewRoom(roomID, setupUser string, mailCheckInterval int) int64 {
+	stmt, err := db.Prepare("INSERT INTO rooms (roomID, mailCheckInterval, isHTMLenabled, setupUser) VALUES(?,?,?,?)")
 	checkErr(err)
 
 	isenabled := 0
@@ -391,7 +741,7 @@ func insertNewRoom(roomID string, mailCheckInterval int) int64 {
 		isenabled = 1
 	}
 
-	res, err := stmt.Exec(roomID, mailCheckInterval, isenabled)
+	res, err := stmt.Exec(roomID, mailCheckInterval, isenabled, setupUser)
 	if err != nil {
 		WriteLog(critical, "#19 insertNewRoom could not execute err: "+err.Error())
 		return -1
@@ -471,8 +821,8 @@ func insertSMTPAccountount(host string, port int, username, password string, ign
 	return id, nil
 }
 
-func insertimapAccountount(host, username, password, mailbox string, ignoreSSl bool) (id int64, success bool) {
-	stmt, err := db.Prepare("INSERT INTO imapAccounts (host, username, password, ignoreSSL, mailbox) VALUES(?,?,?,?,?)")
+func insertimapAccountount(host, username, password, mailbox, security string, ignoreSSl bool) (id int64, success bool) {
+	stmt, err := db.Prepare("INSERT INTO imapAccounts (host, username, password, ignoreSSL, mailbox, security) VALUES(?,?,?,?,?,?)")
 	success = true
 	if !checkErr(err) {
 		WriteLog(critical, "#20 insertimapAccountount could not execute err: "+err.Error())
@@ -482,7 +832,7 @@ func insertimapAccountount(host, username, password, mailbox string, ignoreSSl b
 	if ignoreSSl {
 		ign = 1
 	}
-	a, er := stmt.Exec(host, username, base64.StdEncoding.EncodeToString([]byte(password)), ign, mailbox)
+	a, er := stmt.Exec(host, username, base64.StdEncoding.EncodeToString([]byte(password)), ign, mailbox, security)
 	if !checkErr(er) {
 		WriteLog(critical, "#21 insertimapAccountount could not execute err: "+err.Error())
 		success = false
@@ -532,16 +882,16 @@ func isSMTPAccountAlreadyInUse(email string) (bool, error) {
 }
 
 func getimapAccounts() ([]imapAccountount, error) {
-	rows, err := db.Query("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, mailbox FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id)")
+	rows, err := db.Query("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, mailbox, IFNULL(security, '') FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id) WHERE IFNULL(rooms.leftAt, 0)=0")
 	if err != nil {
 		return nil, err
 	}
 
 	var list []imapAccountount
-	var host, username, password, roomID, mailbox string
+	var host, username, password, roomID, mailbox, security string
 	var ignoreSSL, roomPKID, mailCheckInterval int
 	for rows.Next() {
-		rows.Scan(&host, &username, &password, &ignoreSSL, &roomID, &roomPKID, &mailCheckInterval, &mailbox)
+		rows.Scan(&host, &username, &password, &ignoreSSL, &roomID, &roomPKID, &mailCheckInterval, &mailbox, &security)
 		ignssl := false
 		if ignoreSSL == 1 {
 			ignssl = true
@@ -551,22 +901,22 @@ func getimapAccounts() ([]imapAccountount, error) {
 			fmt.Println(berr.Error())
 			continue
 		}
-		list = append(list, imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, false})
+		list = append(list, imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, false, security})
 	}
 	return list, nil
 }
 
 func getIMAPAccount(roomID string) (*imapAccountount, error) {
-	var host, username, password, rid, mailbox string
+	var host, username, password, rid, mailbox, security string
 	var ignoreSSL, roomPKID, mailCheckInterval int
 
-	res, err := db.Prepare("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, mailbox FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id) WHERE rooms.roomID=?")
+	res, err := db.Prepare("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, mailbox, IFNULL(security, '') FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id) WHERE rooms.roomID=?")
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = res.QueryRow(roomID).Scan(&host, &username, &password, &ignoreSSL, &rid, &roomPKID, &mailCheckInterval, &mailbox)
+	err = res.QueryRow(accountRoomID(roomID)).Scan(&host, &username, &password, &ignoreSSL, &rid, &roomPKID, &mailCheckInterval, &mailbox, &security)
 
 	if err != nil {
 		return nil, err
@@ -582,18 +932,18 @@ func getIMAPAccount(roomID string) (*imapAccountount, error) {
 		return nil, berr
 	}
 
-	return &imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, false}, nil
+	return &imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, false, security}, nil
 }
 
 func getSMTPAccount(roomID string) (*smtpAccount, error) {
-	rows, err := db.Prepare("SELECT smtpAccounts.pk_id, host, port, username, password, rooms.pk_id, ignoreSSL FROM smtpAccounts INNER JOIN rooms ON (rooms.smtpAccount = smtpAccounts.pk_id) WHERE rooms.roomID=?")
+	rows, err := db.Prepare("SELECT smtpAccounts.pk_id, host, port, username, password, rooms.pk_id, ignoreSSL, IFNULL(security, ''), IFNULL(authMech, ''), IFNULL(transport, '') FROM smtpAccounts INNER JOIN rooms ON (rooms.smtpAccount = smtpAccounts.pk_id) WHERE rooms.roomID=?")
 	if err != nil {
 		return nil, err
 	}
 
-	var host, username, password string
+	var host, username, password, security, authMech, transport string
 	var ignoreSSL, roomPKID, pk, port int
-	err = rows.QueryRow(roomID).Scan(&pk, &host, &port, &username, &password, &roomPKID, &ignoreSSL)
+	err = rows.QueryRow(accountRoomID(roomID)).Scan(&pk, &host, &port, &username, &password, &roomPKID, &ignoreSSL, &security, &authMech, &transport)
 	if err != nil {
 		return nil, err
 	}
@@ -606,7 +956,55 @@ func getSMTPAccount(roomID string) (*smtpAccount, error) {
 		fmt.Println(berr.Error())
 		return nil, berr
 	}
-	return &smtpAccount{host, username, string(pass), roomID, ignSSL, roomPKID, port, pk}, nil
+	return &smtpAccount{host, username, string(pass), roomID, ignSSL, roomPKID, port, pk, security, authMech, transport}, nil
+}
+
+//updateIMAPAccount saves the changed login data of the imap account of a room
+func updateIMAPAccount(roomID string, account *imapAccountount) error {
+	stmt, err := db.Prepare("UPDATE imapAccounts SET host=?, username=?, password=?, ignoreSSL=?, mailbox=?, security=? WHERE pk_id=(SELECT imapAccount FROM rooms WHERE roomID=?)")
+	if err != nil {
+		return err
+	}
+	ign := 0
+	if account.ignoreSSL {
+		ign = 1
+	}
+	_, err = stmt.Exec(account.host, account.username, base64.StdEncoding.EncodeToString([]byte(account.password)), ign, account.mailbox, account.security, roomID)
+	return err
+}
+
+//updateSMTPAccount saves the changed login data of an smtp account
+func updateSMTPAccount(account *smtpAccount) error {
+	stmt, err := db.Prepare("UPDATE smtpAccounts SET host=?, port=?, username=?, password=?, ignoreSSL=?, security=?, transport=? WHERE pk_id=?")
+	if err != nil {
+		return err
+	}
+	ign := 0
+	if account.ignoreSSL {
+		ign = 1
+	}
+	_, err = stmt.Exec(account.host, account.port, account.username, base64.StdEncoding.EncodeToString([]byte(account.password)), ign, account.security, account.transport, account.pk)
+	return err
+}
+
+//smtp settings which can be changed with !setsmtp and their columns
+var smtpSettingColumns = map[string]string{
+	"security":  "security",
+	"auth":      "authMech",
+	"transport": "transport",
+}
+
+func saveSMTPSetting(roomID, setting, value string) error {
+	column, ok := smtpSettingColumns[setting]
+	if !ok {
+		return errors.New("unknown smtp setting " + setting)
+	}
+	stmt, err := db.Prepare("UPDATE smtpAccounts SET " + column + "=? WHERE pk_id=(SELECT smtpAccount FROM rooms WHERE roomID=?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(value, roomID)
+	return err
 }
 
 func saveMailbox(roomID, newMailbox string) error {
@@ -661,69 +1059,285 @@ func setHTMLenabled(roomID string, enabled bool) error {
 	return nil
 }
 
-func getBlocklist(imapAccount int) []string {
-	rows, err := db.Query("SELECT address FROM blocklist WHERE imapAccount=?", imapAccount)
+func getSentFolderOverride(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(sentFolder, '') FROM rooms WHERE roomID=?")
 	if err != nil {
-		fmt.Println("Err:", err.Error())
-		return []string{"Error fetching accounts:" + err.Error()}
-	}
-	var blocklist []string
-	var address string
-	for rows.Next() {
-		rows.Scan(&address)
-		blocklist = append(blocklist, address)
+		return "", err
 	}
-	return blocklist
-}
-
-func isInBlocklist(imapAccount int, addr string) bool {
-	row := db.QueryRow("SELECT COUNT(*) FROM blocklist WHERE imapAccount=? AND address=?", imapAccount, addr)
-	var has int
-	row.Scan(&has)
-	return has == 1
+	defer stmt.Close()
+	folder := ""
+	err = stmt.QueryRow(accountRoomID(roomID)).Scan(&folder)
+	return folder, err
 }
 
-func addEmailToBlocklist(imapAcc int, emailaddr string) error {
-	if isInBlocklist(imapAcc, emailaddr) {
-		return nil
-	}
-	stmt, err := db.Prepare("INSERT INTO blocklist (imapAccount, address) VALUES(?,?)")
+func saveSentFolder(roomID, folder string) error {
+	stmt, err := db.Prepare("UPDATE rooms SET sentFolder=? WHERE roomID=?")
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(imapAcc, emailaddr)
+	_, err = stmt.Exec(folder, roomID)
 	return err
 }
 
-func clearBlocklist(imapAcc int) error {
-	stmt, err := db.Prepare("DELETE FROM blocklist WHERE imapAccount=?")
+func insertOutboxMail(roomID, sender, receiver, subject, messageID string, raw []byte, nextTry int64) (int64, error) {
+	stmt, err := db.Prepare("INSERT INTO outbox (roomID, sender, receiver, subject, messageID, raw, nextTry, status) VALUES(?,?,?,?,?,?,?,?)")
 	if err != nil {
-		return err
+		return -1, err
 	}
-	_, err = stmt.Exec(imapAcc)
-	return err
+	res, err := stmt.Exec(roomID, sender, receiver, subject, messageID, raw, nextTry, outboxQueued)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
 }
 
-func removeEmailFromBlocklist(imapAcc int, addr string) error {
-	if !isInBlocklist(imapAcc, addr) {
-		return errors.New("not on blocklist")
+func getOutboxMail(pkID int64) (*outboxMail, error) {
+	stmt, err := db.Prepare("SELECT pk_id, roomID, sender, receiver, subject, status, raw, attempts, nextTry, lastError, IFNULL(messageID, '') FROM outbox WHERE pk_id=?")
+	if err != nil {
+		return nil, err
 	}
-	stmt, err := db.Prepare("DELETE FROM blocklist WHERE imapAccount=? AND address=?")
+	defer stmt.Close()
+	var mail outboxMail
+	err = stmt.QueryRow(pkID).Scan(&mail.pkID, &mail.roomID, &mail.sender, &mail.receiver, &mail.subject, &mail.status, &mail.raw, &mail.attempts, &mail.nextTry, &mail.lastError, &mail.messageID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = stmt.Exec(imapAcc, addr)
-	return err
+	return &mail, nil
 }
 
-//returns true if email matches blocklist
-func checkForBlocklist(roomID string, senderEmail string) bool {
-	acc, _, err := getRoomAccounts(roomID)
+func queryOutboxMails(query string, args ...interface{}) ([]outboxMail, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		fmt.Println("Err:", err.Error())
-		return false
+		return nil, err
 	}
-	blocklist := getBlocklist(acc)
+	defer rows.Close()
+
+	var list []outboxMail
+	for rows.Next() {
+		var mail outboxMail
+		err = rows.Scan(&mail.pkID, &mail.roomID, &mail.sender, &mail.receiver, &mail.subject, &mail.status, &mail.attempts, &mail.nextTry, &mail.lastError)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, mail)
+	}
+	return list, nil
+}
+
+//getOutboxMails returns the outbox of a room without the rendered emails
+func getOutboxMails(roomID string) ([]outboxMail, error) {
+	return queryOutboxMails("SELECT pk_id, roomID, sender, receiver, subject, status, attempts, nextTry, lastError FROM outbox WHERE roomID=? ORDER BY pk_id", roomID)
+}
+
+func getDueOutboxMails(now int64) ([]outboxMail, error) {
+	return queryOutboxMails("SELECT pk_id, roomID, sender, receiver, subject, status, attempts, nextTry, lastError FROM outbox WHERE status=? AND nextTry<=? ORDER BY nextTry", outboxQueued, now)
+}
+
+func updateOutboxMail(pkID int64, attempts int, nextTry int64, status, lastError string) error {
+	stmt, err := db.Prepare("UPDATE outbox SET attempts=?, nextTry=?, status=?, lastError=? WHERE pk_id=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(attempts, nextTry, status, lastError, pkID)
+	return err
+}
+
+func deleteOutboxMail(pkID int64) error {
+	stmt, err := db.Prepare("DELETE FROM outbox WHERE pk_id=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(pkID)
+	return err
+}
+
+func getRoomTimezone(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(timezone, '') FROM rooms WHERE roomID=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	timezone := ""
+	err = stmt.QueryRow(roomID).Scan(&timezone)
+	return timezone, err
+}
+
+func saveRoomTimezone(roomID, timezone string) error {
+	stmt, err := db.Prepare("UPDATE rooms SET timezone=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(timezone, roomID)
+	return err
+}
+
+func getUndoDelay(roomID string) (int, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(undoDelay, 0) FROM rooms WHERE roomID=?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	delay := 0
+	err = stmt.QueryRow(roomID).Scan(&delay)
+	return delay, err
+}
+
+func saveUndoDelay(roomID string, delay int) error {
+	stmt, err := db.Prepare("UPDATE rooms SET undoDelay=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(delay, roomID)
+	return err
+}
+
+//getSignatures returns the signature of the room and of its smtp account
+func getSignatures(roomID string) (roomSignature, accountSignature string, err error) {
+	stmt, err := db.Prepare("SELECT IFNULL(rooms.signature, ''), IFNULL(smtpAccounts.signature, '') FROM rooms LEFT JOIN smtpAccounts ON (smtpAccounts.pk_id = rooms.smtpAccount) WHERE roomID=?")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(accountRoomID(roomID)).Scan(&roomSignature, &accountSignature)
+	return
+}
+
+func saveRoomSignature(roomID, signature string) error {
+	stmt, err := db.Prepare("UPDATE rooms SET signature=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(signature, roomID)
+	return err
+}
+
+func saveAccountSignature(roomID, signature string) error {
+	stmt, err := db.Prepare("UPDATE smtpAccounts SET signature=? WHERE pk_id=(SELECT smtpAccount FROM rooms WHERE roomID=?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(signature, roomID)
+	return err
+}
+
+func getTemplate(roomID, name string) (*mailTemplate, error) {
+	stmt, err := db.Prepare("SELECT name, subject, body FROM templates WHERE roomID=? AND name=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var template mailTemplate
+	err = stmt.QueryRow(roomID, name).Scan(&template.name, &template.subject, &template.body)
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func getTemplates(roomID string) ([]mailTemplate, error) {
+	rows, err := db.Query("SELECT name, subject, body FROM templates WHERE roomID=? ORDER BY name", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []mailTemplate
+	for rows.Next() {
+		var template mailTemplate
+		if err := rows.Scan(&template.name, &template.subject, &template.body); err != nil {
+			return nil, err
+		}
+		list = append(list, template)
+	}
+	return list, nil
+}
+
+//saveTemplate creates a template or overwrites an existing one with the same name
+func saveTemplate(roomID, name, subject, body string) error {
+	err := deleteTemplate(roomID, name)
+	if err != nil {
+		return err
+	}
+	stmt, err := db.Prepare("INSERT INTO templates (roomID, name, subject, body) VALUES(?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomID, name, subject, body)
+	return err
+}
+
+func deleteTemplate(roomID, name string) error {
+	stmt, err := db.Prepare("DELETE FROM templates WHERE roomID=? AND name=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomID, name)
+	return err
+}
+
+func getBlocklist(imapAccount int) []string {
+	rows, err := db.Query("SELECT address FROM blocklist WHERE imapAccount=?", imapAccount)
+	if err != nil {
+		fmt.Println("Err:", err.Error())
+		return []string{"Error fetching accounts:" + err.Error()}
+	}
+	var blocklist []string
+	var address string
+	for rows.Next() {
+		rows.Scan(&address)
+		blocklist = append(blocklist, address)
+	}
+	return blocklist
+}
+
+func isInBlocklist(imapAccount int, addr string) bool {
+	row := db.QueryRow("SELECT COUNT(*) FROM blocklist WHERE imapAccount=? AND address=?", imapAccount, addr)
+	var has int
+	row.Scan(&has)
+	return has == 1
+}
+
+func addEmailToBlocklist(imapAcc int, emailaddr string) error {
+	if isInBlocklist(imapAcc, emailaddr) {
+		return nil
+	}
+	stmt, err := db.Prepare("INSERT INTO blocklist (imapAccount, address) VALUES(?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(imapAcc, emailaddr)
+	return err
+}
+
+func clearBlocklist(imapAcc int) error {
+	stmt, err := db.Prepare("DELETE FROM blocklist WHERE imapAccount=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(imapAcc)
+	return err
+}
+
+func removeEmailFromBlocklist(imapAcc int, addr string) error {
+	if !isInBlocklist(imapAcc, addr) {
+		return errors.New("not on blocklist")
+	}
+	stmt, err := db.Prepare("DELETE FROM blocklist WHERE imapAccount=? AND address=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(imapAcc, addr)
+	return err
+}
+
+//returns true if email matches blocklist
+func checkForBlocklist(roomID string, senderEmail string) bool {
+	acc, _, err := getRoomAccounts(roomID)
+	if err != nil {
+		fmt.Println("Err:", err.Error())
+		return false
+	}
+	blocklist := getBlocklist(acc)
 	for _, bll := range blocklist {
 		if strings.HasPrefix(bll, "*") || strings.HasSuffix(bll, "*") {
 			if strings.HasPrefix(bll, "*") && !strings.HasSuffix(bll, "*") {
@@ -742,3 +1356,480 @@ func checkForBlocklist(roomID string, senderEmail string) bool {
 	}
 	return false
 }
+
+//insertMailEvent saves which email a bridged message belongs to
+func insertMailEvent(roomID, eventID string, ref mailRef) error {
+	stmt, err := db.Prepare("INSERT INTO mailEvents (roomID, eventID, mailbox, uid, uidValidity, sender, senderName) VALUES(?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomID, eventID, ref.mailbox, ref.uid, ref.uidValidity, ref.sender, ref.senderName)
+	return err
+}
+
+func getMailEvent(roomID, eventID string) (*mailRef, error) {
+	stmt, err := db.Prepare("SELECT mailbox, uid, uidValidity, sender, senderName FROM mailEvents WHERE roomID=? AND eventID=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var ref mailRef
+	err = stmt.QueryRow(roomID, eventID).Scan(&ref.mailbox, &ref.uid, &ref.uidValidity, &ref.sender, &ref.senderName)
+	if err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+//addContact saves a contact. A contact with the same nickname gets replaced
+func addContact(roomID string, c contact) error {
+	err := deleteContact(roomID, c.nickname)
+	if err != nil {
+		return err
+	}
+	stmt, err := db.Prepare("INSERT INTO contacts (roomID, nickname, name, address) VALUES(?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomID, c.nickname, c.name, c.address)
+	return err
+}
+
+func deleteContact(roomID, nickname string) error {
+	stmt, err := db.Prepare("DELETE FROM contacts WHERE roomID=? AND nickname=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomID, nickname)
+	return err
+}
+
+func getContact(roomID, nickname string) (*contact, error) {
+	stmt, err := db.Prepare("SELECT nickname, name, address FROM contacts WHERE roomID=? AND nickname=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var c contact
+	err = stmt.QueryRow(roomID, nickname).Scan(&c.nickname, &c.name, &c.address)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func getContacts(roomID string) ([]contact, error) {
+	rows, err := db.Query("SELECT nickname, name, address FROM contacts WHERE roomID=? ORDER BY nickname", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []contact
+	for rows.Next() {
+		var c contact
+		if err := rows.Scan(&c.nickname, &c.name, &c.address); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
+
+func insertSentMail(roomID string, mail sentMail) error {
+	stmt, err := db.Prepare("INSERT INTO sentMails (roomID, messageID, envelopeID, eventID, subject) VALUES(?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomID, mail.messageID, mail.envelopeID, mail.eventID, mail.subject)
+	return err
+}
+
+//getSentMail finds a sent email by the envelope id or the Message-ID a bounce refers to
+func getSentMail(roomID, envelopeID, messageID string) (*sentMail, error) {
+	stmt, err := db.Prepare("SELECT messageID, envelopeID, eventID, subject FROM sentMails WHERE roomID=? AND ((envelopeID=? AND envelopeID!='') OR (messageID=? AND messageID!='')) ORDER BY pk_id DESC LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var mail sentMail
+	err = stmt.QueryRow(roomID, envelopeID, messageID).Scan(&mail.messageID, &mail.envelopeID, &mail.eventID, &mail.subject)
+	if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+//getBotSetting returns a value the bridge stored for itself, eg. its device id. Returns "" if it isn't set
+func getBotSetting(name string) (string, error) {
+	stmt, err := db.Prepare("SELECT value FROM botSettings WHERE name=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var value string
+	err = stmt.QueryRow(name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func setBotSetting(name, value string) error {
+	_, err := db.Exec("DELETE FROM botSettings WHERE name=?", name)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO botSettings (name, value) VALUES(?,?)", name, value)
+	return err
+}
+
+//setRoomEncryption saves the content of the m.room.encryption event of a room
+func setRoomEncryption(roomID, content string) error {
+	_, err := db.Exec("DELETE FROM roomEncryption WHERE roomID=?", roomID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO roomEncryption (roomID, content) VALUES(?,?)", roomID, content)
+	return err
+}
+
+//getRoomEncryption returns the content of the m.room.encryption event or "" if the room isn't encrypted
+func getRoomEncryption(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT content FROM roomEncryption WHERE roomID=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var content string
+	err = stmt.QueryRow(roomID).Scan(&content)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return content, err
+}
+
+func setRoomMember(roomID, userID, membership string) error {
+	_, err := db.Exec("DELETE FROM roomMembers WHERE roomID=? AND userID=?", roomID, userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO roomMembers (roomID, userID, membership) VALUES(?,?,?)", roomID, userID, membership)
+	return err
+}
+
+//getRoomMembers returns the joined and invited users of a room
+func getRoomMembers(roomID string) ([]string, error) {
+	rows, err := db.Query("SELECT userID FROM roomMembers WHERE roomID=? AND membership IN ('join', 'invite')", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+//getRoomMembersWithMembership returns the members of a room having the given membership, eg. 'join'
+func getRoomMembersWithMembership(roomID, membership string) ([]string, error) {
+	rows, err := db.Query("SELECT userID FROM roomMembers WHERE roomID=? AND membership=?", roomID, membership)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+//getEncryptedRoomsOfUser returns the encrypted rooms the user is a member of
+func getEncryptedRoomsOfUser(userID string) ([]string, error) {
+	rows, err := db.Query("SELECT roomMembers.roomID FROM roomMembers JOIN roomEncryption ON (roomEncryption.roomID = roomMembers.roomID) WHERE userID=? AND membership IN ('join', 'invite')", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, roomID)
+	}
+	return rooms, rows.Err()
+}
+
+//markEventHandled saves the id of an event. Returns false if it was handled before
+func markEventHandled(eventID string, timestamp int64) (bool, error) {
+	res, err := db.Exec("INSERT OR IGNORE INTO handledEvents (eventID, timestamp) VALUES(?,?)", eventID, timestamp)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	return inserted > 0, err
+}
+
+//deleteHandledEvents removes the ids of events sent before the given time (unix ms)
+func deleteHandledEvents(before int64) error {
+	_, err := db.Exec("DELETE FROM handledEvents WHERE timestamp<?", before)
+	return err
+}
+
+//getGhost returns nil if the puppet wasn't registered yet
+func getGhost(userID string) (*ghostUser, error) {
+	stmt, err := db.Prepare("SELECT userID, displayName, avatarHash FROM ghosts WHERE userID=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var ghost ghostUser
+	err = stmt.QueryRow(userID).Scan(&ghost.userID, &ghost.displayName, &ghost.avatarHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ghost, nil
+}
+
+func saveGhost(ghost *ghostUser) error {
+	_, err := db.Exec("DELETE FROM ghosts WHERE userID=?", ghost.userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO ghosts (userID, displayName, avatarHash) VALUES(?,?,?)", ghost.userID, ghost.displayName, ghost.avatarHash)
+	return err
+}
+
+//accountRoomID returns the room whose accounts a room uses: the parent of a conversation or folder room, the room itself otherwise
+func accountRoomID(roomID string) string {
+	var parentRoomID string
+	err := db.QueryRow("SELECT parentRoomID FROM conversations WHERE roomID=? UNION SELECT parentRoomID FROM folderRooms WHERE roomID=?", roomID, roomID).Scan(&parentRoomID)
+	if err != nil {
+		return roomID
+	}
+	return parentRoomID
+}
+
+func isConversationMode(roomID string) (bool, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(conversationMode, 0) FROM rooms WHERE roomID=?")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+	var mode int
+	err = stmt.QueryRow(roomID).Scan(&mode)
+	return mode == 1, err
+}
+
+func saveConversationMode(roomID string, enabled bool) error {
+	mode := 0
+	if enabled {
+		mode = 1
+	}
+	_, err := db.Exec("UPDATE rooms SET conversationMode=? WHERE roomID=?", mode, roomID)
+	return err
+}
+
+func insertConversation(conv *conversation) (int64, error) {
+	res, err := db.Exec("INSERT INTO conversations (parentRoomID, roomID, subject, address) VALUES(?,?,?,?)", conv.parentRoomID, conv.roomID, conv.subject, conv.address)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+//getConversation returns the conversation of a room or nil if the room isn't one
+func getConversation(roomID string) (*conversation, error) {
+	var conv conversation
+	err := db.QueryRow("SELECT pk_id, parentRoomID, roomID, subject, address FROM conversations WHERE roomID=?", roomID).Scan(&conv.pkID, &conv.parentRoomID, &conv.roomID, &conv.subject, &conv.address)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+//findConversation returns the conversation of a parent room containing one of the emails or nil if there is none
+func findConversation(parentRoomID string, messageIDs []string) (*conversation, error) {
+	for _, messageID := range messageIDs {
+		var conv conversation
+		err := db.QueryRow("SELECT conversations.pk_id, parentRoomID, roomID, subject, address FROM conversations INNER JOIN conversationMails ON (conversationMails.conversationID = conversations.pk_id) WHERE parentRoomID=? AND messageID=?", parentRoomID, messageID).Scan(&conv.pkID, &conv.parentRoomID, &conv.roomID, &conv.subject, &conv.address)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &conv, nil
+	}
+	return nil, nil
+}
+
+func insertConversationMail(conversationID int64, messageID string) error {
+	_, err := db.Exec("INSERT INTO conversationMails (conversationID, messageID) VALUES(?,?)", conversationID, messageID)
+	return err
+}
+
+//getConversationMails returns the Message-IDs of a conversation, the oldest first
+func getConversationMails(conversationID int64) ([]string, error) {
+	rows, err := db.Query("SELECT messageID FROM conversationMails WHERE conversationID=? ORDER BY pk_id", conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messageIDs []string
+	for rows.Next() {
+		var messageID string
+		if err := rows.Scan(&messageID); err != nil {
+			return nil, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	return messageIDs, rows.Err()
+}
+
+//getSpaceID returns the space of a bridged room or an empty string if it has none
+func getSpaceID(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(spaceID, '') FROM rooms WHERE roomID=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var spaceID string
+	err = stmt.QueryRow(roomID).Scan(&spaceID)
+	return spaceID, err
+}
+
+//getSetupUser returns the user who created the bridge of a room, empty for bridges created before it was saved
+func getSetupUser(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(setupUser, '') FROM rooms WHERE roomID=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var setupUser string
+	err = stmt.QueryRow(accountRoomID(roomID)).Scan(&setupUser)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return setupUser, err
+}
+
+//setRoomEmptySince saves when the last user left a bridged room, 0 if users are in it
+func setRoomEmptySince(roomID string, since int64) error {
+	_, err := db.Exec("UPDATE rooms SET emptySince=? WHERE roomID=?", since, roomID)
+	return err
+}
+
+//getEmptyRooms returns the bridged rooms without users and since when they are empty
+func getEmptyRooms() (map[string]int64, error) {
+	rows, err := db.Query("SELECT roomID, emptySince FROM rooms WHERE emptySince>0 AND IFNULL(leftAt, 0)=0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := make(map[string]int64)
+	for rows.Next() {
+		var roomID string
+		var since int64
+		if err := rows.Scan(&roomID, &since); err != nil {
+			return nil, err
+		}
+		rooms[roomID] = since
+	}
+	return rooms, rows.Err()
+}
+
+//setRoomLeftAt saves when the bridge left a room, 0 if it is in the room
+func setRoomLeftAt(roomID string, leftAt int64) error {
+	_, err := db.Exec("UPDATE rooms SET leftAt=?, emptySince=0 WHERE roomID=?", leftAt, roomID)
+	return err
+}
+
+//getRoomLeftAt returns when the bridge left a room, 0 if it is in the room or the room isn't bridged
+func getRoomLeftAt(roomID string) (int64, error) {
+	var leftAt int64
+	err := db.QueryRow("SELECT IFNULL(leftAt, 0) FROM rooms WHERE roomID=?", roomID).Scan(&leftAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return leftAt, err
+}
+
+func saveSpaceID(roomID, spaceID string) error {
+	_, err := db.Exec("UPDATE rooms SET spaceID=? WHERE roomID=?", spaceID, roomID)
+	return err
+}
+
+func insertFolderRoom(folder *folderRoom) (int64, error) {
+	res, err := db.Exec("INSERT INTO folderRooms (parentRoomID, mailbox, roomID) VALUES(?,?,?)", folder.parentRoomID, folder.mailbox, folder.roomID)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+func getFolderRooms(parentRoomID string) ([]folderRoom, error) {
+	rows, err := db.Query("SELECT pk_id, parentRoomID, mailbox, roomID, archived, synced FROM folderRooms WHERE parentRoomID=?", parentRoomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var folders []folderRoom
+	for rows.Next() {
+		var folder folderRoom
+		var archived, synced int
+		if err := rows.Scan(&folder.pkID, &folder.parentRoomID, &folder.mailbox, &folder.roomID, &archived, &synced); err != nil {
+			return nil, err
+		}
+		folder.archived, folder.synced = archived == 1, synced == 1
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+//getFolderRoomID returns the room of a folder or an empty string if the folder has none
+func getFolderRoomID(parentRoomID, mailbox string) (string, error) {
+	var roomID string
+	err := db.QueryRow("SELECT roomID FROM folderRooms WHERE parentRoomID=? AND mailbox=? AND archived=0", parentRoomID, mailbox).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return roomID, err
+}
+
+func setFolderRoomArchived(pkID int64, archived bool) error {
+	value := 0
+	if archived {
+		value = 1
+	}
+	_, err := db.Exec("UPDATE folderRooms SET archived=? WHERE pk_id=?", value, pkID)
+	return err
+}
+
+func setFolderRoomSynced(pkID int64) error {
+	_, err := db.Exec("UPDATE folderRooms SET synced=1 WHERE pk_id=?", pkID)
+	return err
+}
+
+func deleteFolderRooms(parentRoomID string) error {
+	_, err := db.Exec("DELETE FROM folderRooms WHERE parentRoomID=?", parentRoomID)
+	return err
+}
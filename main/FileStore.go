@@ -3,24 +3,26 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
 )
 
-//FileStore required by the bridgeAPI
+//FileStore persists the sync token, so the bot continues where it stopped after a restart
 type FileStore struct {
 	path string
 
-	FilterID  string                   `json:"filter_id"`
-	NextBatch string                   `json:"next_batch"`
-	Rooms     map[string]*mautrix.Room `json:"-"`
+	FilterID  string                      `json:"filter_id"`
+	NextBatch string                      `json:"next_batch"`
+	Rooms     map[id.RoomID]*mautrix.Room `json:"-"`
 }
 
 //NewFileStore creates a new filestore
 func NewFileStore(path string) *FileStore {
 	return &FileStore{
 		path:  path,
-		Rooms: make(map[string]*mautrix.Room),
+		Rooms: make(map[id.RoomID]*mautrix.Room),
 	}
 }
 
@@ -34,9 +36,12 @@ func (fs *FileStore) Save() error {
 	return err
 }
 
-//Load loads the store
+//Load loads the store. A missing file means the bot never synced
 func (fs *FileStore) Load() error {
 	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -45,33 +50,35 @@ func (fs *FileStore) Load() error {
 }
 
 //SaveFilterID sets filterID and saves
-func (fs *FileStore) SaveFilterID(_, filterID string) {
+func (fs *FileStore) SaveFilterID(_ id.UserID, filterID string) {
 	fs.FilterID = filterID
 	fs.Save()
 }
 
 //LoadFilterID loadsFilterID
-func (fs *FileStore) LoadFilterID(_ string) string {
+func (fs *FileStore) LoadFilterID(_ id.UserID) string {
 	return fs.FilterID
 }
 
 //SaveNextBatch saves Next batch
-func (fs *FileStore) SaveNextBatch(_, nextBatchToken string) {
+func (fs *FileStore) SaveNextBatch(_ id.UserID, nextBatchToken string) {
 	fs.NextBatch = nextBatchToken
-	fs.Save()
+	if err := fs.Save(); err != nil {
+		WriteLog(logError, "#116 saving sync token: "+err.Error())
+	}
 }
 
 //LoadNextBatch loads  next batch
-func (fs *FileStore) LoadNextBatch(_ string) string {
+func (fs *FileStore) LoadNextBatch(_ id.UserID) string {
 	return fs.NextBatch
 }
 
 //SaveRoom saves room
 func (fs *FileStore) SaveRoom(room *mautrix.Room) {
-	fs.Rooms[string(room.ID)] = room
+	fs.Rooms[room.ID] = room
 }
 
 //LoadRoom loads room
-func (fs *FileStore) LoadRoom(roomID string) *mautrix.Room {
+func (fs *FileStore) LoadRoom(roomID id.RoomID) *mautrix.Room {
 	return fs.Rooms[roomID]
 }
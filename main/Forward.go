@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+	"gopkg.in/gomail.v2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	forwardInline = "inline"
+	forwardAttach = "attach"
+)
+
+//forwardedFile is an attachment of a forwarded email
+type forwardedFile struct {
+	name, contentType string
+	//contentID is set for inline images, the html body references them with cid:
+	contentID string
+	data      []byte
+}
+
+//fetchRawMail downloads a bridged email from the imap server again
+func fetchRawMail(roomID string, ref *mailRef) ([]byte, error) {
+	account, err := getIMAPAccount(roomID)
+	if err != nil {
+		return nil, err
+	}
+	mClient, err := loginMail(account)
+	if err != nil {
+		return nil, err
+	}
+	defer mClient.Logout()
+
+	mbox, err := mClient.Select(ref.mailbox, true)
+	if err != nil {
+		return nil, err
+	}
+	if mbox.UidValidity != ref.uidValidity {
+		return nil, errors.New("the mailbox " + ref.mailbox + " has changed, the email can't be found anymore")
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(ref.uid)
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- mClient.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages)
+	}()
+
+	var raw []byte
+	for msg := range messages {
+		if r := msg.GetBody(section); r != nil {
+			raw, err = ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errors.New("the email doesn't exist anymore")
+	}
+	return raw, nil
+}
+
+func formatAddresses(addresses []*mail.Address) string {
+	list := make([]string, len(addresses))
+	for i, address := range addresses {
+		list[i] = address.String()
+	}
+	return strings.Join(list, ", ")
+}
+
+//buildForward creates an email forwarding raw to the given receivers.
+//'inline' quotes the original body and keeps its attachments, 'attach' attaches the whole email as .eml file
+func buildForward(raw []byte, mode string, account *smtpAccount, recipients []*netmail.Address) (*gomail.Message, string, error) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", err
+	}
+	header := mr.Header
+	subject, _ := header.Subject()
+	from, _ := header.AddressList("From")
+	to, _ := header.AddressList("To")
+	date, _ := header.Date()
+
+	fwdSubject := subject
+	if !strings.HasPrefix(strings.ToLower(subject), "fwd:") {
+		fwdSubject = "Fwd: " + subject
+	}
+	m := gomail.NewMessage()
+	m.SetHeader("From", account.username)
+	toHeader := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		toHeader[i] = m.FormatAddress(recipient.Address, recipient.Name)
+	}
+	m.SetHeader("To", toHeader...)
+	m.SetHeader("Subject", fwdSubject)
+
+	if mode == forwardAttach {
+		m.SetBody("text/plain", "The forwarded email \""+subject+"\" is attached.")
+		name := strings.NewReplacer("/", "_", "\\", "_").Replace(subject)
+		if len(strings.Trim(name, " ")) == 0 {
+			name = "email"
+		}
+		//gomail encodes attachments with base64, which message/rfc822 doesn't allow. Clients open .eml files anyway
+		attachBytes(m, name+".eml", mime.FormatMediaType("application/octet-stream", map[string]string{"name": name + ".eml"}), raw)
+		return m, fwdSubject, nil
+	}
+
+	htmlBody, plainBody := "", ""
+	var files []forwardedFile
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		b, err := ioutil.ReadAll(p.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			{
+				contentType, _, _ := h.ContentType()
+				if contentType == "text/html" && len(htmlBody) == 0 {
+					htmlBody = string(b)
+				} else if contentType == "text/plain" && len(plainBody) == 0 {
+					plainBody = string(b)
+				} else if !strings.HasPrefix(contentType, "text/") {
+					//inline images and the like
+					files = append(files, forwardedFile{"inline" + mimeExtension(contentType), contentType, h.Get("Content-Id"), b})
+				}
+			}
+		case *mail.AttachmentHeader:
+			{
+				name, _ := h.Filename()
+				contentType, _, _ := h.ContentType()
+				if len(name) == 0 {
+					name = "attachment" + mimeExtension(contentType)
+				}
+				files = append(files, forwardedFile{name, contentType, h.Get("Content-Id"), b})
+			}
+		}
+	}
+
+	forwardHeaders := []string{
+		"---------- Forwarded message ----------",
+		"From: " + formatAddresses(from),
+	}
+	if !date.IsZero() {
+		forwardHeaders = append(forwardHeaders, "Date: "+date.Format(time.RFC1123Z))
+	}
+	forwardHeaders = append(forwardHeaders, "Subject: "+subject, "To: "+formatAddresses(to))
+	if len(plainBody) == 0 {
+		plainBody = htmlToText(sanitizeHTML(htmlBody))
+	}
+	m.SetBody("text/plain", strings.Join(forwardHeaders, "\r\n")+"\r\n\r\n"+plainBody)
+	if len(htmlBody) > 0 {
+		escaped := make([]string, len(forwardHeaders))
+		for i, line := range forwardHeaders {
+			escaped[i] = html.EscapeString(line)
+		}
+		m.AddAlternative("text/html", "<div>"+strings.Join(escaped, "<br>")+"</div><br><div>"+sanitizeHTML(htmlBody)+"</div>")
+	}
+	for _, file := range files {
+		contentType := mime.FormatMediaType(file.contentType, map[string]string{"name": file.name})
+		if len(contentType) == 0 {
+			contentType = "application/octet-stream"
+		}
+		if len(file.contentID) > 0 {
+			embedBytes(m, file.name, contentType, file.contentID, file.data)
+		} else {
+			attachBytes(m, file.name, contentType, file.data)
+		}
+	}
+	return m, fwdSubject, nil
+}
+
+func mimeExtension(contentType string) string {
+	if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
+
+//attachBytes attaches a file which isn't saved on the disk
+func attachBytes(m *gomail.Message, name, contentType string, data []byte) {
+	m.Attach(name, gomail.SetHeader(map[string][]string{"Content-Type": {contentType}}), gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}))
+}
+
+//embedBytes adds an inline file which the html body references by its Content-ID
+func embedBytes(m *gomail.Message, name, contentType, contentID string, data []byte) {
+	m.Embed(name, gomail.SetHeader(map[string][]string{"Content-Type": {contentType}, "Content-ID": {contentID}}), gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}))
+}
+
+//handleForwardCommand forwards the bridged email the message replies to.
+//'!forward <email(s)> [inline/attach]'. It's run in a goroutine, fetching the email mustn't block the sync
+func handleForwardCommand(roomID id.RoomID, replyTo id.EventID, message string, client *mautrix.Client) {
+	args := strings.Fields(message)
+	mode := forwardInline
+	if len(args) > 1 && (args[len(args)-1] == forwardInline || args[len(args)-1] == forwardAttach) {
+		mode = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+	if len(replyTo) == 0 || len(args) == 0 {
+		client.SendText(roomID, "Reply to a bridged email with '"+commandPrefix()+"forward <email(s)> [inline/attach]' to forward it")
+		return
+	}
+	recipients, errs := parseRecipients(roomID.String(), strings.Join(args, " "))
+	if len(errs) > 0 {
+		client.SendText(roomID, invalidRecipientsMessage(errs))
+		return
+	}
+
+	ref, err := getMailEvent(roomID.String(), replyTo.String())
+	if err != nil {
+		client.SendText(roomID, "This message isn't a bridged email. Reply to an email to forward it")
+		return
+	}
+	account, err := getSMTPAccount(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #52")
+		return
+	}
+	raw, err := fetchRawMail(roomID.String(), ref)
+	if err != nil {
+		WriteLog(logError, "#96 fetchRawMail: "+err.Error())
+		client.SendText(roomID, "Couldn't fetch the email: "+err.Error())
+		return
+	}
+
+	m, subject, err := buildForward(raw, mode, account, recipients)
+	if err != nil {
+		WriteLog(logError, "#97 buildForward: "+err.Error())
+		client.SendText(roomID, "Couldn't read the email: "+err.Error())
+		return
+	}
+	receivers := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		receivers[i] = recipient.Address
+	}
+	outboxID, err := queueMail(roomID.String(), account, m, receivers, subject, time.Now().Unix())
+	if err != nil {
+		WriteLog(critical, "#46 queueMail: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #46\r\n"+err.Error())
+		return
+	}
+	client.SendText(roomID, "Forwarding...")
+	go deliverOutboxMail(outboxID)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"maunium.net/go/mautrix/event"
+)
+
+//tags allowed in the html part of an email. Based on the tags Matrix clients may send
+var allowedTags = map[string]bool{
+	"font": true, "del": true, "s": true, "strike": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "p": true, "a": true, "ul": true, "ol": true, "sup": true, "sub": true, "li": true, "b": true, "i": true,
+	"u": true, "strong": true, "em": true, "code": true, "hr": true, "br": true, "div": true, "table": true, "thead": true,
+	"tbody": true, "tr": true, "th": true, "td": true, "caption": true, "pre": true, "span": true, "details": true, "summary": true,
+}
+
+//tags which get removed including their content. mx-reply contains the quoted message of a Matrix reply
+var droppedTags = map[string]bool{
+	"mx-reply": true, "script": true, "style": true, "head": true, "title": true,
+}
+
+var voidTags = map[string]bool{
+	"br": true, "hr": true, "img": true,
+}
+
+var colorRegex = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+var whitespaceRegex = regexp.MustCompile(`[ \t\r\n]+`)
+
+var blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+
+//textToHTML escapes plain text and keeps its line breaks
+func textToHTML(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
+
+func getAttribute(token nethtml.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+//sanitizeAttributes returns the attributes of a tag which are safe to use in an email
+func sanitizeAttributes(token nethtml.Token) string {
+	attributes := ""
+	switch token.Data {
+	case "a":
+		{
+			href := getAttribute(token, "href")
+			lower := strings.ToLower(href)
+			if strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "mailto:") {
+				attributes += ` href="` + html.EscapeString(href) + `"`
+			}
+		}
+	case "font", "span":
+		{
+			//Matrix clients use data-mx-color, email clients understand css
+			var styles []string
+			color := getAttribute(token, "data-mx-color")
+			if len(color) == 0 {
+				color = getAttribute(token, "color")
+			}
+			if colorRegex.MatchString(color) {
+				styles = append(styles, "color: "+color)
+			}
+			if bgColor := getAttribute(token, "data-mx-bg-color"); colorRegex.MatchString(bgColor) {
+				styles = append(styles, "background-color: "+bgColor)
+			}
+			if len(styles) > 0 {
+				attributes += ` style="` + strings.Join(styles, "; ") + `"`
+			}
+		}
+	case "code":
+		{
+			if class := getAttribute(token, "class"); strings.HasPrefix(class, "language-") && !strings.ContainsAny(class, `"<> `) {
+				attributes += ` class="` + class + `"`
+			}
+		}
+	case "ol":
+		{
+			if start, err := strconv.Atoi(getAttribute(token, "start")); err == nil {
+				attributes += ` start="` + strconv.Itoa(start) + `"`
+			}
+		}
+	}
+	return attributes
+}
+
+//sanitizeHTML removes all tags and attributes from a Matrix message which don't belong into an email.
+//Images get replaced by their alt text, since mxc URLs can't be loaded by email clients
+func sanitizeHTML(input string) string {
+	tokenizer := nethtml.NewTokenizer(strings.NewReader(input))
+	var sb strings.Builder
+	//depth inside of dropped tags
+	skip := 0
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case nethtml.ErrorToken:
+			return sb.String()
+		case nethtml.TextToken:
+			if skip == 0 {
+				sb.WriteString(html.EscapeString(string(tokenizer.Text())))
+			}
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			{
+				token := tokenizer.Token()
+				if droppedTags[token.Data] {
+					if tokenType == nethtml.StartTagToken {
+						skip++
+					}
+					continue
+				}
+				if skip > 0 {
+					continue
+				}
+				if token.Data == "img" {
+					sb.WriteString(html.EscapeString(getAttribute(token, "alt")))
+					continue
+				}
+				if allowedTags[token.Data] {
+					sb.WriteString("<" + token.Data + sanitizeAttributes(token) + ">")
+				}
+			}
+		case nethtml.EndTagToken:
+			{
+				token := tokenizer.Token()
+				if droppedTags[token.Data] {
+					if skip > 0 {
+						skip--
+					}
+					continue
+				}
+				if skip == 0 && allowedTags[token.Data] && !voidTags[token.Data] {
+					sb.WriteString("</" + token.Data + ">")
+				}
+			}
+		}
+	}
+}
+
+//textBuilder collects the plain text of an html document
+type textBuilder struct {
+	strings.Builder
+}
+
+func (b *textBuilder) atLineStart() bool {
+	return b.Len() == 0 || strings.HasSuffix(b.String(), "\n")
+}
+
+func (b *textBuilder) ensureNewline() {
+	if !b.atLineStart() {
+		b.WriteString("\n")
+	}
+}
+
+func (b *textBuilder) ensureBlankLine() {
+	b.ensureNewline()
+	if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n\n") {
+		b.WriteString("\n")
+	}
+}
+
+//writeBlock writes text which has to start on its own line. Each line gets the given prefix
+func (b *textBuilder) writeBlock(text, firstPrefix, prefix string) {
+	text = strings.Trim(text, "\n")
+	if len(text) == 0 {
+		return
+	}
+	b.ensureNewline()
+	for i, line := range strings.Split(text, "\n") {
+		if i == 0 {
+			b.WriteString(firstPrefix + line + "\n")
+		} else {
+			b.WriteString(strings.TrimRight(prefix+line, " ") + "\n")
+		}
+	}
+}
+
+//htmlToText converts the html part of an email into its plain text alternative.
+//Lists, quotes and code blocks keep their layout and links are written behind their text
+func htmlToText(input string) string {
+	context := &nethtml.Node{Type: nethtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := nethtml.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		WriteLog(logError, "#93 parsing html: "+err.Error())
+		return input
+	}
+	var b textBuilder
+	for _, node := range nodes {
+		writeNodeText(&b, node, false)
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text := blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.ReplaceAll(strings.Trim(text, "\n"), "\n", "\r\n")
+}
+
+func nodeAttribute(n *nethtml.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func writeChildrenText(b *textBuilder, n *nethtml.Node, pre bool) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		writeNodeText(b, child, pre)
+	}
+}
+
+//childrenText returns the text of the children of a node, eg. to prefix its lines
+func childrenText(n *nethtml.Node, pre bool) string {
+	var b textBuilder
+	writeChildrenText(&b, n, pre)
+	return b.String()
+}
+
+func writeNodeText(b *textBuilder, n *nethtml.Node, pre bool) {
+	switch n.Type {
+	case nethtml.TextNode:
+		{
+			if pre {
+				b.WriteString(n.Data)
+				return
+			}
+			text := whitespaceRegex.ReplaceAllString(n.Data, " ")
+			if b.atLineStart() {
+				text = strings.TrimLeft(text, " ")
+			}
+			b.WriteString(text)
+			return
+		}
+	case nethtml.ElementNode:
+	default:
+		{
+			writeChildrenText(b, n, pre)
+			return
+		}
+	}
+
+	switch n.Data {
+	case "mx-reply", "script", "style", "head", "title":
+		return
+	case "br":
+		b.WriteString("\n")
+	case "hr":
+		{
+			b.ensureNewline()
+			b.WriteString("----------\n")
+		}
+	case "img":
+		b.WriteString(nodeAttribute(n, "alt"))
+	case "a":
+		{
+			text := childrenText(n, pre)
+			href := nodeAttribute(n, "href")
+			b.WriteString(text)
+			//mentions (matrix.to links) only show their name
+			if len(href) > 0 && href != text && href != "mailto:"+text && !strings.HasPrefix(href, "https://matrix.to/") {
+				b.WriteString(" <" + href + ">")
+			}
+		}
+	case "blockquote":
+		{
+			b.ensureBlankLine()
+			b.writeBlock(childrenText(n, pre), "> ", "> ")
+			b.ensureBlankLine()
+		}
+	case "pre":
+		{
+			b.ensureBlankLine()
+			b.writeBlock(childrenText(n, true), "", "")
+			b.ensureBlankLine()
+		}
+	case "ul", "ol":
+		{
+			b.ensureNewline()
+			number := 1
+			if start, err := strconv.Atoi(nodeAttribute(n, "start")); err == nil {
+				number = start
+			}
+			for child := n.FirstChild; child != nil; child = child.NextSibling {
+				if child.Type != nethtml.ElementNode || child.Data != "li" {
+					continue
+				}
+				marker := "- "
+				if n.Data == "ol" {
+					marker = strconv.Itoa(number) + ". "
+					number++
+				}
+				b.writeBlock(childrenText(child, pre), marker, strings.Repeat(" ", len(marker)))
+			}
+		}
+	case "p", "h1", "h2", "h3", "h4", "h5", "h6", "table":
+		{
+			b.ensureBlankLine()
+			writeChildrenText(b, n, pre)
+			b.ensureBlankLine()
+		}
+	case "div", "li", "tr", "details", "summary", "caption":
+		{
+			b.ensureNewline()
+			writeChildrenText(b, n, pre)
+			b.ensureNewline()
+		}
+	case "td", "th":
+		{
+			writeChildrenText(b, n, pre)
+			b.WriteString("\t")
+		}
+	default:
+		writeChildrenText(b, n, pre)
+	}
+}
+
+//formattedBody returns the html body of a Matrix message or an empty string if it has none
+func formattedBody(content *event.MessageEventContent) string {
+	if content == nil || content.Format != event.FormatHTML {
+		return ""
+	}
+	return content.FormattedBody
+}
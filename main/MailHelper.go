@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"io/ioutil"
 	"log"
 	"maunium.net/go/mautrix/id"
+	"mime"
 	"strings"
 	"time"
 
@@ -19,35 +23,52 @@ import (
 	"maunium.net/go/mautrix"
 )
 
-func loginMail(host, username, password string, ignoreSSL bool) (*client.Client, error) {
-	ailClient, err := client.DialTLS(host, &tls.Config{InsecureSkipVerify: ignoreSSL})
+//imap connection security. Empty means implicit TLS
+var imapSecurityOptions = []string{securityTLS, securitySTARTTLS}
+
+func loginMail(account *imapAccountount) (*client.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: account.ignoreSSL}
+	var ailClient *client.Client
+	var err error
+	if account.security == securitySTARTTLS {
+		ailClient, err = client.Dial(account.host)
+		if err == nil {
+			if err = ailClient.StartTLS(tlsConfig); err != nil {
+				ailClient.Terminate()
+			}
+		}
+	} else {
+		ailClient, err = client.DialTLS(account.host, tlsConfig)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	if err := ailClient.Login(username, password); err != nil {
+	if err := ailClient.Login(account.username, account.password); err != nil {
+		ailClient.Logout()
 		return nil, err
 	}
 
 	return ailClient, nil
 }
 
-func getMails(mClient *client.Client, mBox string, messages chan *imap.Message) (*imap.BodySectionName, int) {
+//getMails fetches the latest mails of a mailbox. Returns the UIDVALIDITY of the mailbox as well, which is needed to find the mails again by their UID
+func getMails(mClient *client.Client, mBox string, messages chan *imap.Message) (*imap.BodySectionName, uint32, int) {
 	mbox, err := mClient.Select(mBox, false)
 	if err != nil {
 		WriteLog(logError, "#12 couldnt get INBOX "+err.Error())
-		return nil, 0
+		return nil, 0, 0
 	}
 
 	if mbox == nil {
 		WriteLog(logError, "#23 getMails mbox is nli")
-		return nil, 0
+		return nil, 0, 0
 	}
 
 	if mbox.Messages == 0 {
 		WriteLog(logError, "#13 getMails no messages in inbox ")
-		return nil, 1
+		return nil, 0, 1
 	}
 
 	seqSet := new(imap.SeqSet)
@@ -60,20 +81,31 @@ func getMails(mClient *client.Client, mBox string, messages chan *imap.Message)
 	}
 
 	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchUid, section.FetchItem()}
 	go func() {
 		if err := mClient.Fetch(seqSet, items, messages); err != nil {
 			WriteLog(critical, "#14 couldnt fetch messages: "+err.Error())
 		}
 	}()
-	return section, -1
+	return section, mbox.UidValidity, -1
 }
 
 type email struct {
 	body, from, to, subject, attachment string
-	sendermails                         []string
+	sendermails, sendernames            []string
 	date                                time.Time
 	htmlFormat                          bool
+	//report is set if the email is a bounce
+	report *deliveryReport
+	//receipt is set if the email is a read receipt
+	receipt *dispositionNotification
+	//receiptTo is the address the sender wants a read receipt sent to
+	receiptTo string
+	//face is the picture of the sender from the Face header (a base64 encoded PNG)
+	face []byte
+	//messageID, inReplyTo and references (all in <>) link the email to its thread
+	messageID, inReplyTo string
+	references           []string
 }
 
 func getMailboxes(emailClient *client.Client) (string, error) {
@@ -95,6 +127,76 @@ func getMailboxes(emailClient *client.Client) (string, error) {
 	return mboxes, nil
 }
 
+//sentAttr is the SPECIAL-USE attribute (RFC 6154) of the sent folder
+const sentAttr = "\\Sent"
+
+//used if the server doesn't support SPECIAL-USE
+var sentFolderNames = []string{"Sent", "Sent Items", "Sent Messages", "INBOX.Sent"}
+
+func getSentFolder(emailClient *client.Client) (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 20)
+	done := make(chan error, 1)
+	go func() {
+		done <- emailClient.List("", "*", mailboxes)
+	}()
+
+	sentFolder, fallback := "", ""
+	for m := range mailboxes {
+		for _, attr := range m.Attributes {
+			if strings.EqualFold(attr, sentAttr) && len(sentFolder) == 0 {
+				sentFolder = m.Name
+			}
+		}
+		for _, name := range sentFolderNames {
+			if strings.EqualFold(m.Name, name) && len(fallback) == 0 {
+				fallback = m.Name
+			}
+		}
+	}
+
+	if err := <-done; err != nil {
+		return "", err
+	}
+	if len(sentFolder) == 0 {
+		sentFolder = fallback
+	}
+	if len(sentFolder) == 0 {
+		return "", errors.New("no sent folder found. Use " + commandPrefix() + "setsentfolder <mailbox> to set one")
+	}
+	return sentFolder, nil
+}
+
+//saveSentMail appends a sent email to the sent folder of the rooms IMAP account
+func saveSentMail(roomID string, msg io.WriterTo) error {
+	account, err := getIMAPAccount(roomID)
+	if err != nil {
+		return err
+	}
+
+	mClient, err := loginMail(account)
+	if err != nil {
+		return err
+	}
+	defer mClient.Logout()
+
+	sentFolder, err := getSentFolderOverride(roomID)
+	if err != nil {
+		return err
+	}
+	if len(sentFolder) == 0 {
+		sentFolder, err = getSentFolder(mClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	return mClient.Append(sentFolder, []string{imap.SeenFlag}, time.Now(), &buf)
+}
+
 func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID string) *email {
 	if msg == nil {
 		fmt.Println("msg is nil")
@@ -131,6 +233,7 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 				list[i] = sender.Address
 			}
 			jmail.sendermails = append(jmail.sendermails, sender.Address)
+			jmail.sendernames = append(jmail.sendernames, sender.Name)
 		}
 		jmail.from = strings.Join(list, ",")
 	}
@@ -149,6 +252,29 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 		log.Println("Subject:", subject)
 		jmail.subject = subject
 	}
+	if contentType, params, err := header.ContentType(); err == nil && contentType == "multipart/report" {
+		switch strings.ToLower(params["report-type"]) {
+		case "delivery-status":
+			jmail.report = &deliveryReport{}
+		case "disposition-notification":
+			jmail.receipt = &dispositionNotification{}
+		}
+	}
+	jmail.receiptTo = strings.Trim(header.Get("Disposition-Notification-To"), " ")
+	if messageID, err := header.MessageID(); err == nil && len(messageID) > 0 {
+		jmail.messageID = "<" + messageID + ">"
+	}
+	if inReplyTo, err := header.MsgIDList("In-Reply-To"); err == nil && len(inReplyTo) > 0 {
+		jmail.inReplyTo = "<" + inReplyTo[0] + ">"
+	}
+	if references, err := header.MsgIDList("References"); err == nil {
+		for _, reference := range references {
+			jmail.references = append(jmail.references, "<"+reference+">")
+		}
+	}
+	if face := header.Get("Face"); len(face) > 0 {
+		jmail.face, _ = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(face), ""))
+	}
 
 	htmlBody, plainBody := "", ""
 	_ = htmlBody
@@ -162,6 +288,14 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 			break
 		}
 
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if jmail.report != nil && parseReportPart(jmail.report, contentType, p.Body) {
+			continue
+		}
+		if jmail.receipt != nil && parseDispositionPart(jmail.receipt, contentType, p.Body) {
+			continue
+		}
+
 		switch h := p.Header.(type) {
 		case *mail.InlineHeader:
 			b, _ := ioutil.ReadAll(p.Body)
@@ -223,7 +357,7 @@ func viewMailbox(roomID string, client *mautrix.Client) {
 		}
 		client.SendText(id.RoomID(roomID), "The current mailbox for this room is: "+mailbox)
 	} else {
-		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use "+commandPrefix()+"setup or "+commandPrefix()+"login for more informations")
 	}
 }
 
@@ -241,9 +375,32 @@ func viewMailboxes(roomID string, client *mautrix.Client) {
 			client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #47")
 			return
 		}
-		client.SendText(id.RoomID(roomID), "Your mailboxes:\r\n"+mailboxes+"\r\nUse !setmailbox <mailbox> to change your mailbox")
+		client.SendText(id.RoomID(roomID), "Your mailboxes:\r\n"+mailboxes+"\r\nUse "+commandPrefix()+"setmailbox <mailbox> to change your mailbox")
+	} else {
+		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use "+commandPrefix()+"setup or "+commandPrefix()+"login for more informations")
+	}
+}
+
+func viewSentFolder(roomID string, client *mautrix.Client) {
+	imapAccID, _, erro := getRoomAccounts(roomID)
+	if erro != nil {
+		WriteLog(critical, "#48 getRoomAccounts: "+erro.Error())
+		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #48")
+		return
+	}
+	if imapAccID != -1 {
+		sentFolder, err := getSentFolderOverride(roomID)
+		if err != nil {
+			WriteLog(critical, "#67 getSentFolderOverride: "+err.Error())
+			client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #67")
+			return
+		}
+		if len(sentFolder) == 0 {
+			sentFolder = "auto (SPECIAL-USE \\Sent)"
+		}
+		client.SendText(id.RoomID(roomID), "Sent emails are saved to: "+sentFolder)
 	} else {
-		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use "+commandPrefix()+"setup or "+commandPrefix()+"login for more informations")
 	}
 }
 
@@ -267,6 +424,6 @@ func viewBlocklist(roomID string, client *mautrix.Client) {
 		}
 		client.SendText(id.RoomID(roomID), msg)
 	} else {
-		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use "+commandPrefix()+"setup or "+commandPrefix()+"login for more informations")
 	}
 }
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -13,9 +13,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/gomarkdown/markdown"
-	"gopkg.in/gomail.v2"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
@@ -24,7 +24,7 @@ import (
 	"maunium.net/go/mautrix"
 )
 
-const version = 7
+const version = 22
 
 var db *sql.DB
 var matrixClient *mautrix.Client
@@ -47,6 +47,14 @@ func initCfg() bool {
 	viper.AddConfigPath(dirPrefix)
 	viper.SetConfigName("cfg")
 
+	//defaults of options added later, so existing configs get them too
+	viper.SetDefault("commandPrefix", "!")
+	viper.SetDefault("admins", []string{})
+	viper.SetDefault("allowed_users", []string{})
+	viper.SetDefault("managePowerLevel", 50)
+	viper.SetDefault("unbridgeGracePeriod", 60)
+	viper.SetDefault("refuseUnsupportedEncryption", true)
+
 	err := viper.ReadInConfig()
 	if err != nil {
 		fmt.Println("config not found. creating new one")
@@ -57,12 +65,20 @@ func initCfg() bool {
 		}
 
 		viper.SetDefault("matrixServer", "matrix.org")
+		viper.SetDefault("matrixaccesstoken", "")
 		viper.SetDefault("matrixuserpassword", "AverySecretPassword21!")
 		viper.SetDefault("matrixuserid", "@m:matrix.org")
 		viper.SetDefault("defaultmailCheckInterval", 30)
 		viper.SetDefault("markdownEnabledByDefault", true)
 		viper.SetDefault("htmlDefault", false)
 		viper.SetDefault("allowed_servers", [1]string{"YourMatrixServerDomain.com"})
+		viper.SetDefault("sendmailPath", "")
+		viper.SetDefault("lmtpSocket", "")
+		viper.SetDefault("appservice", false)
+		viper.SetDefault("appserviceURL", "http://localhost:8093")
+		viper.SetDefault("appserviceListen", "127.0.0.1:8093")
+		viper.SetDefault("asToken", "")
+		viper.SetDefault("hsToken", "")
 		viper.WriteConfigAs(dirPrefix + "cfg.json")
 		return true
 	}
@@ -90,20 +106,89 @@ func loginMatrix() {
 	if err != nil {
 		panic(err)
 	}
-	_, err = client.Login(&mautrix.ReqLogin{
-		Type:             "m.login.password",
-		Identifier:       mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: viper.GetString("matrixuserid")},
-		Password:         viper.GetString("matrixuserpassword"),
-		StoreCredentials: true,
-	})
+	//reuse the device, the encryption keys belong to it
+	deviceID, err := getBotSetting("deviceID")
 	if err != nil {
-		panic(err)
+		WriteLog(logError, "#113 getBotSetting: "+err.Error())
+	}
+	if !loginWithToken(client, id.DeviceID(deviceID)) {
+		err = loginWithPassword(client, id.DeviceID(deviceID))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if client.DeviceID.String() != deviceID {
+		err = setBotSetting("deviceID", client.DeviceID.String())
+		if err != nil {
+			WriteLog(logError, "#114 setBotSetting: "+err.Error())
+		}
 	}
 	fmt.Println("Login successful")
+	store := NewFileStore(dirPrefix + "syncstore.json")
+	if err := store.Load(); err != nil {
+		WriteLog(logError, "#117 loading sync store: "+err.Error())
+	}
+	client.Store = store
 	matrixClient = client
 	go startMatrixSync(client)
 }
 
+//loginWithToken uses the access token from the config or the one of the last password login.
+//Returns false if there is none or the server doesn't accept it
+func loginWithToken(client *mautrix.Client, deviceID id.DeviceID) bool {
+	storedToken, err := getBotSetting("accessToken")
+	if err != nil {
+		WriteLog(logError, "#113 getBotSetting: "+err.Error())
+	}
+	for _, token := range []string{viper.GetString("matrixaccesstoken"), storedToken} {
+		if len(token) == 0 {
+			continue
+		}
+		client.AccessToken = token
+		resp, err := client.Whoami()
+		if err != nil {
+			WriteLog(warn, "Access token not accepted: "+err.Error())
+			continue
+		}
+		if userID := viper.GetString("matrixuserid"); len(userID) > 0 && resp.UserID.String() != userID {
+			WriteLog(warn, "Access token belongs to "+resp.UserID.String()+" instead of "+userID)
+			continue
+		}
+		client.UserID = resp.UserID
+		client.DeviceID = resp.DeviceID
+		if len(client.DeviceID) == 0 {
+			//older servers don't return the device
+			client.DeviceID = deviceID
+		}
+		return true
+	}
+	client.AccessToken = ""
+	return false
+}
+
+//loginWithPassword logs in with matrixuserpassword and stores the new access token, so the next start can use it
+func loginWithPassword(client *mautrix.Client, deviceID id.DeviceID) error {
+	if len(viper.GetString("matrixuserpassword")) == 0 {
+		return errors.New("no valid matrixaccesstoken and no matrixuserpassword set")
+	}
+	_, err := client.Login(&mautrix.ReqLogin{
+		Type:                     "m.login.password",
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: viper.GetString("matrixuserid")},
+		Password:                 viper.GetString("matrixuserpassword"),
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: "Matrix-EmailBridge",
+		StoreCredentials:         true,
+	})
+	if err != nil {
+		return err
+	}
+	err = setBotSetting("accessToken", client.AccessToken)
+	if err != nil {
+		WriteLog(logError, "#114 setBotSetting: "+err.Error())
+	}
+	return nil
+}
+
 func getHostFromMatrixID(matrixID string) (host string, err int) {
 	if strings.Contains(matrixID, ":") {
 		splt := strings.Split(matrixID, ":")
@@ -126,6 +211,9 @@ func contains(a []string, x string) bool {
 
 func logOut(client *mautrix.Client, roomID string, leave bool) error {
 	stopMailChecker(roomID)
+	if spaceID, err := getSpaceID(roomID); err == nil && len(spaceID) > 0 {
+		removeAccountSpace(roomID, spaceID)
+	}
 	deleteRoomAndEmailByRoomID(roomID)
 	if leave {
 		_, err := client.LeaveRoom(id.RoomID(roomID))
@@ -137,40 +225,94 @@ func logOut(client *mautrix.Client, roomID string, leave bool) error {
 	return nil
 }
 
+//handledEventRetention is how long the ids of handled events are kept. Older events are ignored
+const handledEventRetention = 30 * 24 * time.Hour
+
+//firstSync is the time (unix ms) the bot synced the first time. Events sent before are ignored
+var firstSync int64
+
+func initEventFilter() {
+	value, err := getBotSetting("firstSync")
+	if err != nil {
+		WriteLog(logError, "#113 getBotSetting: "+err.Error())
+	}
+	firstSync, _ = strconv.ParseInt(value, 10, 64)
+	if firstSync == 0 {
+		firstSync = time.Now().UnixNano() / int64(time.Millisecond)
+		err = setBotSetting("firstSync", strconv.FormatInt(firstSync, 10))
+		if err != nil {
+			WriteLog(logError, "#114 setBotSetting: "+err.Error())
+		}
+	}
+	err = deleteHandledEvents(time.Now().Add(-handledEventRetention).UnixNano() / int64(time.Millisecond))
+	if err != nil {
+		WriteLog(logError, "#118 deleteHandledEvents: "+err.Error())
+	}
+}
+
+//isNewEvent returns false if the event was handled already or is too old, eg. when the sync is replayed after a restart.
+//This makes sure no command runs twice
+func isNewEvent(evt *event.Event) bool {
+	if evt.Timestamp < firstSync || time.Since(time.Unix(0, evt.Timestamp*int64(time.Millisecond))) > handledEventRetention {
+		return false
+	}
+	isNew, err := markEventHandled(evt.ID.String(), evt.Timestamp)
+	if err != nil {
+		WriteLog(logError, "#119 markEventHandled: "+err.Error())
+		return false
+	}
+	return isNew
+}
+
 func startMatrixSync(client *mautrix.Client) {
 	fmt.Println(client.UserID)
+	initEventFilter()
+	resumeUnbridgeTimers(client)
 
 	syncer := client.Syncer.(*mautrix.DefaultSyncer)
-	syncer.OnEventType(event.StateJoinRules, func(source mautrix.EventSource, evt *event.Event) {
-		host, err := getHostFromMatrixID(string(evt.Sender))
-		if err == -1 {
-			listcontains := contains(viper.GetStringSlice("allowed_servers"), host)
-			if listcontains {
-				client.JoinRoom(string(evt.RoomID), "", nil)
-				client.SendText(evt.RoomID, "Hey you have invited me to a new room. Enter !login to bridge this room to a Mail account")
-			} else {
-				client.LeaveRoom(evt.RoomID)
-				WriteLog(info, string("Got invalid invite from "+evt.Sender+" reason: senders server not whitelisted! Adjust your config if you want to allow this host using me"))
-				return
-			}
-		} else {
-			WriteLog(critical, "")
+	syncer.OnEventType(event.StateEncryption, func(source mautrix.EventSource, evt *event.Event) {
+		if source&mautrix.EventSourceInvite != 0 {
+			return
+		}
+		wasEncrypted := roomStateStore{}.IsEncrypted(evt.RoomID)
+		trackRoomState(evt)
+		//encryption got enabled in a bridged room
+		if !wasEncrypted && source&mautrix.EventSourceTimeline != 0 {
+			checkRoomEncryption(client, evt.RoomID)
 		}
 	})
 
 	syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
-		if evt.Sender != client.UserID && evt.Content.AsMember().Membership == "leave" {
-			logOut(client, string(evt.RoomID), true)
+		if source&mautrix.EventSourceInvite == 0 {
+			trackRoomState(evt)
+		}
+		handleMembership(client, source, evt)
+	})
+
+	syncer.OnEventType(event.EventRedaction, func(source mautrix.EventSource, evt *event.Event) {
+		if evt.Sender == client.UserID || isGhost(evt.Sender) || !isNewEvent(evt) {
+			return
+		}
+		err := removeDraftLine(string(evt.RoomID), evt.Redacts)
+		if err != nil {
+			WriteLog(critical, "#92 removeDraftLine: "+err.Error())
 		}
 	})
 
-	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
-		if evt.Sender == client.UserID {
+	handleMessage := func(source mautrix.EventSource, evt *event.Event) {
+		//puppets post the bridged emails
+		if evt.Sender == client.UserID || isGhost(evt.Sender) || !isNewEvent(evt) {
 			return
 		}
+		//commands can be sent as replies, eg. !forward
+		evt.Content.AsMessage().RemoveReplyFallback()
 		message := evt.Content.AsMessage().Body
 		roomID := evt.RoomID
 
+		//answers to the setup wizard aren't commands or lines of an email
+		if handleWizardMessage(client, evt) {
+			return
+		}
 		if is, err := isUserWritingEmail(string(roomID)); is && err == nil {
 			writeTemp, err := getWritingTemp(string(roomID))
 			if err != nil {
@@ -179,6 +321,14 @@ func startMatrixSync(client *mautrix.Client) {
 				deleteWritingTemp(string(roomID))
 				return
 			}
+			if relatesTo := evt.Content.AsMessage().RelatesTo; relatesTo != nil && relatesTo.Type == event.RelReplace {
+				err = handleDraftEdit(writeTemp, evt.Content.AsMessage())
+				if err != nil {
+					WriteLog(critical, "#91 handleDraftEdit: "+err.Error())
+					client.SendText(roomID, "Couldn't apply your edit: An server-error occured Errorcode: #91")
+				}
+				return
+			}
 			if len(strings.Trim(writeTemp.subject, " ")) == 0 {
 				if evt.Content.AsMessage().MsgType != event.MsgText {
 					client.SendText(roomID, "You have to send a text for subject!")
@@ -191,604 +341,43 @@ func startMatrixSync(client *mautrix.Client) {
 					deleteWritingTemp(string(roomID))
 					return
 				}
-				client.SendText(roomID, "Now send me the content of the email. One message is one line. If you want to send or cancel enter !send or !cancel")
-			} else {
-				if message == "!send" {
-					account, err := getSMTPAccount(string(roomID))
-					if err != nil {
-						WriteLog(critical, "#52 saveWritingtemp: "+err.Error())
-						client.SendText(roomID, "An server-error occured Errorcode: #52")
-						deleteWritingTemp(string(roomID))
-						return
-					}
-
-					m := gomail.NewMessage()
-					m.SetHeader("From", account.username)
-
-					if strings.Contains(writeTemp.receiver, ",") {
-						recEmails := strings.Split(writeTemp.receiver, ",")
-						m.SetHeader("To", recEmails...)
-					} else {
-						m.SetHeader("To", writeTemp.receiver)
-					}
-
-					m.SetHeader("Subject", writeTemp.subject)
-
-					if writeTemp.markdown {
-						toSendText := string(markdown.ToHTML([]byte(writeTemp.body), nil, nil))
-						toSendText = strings.ReplaceAll(toSendText, "\r\n<h", "<h")
-						toSendText = strings.ReplaceAll(toSendText, "\n\n<h", "<h")
-						toSendText = strings.ReplaceAll(toSendText, ">\n\n", ">")
-						toSendText = strings.ReplaceAll(toSendText, "\r\n", "<br>")
-						m.SetBody("text/html", toSendText)
-
-						plainbody := writeTemp.body
-						plainbody = strings.ReplaceAll(plainbody, "<br>", "\r\n")
-						m.AddAlternative("text/plain", plainbody)
-					} else {
-						m.SetBody("text/plain", writeTemp.body)
-					}
-
-					attachments, err := getAttachments(writeTemp.pkID)
-					if err == nil {
-						for _, i := range attachments {
-							client.SendText(roomID, "Attaching file: "+i)
-							m.Attach(tempDir + i)
-						}
-					} else {
-						client.SendText(roomID, "coulnd't attach files: "+err.Error())
-					}
-
-					d := gomail.NewDialer(account.host, account.port, account.username, account.password)
-					if account.ignoreSSL {
-						d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-					}
-					client.SendText(roomID, "Sending...")
-					if err := d.DialAndSend(m); err != nil {
-						WriteLog(logError, "#46 DialAndSend: "+err.Error())
-						client.SendText(roomID, "An server-error occured Errorcode: #53\r\n"+err.Error())
-						removeSMTPAccount(string(roomID))
-						client.SendText(roomID, "To fix this errer you have to run !setup smtp .... again")
-						deleteWritingTemp(string(roomID))
-						return
-					}
-					client.SendText(roomID, "Message sent successfully")
-					deleteWritingTemp(string(roomID))
-				} else if message == "!cancel" {
-					client.SendText(roomID, "Mail canceled")
+				client.SendText(roomID, "Now send me the content of the email. One message is one line. If you want to send or cancel enter "+commandPrefix()+"send or "+commandPrefix()+"cancel. Use "+commandPrefix()+"send at <time> or "+commandPrefix()+"send in <duration> to send it later. "+commandPrefix()+"preview shows the email and "+commandPrefix()+"help lists the commands for editing it")
+			} else if handleCommand(client, evt, writeTemp) {
+				return
+			} else if evt.Content.AsMessage().MsgType == event.MsgText {
+				err = appendDraftLine(writeTemp, evt.ID, evt.Content.AsMessage())
+				if err != nil {
+					WriteLog(critical, "#54 saveWritingtemp: "+err.Error())
+					client.SendText(roomID, "An server-error occured Errorcode: #54")
 					deleteWritingTemp(string(roomID))
 					return
-				} else if strings.HasPrefix(message, "!rm") && len(strings.Split(message, " ")) > 0 {
-					splitted := strings.Split(message, " ")[1:]
-					var fileName string
-					for _, a := range splitted {
-						fileName += a + " "
-					}
-					fileName = strings.TrimRight(fileName, " ")
-					fileName = strings.TrimLeft(fileName, " ")
-					fmt.Println(fileName)
-					err := deleteAttachment(fileName, writeTemp.pkID)
-					if err != nil {
-						client.SendText(roomID, "Couldn't delete attachment: "+err.Error())
-						return
-					}
-					_ = os.Remove(tempDir + fileName)
-					client.SendText(roomID, "Attachment deleted!")
-
-				} else {
-					if evt.Content.AsMessage().MsgType == event.MsgText {
-						if len(strings.ReplaceAll(writeTemp.body, " ", "")) == 0 {
-							err = saveWritingtemp(string(roomID), "body", message+"\r\n")
-						} else {
-							err = saveWritingtemp(string(roomID), "body", writeTemp.body+message+"\r\n")
-						}
-						if err != nil {
-							WriteLog(critical, "#54 saveWritingtemp: "+err.Error())
-							client.SendText(roomID, "An server-error occured Errorcode: #54")
-							deleteWritingTemp(string(roomID))
-							return
-						}
-					} else if evt.Content.AsMessage().MsgType == event.MsgFile || evt.Content.AsMessage().MsgType == event.MsgImage {
-						if strings.HasPrefix(string(evt.Content.AsMessage().URL), "mxc://") {
-							reader, err := client.Download(id.MustParseContentURI(evt.Content.AsMessage().Body))
-							if err != nil {
-								client.SendText(roomID, "Couldn't download File: "+err.Error())
-							} else {
-								filename := strconv.Itoa(int(time.Now().Unix())) + "_" + evt.Content.AsMessage().Body
-								err := streamToTempFile(reader, filename)
-								if err != nil {
-									client.SendText(roomID, "Couldn't download file: "+err.Error())
-								} else {
-									addEmailAttachment(writeTemp.pkID, filename)
-									client.SendText(roomID, "File "+filename+" attached!")
-								}
-							}
-						}
-					}
-
 				}
+			} else if isMediaMessage(evt.Content.AsMessage()) {
+				go attachMedia(roomID, writeTemp, evt.Content.AsMessage(), client)
 			}
 		} else if err != nil {
 			WriteLog(critical, "#41 deleteWritingTemp: "+err.Error())
 			client.SendText(roomID, "An server-error occured Errorcode: #41")
 			return
-		} else {
-			//commands only available in room not bridged to email
-			if message == "!login" {
-				client.SendText(roomID, "Okay send me the data of your server(at first IMAPs) in the given order, splitted by a comma(,)\r\n!setup imap, host:port, username/email, password, mailbox, ignoreSSL\r\n!setup smtp, host, port, email, password, ignoreSSL\r\n\r\nExample: \r\n!setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n!setup smtp, host.com:587, mail@host.com, w0rdp4ss, false")
-			} else if strings.HasPrefix(message, "!setup") {
-				data := strings.Trim(strings.ReplaceAll(message, "!setup", ""), " ")
-				s := strings.Split(data, ",")
-				if len(s) < 4 || len(s) > 6 {
-					client.SendText(roomID, "Wrong syntax :/\r\nExample: \r\n!setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n"+
-						"!setup smtp, host.com:587, mail@host.com, w0rdp4ss, false")
-				} else {
-					accountType := s[0]
-					if strings.ToLower(accountType) != "imap" && strings.ToLower(accountType) != "smtp" {
-						client.SendText(roomID, "What? you can setup 'imap' and 'smtp', not \""+accountType+"\"")
-						return
-					}
-					host := strings.ReplaceAll(s[1], " ", "")
-					username := strings.ReplaceAll(s[2], " ", "")
-					password := strings.ReplaceAll(s[3], " ", "")
-					ignoreSSlCert := false
-					mailbox := "INBOX"
-					if len(s) >= 5 {
-						mailbox = strings.ReplaceAll(s[4], " ", "")
-					}
-					var err error
-					defaultMailSyncInterval := viper.GetInt("defaultmailCheckInterval")
-					imapAccID, smtpAccID, erro := getRoomAccounts(string(roomID))
-					if erro != nil {
-						client.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #37")
-						WriteLog(critical, "#37 checking getRoomAccounts: "+erro.Error())
-						return
-					}
-					if accountType == "imap" {
-						if len(s) == 6 {
-							ignoreSSlCert, err = strconv.ParseBool(strings.ReplaceAll(s[5], " ", ""))
-							if err != nil {
-								fmt.Println(err.Error())
-								ignoreSSlCert = false
-							}
-						}
-						if imapAccID != -1 {
-							client.SendText(roomID, "IMAP account already existing. Create a new room if you want to use a different account!")
-							return
-						}
-						isInUse, err := isImapAccountAlreadyInUse(username)
-						if err != nil {
-							client.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #03")
-							WriteLog(critical, "#03 checking isImapAccountAlreadyInUse: "+err.Error())
-							return
-						}
-
-						if isInUse {
-							client.SendText(roomID, "This email is already in Use! You cannot use your email twice!")
-							return
-						}
-
-						go func() {
-							if !strings.Contains(host, ":") {
-								host += ":993"
-							}
-
-							mclient, err := loginMail(host, username, password, ignoreSSlCert)
-							if mclient != nil && err == nil {
-								has, er := hasRoom(string(roomID))
-								if er != nil {
-									client.SendText(roomID, "An error occured! contact your admin! Errorcode: #25")
-									WriteLog(critical, "checking imapAcc #25: "+er.Error())
-									return
-								}
-								var newRoomID int64
-								if !has {
-									newRoomID = insertNewRoom(string(roomID), defaultMailSyncInterval)
-									if newRoomID == -1 {
-										client.SendText(roomID, "An error occured! contact your admin! Errorcode: #26")
-										WriteLog(critical, "checking insertNewRoom #26")
-										return
-									}
-								} else {
-									id, err := getRoomPKID(evt.RoomID.String())
-									if err != nil {
-										WriteLog(critical, "checking getRoomPKID #27: "+err.Error())
-										client.SendText(roomID, "An error occured! contact your admin! Errorcode: #27")
-										return
-									}
-									newRoomID = int64(id)
-								}
-								imapID, succes := insertimapAccountount(host, username, password, mailbox, ignoreSSlCert)
-								if !succes {
-									client.SendText(roomID, "sth went wrong. Contact your admin")
-									return
-								}
-								err = saveImapAcc(string(roomID), int(imapID))
-								if err != nil {
-									WriteLog(critical, "saveImapAcc #35 : "+err.Error())
-									client.SendText(roomID, "sth went wrong. Contact you admin! Errorcode: #35")
-									return
-								}
-								client.SendText(roomID, "Bridge created successfully!\r\nYou should delete the message containing your credentials ;)\r\nIMAP:\r\n"+
-									"host: "+host+"\r\n"+
-									"username: "+username+"\r\n"+
-									"mailbox: "+mailbox+"\r\n"+
-									"ignoreSSL: "+strconv.FormatBool(ignoreSSlCert))
-
-								startMailListener(imapAccountount{host, username, password, roomID.String(), mailbox, ignoreSSlCert, int(newRoomID), defaultMailSyncInterval, true})
-								WriteLog(success, "Created new bridge and started maillistener\r\n")
-							} else {
-								client.SendText(roomID, "Error creating bridge! Errorcode: #04\r\nReason: "+err.Error())
-								WriteLog(logError, "#04 creating bridge: "+err.Error())
-							}
-						}()
-					} else if accountType == "smtp" {
-						if smtpAccID != -1 {
-							client.SendText(roomID, "SMTP account already existing. Create a new room if you want to use a different account!")
-							return
-						}
-						isInUse, err := isSMTPAccountAlreadyInUse(username)
-						if err != nil {
-							client.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #24")
-							WriteLog(critical, "#24 checking isSMTPAccountAlreadyInUse: "+err.Error())
-							return
-						}
-						if isInUse {
-							client.SendText(roomID, "This smtp-username is already in Use! You cannot use your email twice!")
-							return
-						}
-
-						go func() {
-							if len(s) == 5 {
-								ignoreSSlCert, err = strconv.ParseBool(strings.ReplaceAll(s[4], " ", ""))
-								if err != nil {
-									fmt.Println(err.Error())
-									ignoreSSlCert = false
-								}
-							}
-							has, er := hasRoom(roomID.String())
-							if er != nil {
-								client.SendText(roomID, "An error occured! contact your admin! Errorcode: #28")
-								WriteLog(critical, "checking imapAcc #28: "+er.Error())
-								return
-							}
-							var newRoomID int64
-							if !has {
-								newRoomID = insertNewRoom(roomID.String(), defaultMailSyncInterval)
-								if newRoomID == -1 {
-									client.SendText(roomID, "An error occured! contact your admin! Errorcode: #29")
-									WriteLog(critical, "checking insertNewRoom #29: ")
-									return
-								}
-							} else {
-								id, err := getRoomPKID(evt.RoomID.String())
-								if err != nil {
-									WriteLog(critical, "checking getRoomPKID #30: "+err.Error())
-									client.SendText(roomID, "An error occured! contact your admin! Errorcode: #30")
-									return
-								}
-								newRoomID = int64(id)
-							}
-							port := 587
-							if !strings.Contains(host, ":") {
-								client.SendText(roomID, "No port specified! Using 587")
-							} else {
-								hostsplit := strings.Split(host, ":")
-								host = hostsplit[0]
-								port, err = strconv.Atoi(strings.Trim(hostsplit[1], " "))
-								if err != nil {
-									client.SendText(roomID, "The port must be a number!")
-									return
-								}
-							}
-							smtpID, err := insertSMTPAccountount(host, port, username, password, ignoreSSlCert)
-							if err != nil {
-								client.SendText(roomID, "sth went wrong. Contact your admin")
-								return
-							}
-							err = saveSMTPAcc(roomID.String(), int(smtpID))
-							if err != nil {
-								WriteLog(critical, "saveSMTPAcc #36 : "+err.Error())
-								client.SendText(roomID, "sth went wrong. Contact you admin! Errorcode: #34")
-								return
-							}
-
-							client.SendText(roomID, "SMTP data saved.\r\nSMTP:\r\n"+
-								"host: "+host+"\r\n"+
-								"port: "+strconv.Itoa(port)+"\r\n"+
-								"username: "+username+"\r\n"+
-								"ignoreSSL: "+strconv.FormatBool(ignoreSSlCert))
-						}()
-					} else {
-						client.SendText(roomID, "Not implemented yet!")
-					}
-				}
-			} else if message == "!help" {
-				helpText := "-------- Help --------\r\n"
-				helpText += "!setup imap/smtp, host:port, username(em@ail.com), password, <mailbox (only for imap)>, ignoreSSLcert(true/false) - creates a bridge for this room\r\n"
-				helpText += "!ping - gets information about the email bridge for this room\r\n"
-				helpText += "!help - shows this command help overview\r\n"
-				helpText += "!write (receiver(s) email(s) splitted by space!) <markdown default:true>- sends an email to a given address\r\n"
-				helpText += "!mailboxes - shows a list with all mailboxes available on your IMAP server\r\n"
-				helpText += "!setmailbox (mailbox) - changes the mailbox for the room\r\n"
-				helpText += "!mailbox - shows the currently selected mailbox\r\n"
-				helpText += "!sethtml (on/off or true/false) - sets HTML-rendering for messages on/off\r\n"
-				helpText += "!logout remove email bridge from current room\r\n"
-				helpText += "!leave unbridge the current room and kick the bot\r\n"
-				helpText += "\r\n---- Email writing commands ----\r\n"
-				helpText += "!send - sends the email\r\n"
-				helpText += "!rm <file> - removes given attachment from email\r\n"
-				client.SendText(roomID, helpText)
-			} else if message == "!ping" {
-				if has, err := hasRoom(roomID.String()); has && err == nil {
-					roomData, err := getRoomInfo(roomID.String())
-					if err != nil {
-						WriteLog(logError, "#006 getRoomInfo: "+err.Error())
-						client.SendText(roomID, "An server-error occured")
-						return
-					}
-
-					client.SendText(roomID, roomData)
-				} else {
-					if err != nil {
-						WriteLog(logError, "#06 hasRoom: "+err.Error())
-						client.SendText(roomID, "An server-error occured")
-					} else {
-						client.SendText(roomID, "You have to login to use this command!")
-					}
-				}
-			} else if strings.HasPrefix(message, "!write") {
-				if has, err := hasRoom(roomID.String()); has && err == nil {
-					_, smtpAccID, erro := getRoomAccounts(roomID.String())
-					if erro != nil {
-						WriteLog(critical, "#38 getRoomAccounts: "+erro.Error())
-						client.SendText(roomID, "An server-error occured Errorcode: #38")
-						return
-					}
-					if smtpAccID == -1 {
-						client.SendText(roomID, "You have to setup an smtp account. Type !help or !login for more information")
-						return
-					}
-					s := strings.Split(message, " ")
-					if len(s) > 1 {
-						receiver := strings.Trim(s[1], " ")
-						if len(s) > 2 {
-							receiverString := ""
-							for i := 1; i < len(s); i++ {
-								recEmail := strings.Trim(s[i], " ")
-								if len(recEmail) == 0 || !strings.Contains(recEmail, "@") || !strings.Contains(recEmail, ".") || strings.Contains(receiverString, recEmail) {
-									continue
-								}
-								add := ","
-								if strings.HasSuffix(recEmail, ",") {
-									add = ""
-								}
-								receiverString += strings.Trim(s[i], " ") + add
-							}
-							receiver = receiverString[:len(receiverString)-1]
-						}
-
-						if strings.Contains(receiver, "@") && strings.Contains(receiver, ".") && len(receiver) > 5 {
-							hasTemp, err := isUserWritingEmail(roomID.String())
-							if err != nil {
-								WriteLog(critical, "#39 isUserWritingEmail: "+err.Error())
-								client.SendText(roomID, "An server-error occured Errorcode: #39")
-								return
-							}
-							if hasTemp {
-								er := deleteWritingTemp(roomID.String())
-								if er != nil {
-									WriteLog(critical, "#40 deleteWritingTemp: "+er.Error())
-									client.SendText(roomID, "An server-error occured Errorcode: #40")
-									return
-								}
-							}
-
-							mrkdwn := 0
-							if viper.GetBool("markdownEnabledByDefault") {
-								mrkdwn = 1
-							}
-							if len(s) == 3 {
-								mdwn, berr := strconv.ParseBool(s[2])
-								if berr == nil {
-									if mdwn {
-										mrkdwn = 1
-									} else {
-										mrkdwn = 0
-									}
-								}
-							}
-
-							err = newWritingTemp(roomID.String(), receiver)
-							saveWritingtemp(roomID.String(), "markdown", strconv.Itoa(mrkdwn))
-							if err != nil {
-								WriteLog(critical, "#42 newWritingTemp: "+err.Error())
-								client.SendText(roomID, "An server-error occured Errorcode: #42")
-								return
-							}
-							client.SendText(roomID, "Now send me the subject of your email")
-						} else {
-							client.SendText(roomID, "this is an email: max@google.de\r\nthis is no email: "+receiver)
-						}
-					} else {
-						client.SendText(roomID, "Usage: !write <emailaddress>")
-					}
-				} else {
-					client.SendText(roomID, "You have to login to use this command!")
-				}
-			} else if strings.HasPrefix(message, "!setmailbox") {
-				imapAccID, _, erro := getRoomAccounts(roomID.String())
-				if erro != nil {
-					WriteLog(critical, "#48 getRoomAccounts: "+erro.Error())
-					client.SendText(roomID, "An server-error occured Errorcode: #48")
-					return
-				}
-				if imapAccID != -1 {
-					d := strings.Split(message, " ")
-					if len(d) == 2 {
-						mailbox := d[1]
-						saveMailbox(roomID.String(), mailbox)
-						deleteMails(roomID.String())
-						stopMailChecker(roomID.String())
-						imapAccount, err := getIMAPAccount(roomID.String())
-						if err != nil {
-							WriteLog(critical, "#49 getIMAPAccount: "+err.Error())
-							client.SendText(roomID, "An server-error occured Errorcode: #49")
-							return
-						}
-						imapAccount.silence = true
-						go startMailListener(*imapAccount)
-						client.SendText(roomID, "Mailbox updated")
-					} else {
-						client.SendText(roomID, "Usage: !setmailbox <new mailbox>")
-					}
-				} else {
-					client.SendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
-				}
-			} else if strings.HasPrefix(message, "!sethtml") {
-				imapAccID, _, erro := getRoomAccounts(roomID.String())
-				if erro != nil {
-					WriteLog(critical, "#50 getRoomAccounts: "+erro.Error())
-					client.SendText(roomID, "An server-error occured Errorcode: #50")
-					return
-				}
-				if imapAccID != -1 {
-					d := strings.Split(message, " ")
-					if len(d) == 2 {
-						newMode := strings.ToLower(d[1])
-						newModeB := false
-						if newMode == "true" || newMode == "on" {
-							newModeB = true
-						} else if newMode != "false" && newMode != "off" {
-							client.SendText(roomID, "What?\r\non/off or true/false")
-							return
-						}
-						err := setHTMLenabled(roomID.String(), newModeB)
-						if err != nil {
-							WriteLog(critical, "#56 getMailbox: "+err.Error())
-							client.SendText(roomID, "An server-error occured Errorcode: #56")
-							return
-						}
-						client.SendText(roomID, "Successfully set HTML-rendering to "+newMode)
-					} else {
-						client.SendText(roomID, "Usage: !sethtml (on/of) or (true/false)")
-					}
-				} else {
-					client.SendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
-				}
-			} else if message == "!logout" {
-				err := logOut(client, roomID.String(), false)
-				if err != nil {
-					client.SendText(roomID, "Error logging out: "+err.Error())
-				} else {
-					client.SendText(roomID, "Successfully logged out")
-				}
-			} else if message == "!leave" {
-				err := logOut(client, roomID.String(), true)
-				if err != nil {
-					client.SendText(roomID, "Error leaving: "+err.Error())
-				} else {
-					client.SendText(roomID, "Successfully unbridged")
-				}
+		} else if handleCommand(client, evt, nil) {
+			return
+		} else if handleConversationMessage(roomID, evt.Content.AsMessage(), client) {
+			//messages in conversation rooms are replies to their email thread
+			return
+		}
+	}
+	syncer.OnEventType(event.EventMessage, handleMessage)
 
-			} else if strings.HasPrefix(message, "!blocklist") || strings.HasPrefix(message, "!bl") {
-				imapAccID, _, _ := getRoomAccounts(roomID.String())
-				if imapAccID == -1 {
-					client.SendText(roomID, "You need to login with an imap account to use this command!")
-					return
-				}
-				sm := strings.Split(message, " ")
-				if len(sm) < 3 {
-					if len(sm) == 2 && (sm[1] == "view" || sm[1] == "list") {
-						viewBlocklist(roomID.String(), client)
-					} else if len(sm) == 2 && sm[1] == "clear" {
-						err := clearBlocklist(imapAccID)
-						var msg string
-						if err != nil {
-							fmt.Println("Err:", err.Error())
-							msg = "Error clearing blocklist! View logs for more details!"
-						} else {
-							msg = "Blocklist is now clean!"
-						}
-						client.SendText(roomID, msg)
-					} else {
-						client.SendText(roomID, "Usage: !blocklist <add/delete/clear/view> <email address>\nDon't show any emails from a given email address.\nWildcards (like *@evilEmailAddress.com) are supported")
-					}
-				} else {
-					cmd := strings.ToLower(sm[1])
-					addr := sm[2]
-					if !strings.Contains(addr, "@") || !strings.Contains(addr, ".") || len(addr) < 6 {
-						client.SendText(roomID, "Error! "+addr+" is an invalid email address!")
-					} else {
-						switch cmd {
-						case "add":
-							{
-								//add item to blocklis
-								err := addEmailToBlocklist(imapAccID, addr)
-								var msg string
-								if err != nil {
-									fmt.Println("Err:", err.Error())
-									msg = "Error adding " + addr + " to blocklist! View logs for more details!"
-								} else {
-									msg = "Success adding " + addr + " to blocklist!"
-								}
-								client.SendText(roomID, msg)
-							}
-						case "remove", "delete", "rm":
-							{
-								err := removeEmailFromBlocklist(imapAccID, addr)
-								var msg string
-								if err != nil {
-									fmt.Println("Err:", err.Error())
-									msg = "Error deleting " + addr + " from blocklist! View logs for more details!"
-								} else {
-									msg = "Success deleting " + addr + " from blocklist!"
-								}
-								client.SendText(roomID, msg)
-							}
-						}
-					}
-				}
-			} else if strings.HasPrefix(message, "!view") {
-				imapAccID, _, _ := getRoomAccounts(roomID.String())
-				if imapAccID == -1 {
-					client.SendText(roomID, "You need to login with an imap account to use this command!")
-					return
-				}
-				sm := strings.Split(message, " ")
-				if len(sm) == 1 {
-					viewViewHelp(roomID.String(), client)
-				} else if len(sm) > 1 {
-					switch strings.ToLower(sm[1]) {
-					case "mb", "mailbox":
-						{
-							viewMailbox(roomID.String(), client)
-						}
-					case "mbs", "mailboxes":
-						{
-							viewMailboxes(roomID.String(), client)
-						}
-					case "blocklist", "bl", "blocklists", "blo", "blocked":
-						{
-							viewBlocklist(roomID.String(), client)
-						}
-					case "h", "help":
-						{
-							viewViewHelp(roomID.String(), client)
-						}
-					default:
-						{
-							viewViewHelp(roomID.String(), client)
-						}
-					}
-				}
-			} else if strings.HasPrefix(message, "!") {
-				client.SendText(roomID, "command not found!")
-			}
+	err := initCrypto(client, syncer, func(source mautrix.EventSource, evt *event.Event) {
+		if evt.Type == event.EventMessage {
+			handleMessage(source, evt)
 		}
 	})
+	if err != nil {
+		WriteLog(critical, "#115 initCrypto: "+err.Error())
+	}
 
-	err := client.Sync()
+	err = client.Sync()
 	if err != nil {
 		WriteLog(logError, "#07 Syncing: "+err.Error())
 		fmt.Println(err)
@@ -796,7 +385,7 @@ func startMatrixSync(client *mautrix.Client) {
 }
 
 func viewViewHelp(roomID string, client *mautrix.Client) {
-	client.SendText(id.RoomID(roomID), "Available options:\n\nmb/mailbox\t-\tViews the current used mailbox\nmbs/mailboxes\t-\tView the available mailboxes\nbl/blocklist\t-\tViews the list of blocked addresses")
+	client.SendText(id.RoomID(roomID), "Available options:\n\nmb/mailbox\t-\tViews the current used mailbox\nmbs/mailboxes\t-\tView the available mailboxes\nsf/sentfolder\t-\tViews the mailbox sent emails are saved to\nbl/blocklist\t-\tViews the list of blocked addresses")
 }
 
 func deleteTempFile(name string) {
@@ -880,12 +469,28 @@ func main() {
 		panic(er)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "generate-registration" {
+		err := generateRegistration()
+		if err != nil {
+			fmt.Println("Couldn't generate the registration:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Created " + dirPrefix + "registration.yaml. Add it to app_service_config_files of your homeserver and restart it")
+		return
+	}
+
 	deleteAllWritingTemps()
 
 	loginMatrix()
 
+	if appserviceEnabled() {
+		go startAppservice()
+	}
+
 	startMailSchedeuler()
 
+	startOutboxScheduler()
+
 	for {
 		time.Sleep(1 * time.Second)
 	}
@@ -895,7 +500,8 @@ func stopMailChecker(roomID string) {
 	_, ok := listenerMap[roomID]
 	if ok {
 		close(listenerMap[roomID])
-		//delete(listenerMap, evt.RoomID)
+		//a bridge can be stopped more than once, eg. when it is unbridged and removed later
+		delete(listenerMap, roomID)
 	}
 }
 
@@ -952,7 +558,7 @@ func startMailListener(account imapAccountount) {
 	var mClient *client.Client
 	var err error
 	for !connectSuccess {
-		mClient, err = loginMail(account.host, account.username, account.password, account.ignoreSSL)
+		mClient, err = loginMail(&account)
 		if err == nil {
 			connectSuccess = true
 			continue
@@ -965,6 +571,7 @@ func startMailListener(account imapAccountount) {
 	listenerMap[account.roomID] = quit
 	clients[account.roomID] = mClient
 	go func() {
+		syncSpace(mClient, &account)
 		for {
 			select {
 			case <-quit:
@@ -975,6 +582,7 @@ func startMailListener(account imapAccountount) {
 					return
 				}
 				fetchNewMails(mClient, &account)
+				fetchFolderMails(mClient, &account)
 				checksPerAccount[account.roomID]++
 				time.Sleep((time.Duration)(account.mailCheckInterval) * time.Second)
 			}
@@ -992,7 +600,7 @@ func reconnect(account imapAccountount) {
 
 func fetchNewMails(mClient *client.Client, account *imapAccountount) {
 	messages := make(chan *imap.Message, 1)
-	section, errCode := getMails(mClient, account.mailbox, messages)
+	section, uidValidity, errCode := getMails(mClient, account.mailbox, messages)
 
 	if section == nil {
 		if errCode == 0 {
@@ -1022,7 +630,7 @@ func fetchNewMails(mClient *client.Client, account *imapAccountount) {
 		if has, err := dbContainsMail(mailID, account.roomPKID); !has && err == nil {
 			go insertEmail(mailID, account.roomPKID)
 			if !account.silence {
-				handleMail(msg, section, *account)
+				handleMail(msg, section, *account, mailRef{mailbox: account.mailbox, uid: msg.Uid, uidValidity: uidValidity})
 			}
 		} else if err != nil {
 			WriteLog(logError, "#11 dbContains mail: "+err.Error())
@@ -1034,11 +642,14 @@ func fetchNewMails(mClient *client.Client, account *imapAccountount) {
 	}
 }
 
-func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapAccountount) {
+func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapAccountount, ref mailRef) {
 	content := getMailContent(mail, section, account.roomID)
 	if content == nil {
 		return
 	}
+	if len(content.sendermails) > 0 {
+		ref.sender, ref.senderName = content.sendermails[0], content.sendernames[0]
+	}
 	for _, senderMail := range content.sendermails {
 		fmt.Println("checking", senderMail)
 		if checkForBlocklist(account.roomID, senderMail) {
@@ -1046,8 +657,29 @@ func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapA
 			return
 		}
 	}
+	if content.report != nil && handleBounce(account.roomID, content.report, ref) {
+		return
+	}
+	if content.receipt != nil && handleReadReceipt(account.roomID, content.receipt) {
+		return
+	}
+	roomID := account.roomID
+	if ref.mailbox != account.mailbox {
+		folderRoomID, err := getFolderRoomID(account.roomID, ref.mailbox)
+		if err != nil {
+			WriteLog(logError, "#137 getFolderRoomID: "+err.Error())
+		} else if len(folderRoomID) > 0 {
+			roomID = folderRoomID
+		}
+	} else if enabled, err := isConversationMode(account.roomID); err == nil && enabled {
+		if roomID, err = getConversationRoom(account.roomID, content); err != nil {
+			WriteLog(logError, "#128 getConversationRoom: "+err.Error())
+			roomID = account.roomID
+		}
+	}
 	from := html.EscapeString(content.from)
 	fmt.Println("attachments: " + content.attachment)
+	sender := getMailSender(roomID, content)
 	headerContent := &event.MessageEventContent{
 		Format:        event.FormatHTML,
 		Body:          "\r\n────────────────────────────────────\r\n## You've got a new Email from " + from + "\r\n" + "Subject: " + content.subject + "\r\n" + "────────────────────────────────────",
@@ -1055,7 +687,8 @@ func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapA
 		MsgType:       event.MsgText,
 	}
 
-	matrixClient.SendMessageEvent(id.RoomID(account.roomID), event.EventMessage, &headerContent)
+	resp, err := sender.SendMessageEvent(id.RoomID(roomID), event.EventMessage, &headerContent)
+	saveMailEvent(roomID, resp, err, ref)
 
 	if content.htmlFormat {
 		bodyContent := &event.MessageEventContent{
@@ -1064,8 +697,24 @@ func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapA
 			FormattedBody: string(markdown.ToHTML([]byte(content.body), nil, nil)),
 			MsgType:       event.MsgText,
 		}
-		matrixClient.SendMessageEvent(id.RoomID(account.roomID), event.EventMessage, &bodyContent)
+		resp, err = sender.SendMessageEvent(id.RoomID(roomID), event.EventMessage, &bodyContent)
 	} else {
-		matrixClient.SendText(id.RoomID(account.roomID), content.body)
+		resp, err = sender.SendText(id.RoomID(roomID), content.body)
+	}
+	saveMailEvent(roomID, resp, err, ref)
+
+	if len(content.receiptTo) > 0 {
+		resp, err = matrixClient.SendText(id.RoomID(roomID), "The sender asks for a read receipt. Reply to the email with "+commandPrefix()+"ack to send it")
+		saveMailEvent(roomID, resp, err, ref)
+	}
+}
+
+//saveMailEvent remembers the email a message was bridged from, so commands replying to it can find it
+func saveMailEvent(roomID string, resp *mautrix.RespSendEvent, err error, ref mailRef) {
+	if err != nil || ref.uid == 0 {
+		return
+	}
+	if err := insertMailEvent(roomID, resp.EventID.String(), ref); err != nil {
+		WriteLog(logError, "#95 insertMailEvent: "+err.Error())
 	}
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//unbridgeTimers are the rooms the bridge leaves after the grace period, because their last user left
+var (
+	unbridgeTimers     = make(map[id.RoomID]*time.Timer)
+	unbridgeTimerMutex sync.Mutex
+)
+
+//unbridgeGracePeriod is how long the bridge stays in a room after its last user left
+func unbridgeGracePeriod() time.Duration {
+	return time.Duration(viper.GetInt("unbridgeGracePeriod")) * time.Minute
+}
+
+//handleMembership joins rooms the bot is invited to and unbridges rooms without users
+func handleMembership(client *mautrix.Client, source mautrix.EventSource, evt *event.Event) {
+	membership := evt.Content.AsMember().Membership
+	userID := id.UserID(evt.GetStateKey())
+	if userID == client.UserID {
+		if membership == event.MembershipInvite && source&mautrix.EventSourceInvite != 0 {
+			handleInvite(client, evt)
+		} else if membership.IsLeaveOrBan() && evt.Sender != client.UserID && isNewEvent(evt) {
+			//the bot got kicked, it can't stay in the room for the grace period
+			cancelUnbridge(evt.RoomID)
+			deactivateBridge(client, evt.RoomID, false)
+		}
+		return
+	}
+	//the members of rooms the bot is invited to don't matter yet
+	if source&mautrix.EventSourceInvite != 0 || isGhost(userID) {
+		return
+	}
+	switch {
+	case membership == event.MembershipJoin:
+		cancelUnbridge(evt.RoomID)
+	case membership.IsLeaveOrBan() && isNewEvent(evt):
+		checkRoomEmpty(client, evt.RoomID)
+	}
+}
+
+//handleInvite joins a room if the inviter is allowed to use the bridge, other invites are rejected
+func handleInvite(client *mautrix.Client, evt *event.Event) {
+	if !isAllowedUser(evt.Sender) {
+		WriteLog(info, "Rejected the invite of "+evt.Sender.String()+" to "+evt.RoomID.String()+": user not allowed! Add the user to allowed_users or its server to allowed_servers in your config if you want to allow it using me")
+		if err := rejectInvite(client, evt.RoomID, "You aren't allowed to use this bridge. Ask its admin to add you"); err != nil {
+			WriteLog(warn, "Couldn't reject the invite to "+evt.RoomID.String()+": "+err.Error())
+		}
+		return
+	}
+	if _, err := client.JoinRoomByID(evt.RoomID); err != nil {
+		WriteLog(logError, "Couldn't join "+evt.RoomID.String()+": "+err.Error())
+		return
+	}
+	loadRoomState(client, evt.RoomID)
+	if !checkRoomEncryption(client, evt.RoomID) {
+		return
+	}
+	leftAt, err := getRoomLeftAt(evt.RoomID.String())
+	if err != nil {
+		WriteLog(logError, "#145 getRoomLeftAt: "+err.Error())
+	}
+	if leftAt > 0 {
+		reactivateBridge(client, evt.RoomID)
+		return
+	}
+	client.SendText(evt.RoomID, "Hey you have invited me to a new room. Enter "+commandPrefix()+"login to bridge this room to a Mail account")
+}
+
+//rejectInvite declines an invite and tells the inviter why
+func rejectInvite(client *mautrix.Client, roomID id.RoomID, reason string) error {
+	_, err := client.MakeRequest("POST", client.BuildURL("rooms", roomID, "leave"), map[string]string{"reason": reason}, nil)
+	return err
+}
+
+//hasUsers returns true if a human joined the room. Invited users, the bot and the puppets of the email senders don't count
+func hasUsers(client *mautrix.Client, roomID id.RoomID) bool {
+	members, err := getRoomMembersWithMembership(roomID.String(), string(event.MembershipJoin))
+	if err != nil {
+		WriteLog(logError, "#146 getRoomMembersWithMembership: "+err.Error())
+		//keep the room rather than unbridging it by mistake
+		return true
+	}
+	for _, member := range members {
+		if userID := id.UserID(member); userID != client.UserID && !isGhost(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkRoomEmpty starts the grace period of a bridged room if its last user left
+func checkRoomEmpty(client *mautrix.Client, roomID id.RoomID) {
+	if has, err := hasRoom(roomID.String()); err != nil || !has {
+		return
+	}
+	if hasUsers(client, roomID) {
+		return
+	}
+	now := time.Now()
+	if err := setRoomEmptySince(roomID.String(), now.Unix()); err != nil {
+		WriteLog(logError, "#141 setRoomEmptySince: "+err.Error())
+	}
+	WriteLog(info, "The last user left "+roomID.String()+", unbridging it in "+unbridgeGracePeriod().String())
+	scheduleUnbridge(client, roomID, now)
+}
+
+//scheduleUnbridge leaves a room when the grace period after the given time is over
+func scheduleUnbridge(client *mautrix.Client, roomID id.RoomID, emptySince time.Time) {
+	unbridgeTimerMutex.Lock()
+	defer unbridgeTimerMutex.Unlock()
+	if timer, ok := unbridgeTimers[roomID]; ok {
+		timer.Stop()
+	}
+	unbridgeTimers[roomID] = time.AfterFunc(time.Until(emptySince.Add(unbridgeGracePeriod())), func() {
+		unbridgeTimerMutex.Lock()
+		delete(unbridgeTimers, roomID)
+		unbridgeTimerMutex.Unlock()
+		//a user may have joined while the timer fired
+		if !hasUsers(client, roomID) {
+			deactivateBridge(client, roomID, true)
+		}
+	})
+}
+
+//cancelUnbridge stops the grace period of a room because a user joined
+func cancelUnbridge(roomID id.RoomID) {
+	unbridgeTimerMutex.Lock()
+	timer, ok := unbridgeTimers[roomID]
+	if ok {
+		timer.Stop()
+		delete(unbridgeTimers, roomID)
+	}
+	unbridgeTimerMutex.Unlock()
+	if !ok {
+		return
+	}
+	if err := setRoomEmptySince(roomID.String(), 0); err != nil {
+		WriteLog(logError, "#141 setRoomEmptySince: "+err.Error())
+	}
+}
+
+//resumeUnbridgeTimers restarts the grace periods which were running when the bridge stopped
+func resumeUnbridgeTimers(client *mautrix.Client) {
+	rooms, err := getEmptyRooms()
+	if err != nil {
+		WriteLog(logError, "#143 getEmptyRooms: "+err.Error())
+		return
+	}
+	for roomID, since := range rooms {
+		scheduleUnbridge(client, id.RoomID(roomID), time.Unix(since, 0))
+	}
+}
+
+//deactivateBridge stops the mail listener of a room and leaves it.
+//The accounts are kept, so the bridge continues if it gets invited again
+func deactivateBridge(client *mautrix.Client, roomID id.RoomID, leave bool) {
+	if has, err := hasRoom(roomID.String()); err != nil || !has {
+		return
+	}
+	stopMailChecker(roomID.String())
+	if err := setRoomLeftAt(roomID.String(), time.Now().Unix()); err != nil {
+		WriteLog(logError, "#144 setRoomLeftAt: "+err.Error())
+	}
+	if leave {
+		if _, err := client.LeaveRoom(roomID); err != nil {
+			WriteLog(warn, "Couldn't leave "+roomID.String()+": "+err.Error())
+		}
+	}
+	WriteLog(info, "Unbridged "+roomID.String()+". Its accounts are kept until it invites the bridge again")
+}
+
+//reactivateBridge restarts the bridge of a room which invited the bridge again
+func reactivateBridge(client *mautrix.Client, roomID id.RoomID) {
+	if err := setRoomLeftAt(roomID.String(), 0); err != nil {
+		WriteLog(logError, "#144 setRoomLeftAt: "+err.Error())
+	}
+	imapAccID, _, err := getRoomAccounts(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#48 getRoomAccounts: "+err.Error())
+	} else if imapAccID != -1 {
+		restartMailListener(roomID.String())
+	}
+	client.SendText(roomID, "Welcome back! This room is bridged to your email account again. Use "+commandPrefix()+"logout to remove the bridge")
+	WriteLog(info, "Bridged "+roomID.String()+" again")
+}
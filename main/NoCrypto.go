@@ -0,0 +1,35 @@
+//go:build !olm
+// +build !olm
+
+package main
+
+import (
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//initCrypto does nothing, the bridge was built without libolm. Build it with -tags olm to support encrypted rooms
+func initCrypto(client *mautrix.Client, syncer *mautrix.DefaultSyncer, handleEvent func(mautrix.EventSource, *event.Event)) error {
+	WriteLog(info, "built without end-to-end encryption support")
+	return nil
+}
+
+func encryptionSupported(roomID id.RoomID) bool {
+	return false
+}
+
+//decryptEvent returns the event unchanged, encrypted events can't be read without encryption support
+func decryptEvent(evt *event.Event) (*event.Event, error) {
+	if evt.Type == event.EventEncrypted {
+		return nil, errors.New("built without end-to-end encryption support")
+	}
+	return evt, nil
+}
+
+//answerVerification returns false, there are no verifications without encryption support
+func answerVerification(roomID id.RoomID, userID id.UserID, confirmed bool) bool {
+	return false
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	outboxQueued = "queued"
+	outboxFailed = "failed"
+)
+
+const maxOutboxAttempts = 10
+
+const outboxCheckInterval = 30 * time.Second
+
+const maxRetryDelay = 6 * time.Hour
+
+//mails which are being delivered, so the scheduler and !send don't send a mail twice.
+//Different mails are sent at the same time, a slow smtp server only blocks its own mails
+var (
+	outboxMutex     sync.Mutex
+	deliveringMails = map[int64]bool{}
+)
+
+//rawMail is an already rendered email
+type rawMail []byte
+
+func (r rawMail) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
+
+//queueMail renders the email and stores it in the outbox. Returns the outbox id
+func queueMail(roomID string, account *smtpAccount, m *gomail.Message, receivers []string, subject string, sendAt int64) (int64, error) {
+	//the Message-ID is needed to match bounces
+	messageID := newMessageID(account.username)
+	m.SetHeader("Message-ID", messageID)
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return -1, err
+	}
+	return insertOutboxMail(roomID, account.username, strings.Join(receivers, ","), subject, messageID, buf.Bytes(), sendAt)
+}
+
+//sendDraft moves a written email into the outbox and tries to send it
+func sendDraft(roomID id.RoomID, writeTemp *emailTemp) {
+	account, err := getSMTPAccount(string(roomID))
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		matrixClient.SendText(roomID, "An server-error occured Errorcode: #52")
+		deleteWritingTempByID(writeTemp.pkID)
+		return
+	}
+
+	attachments, err := getAttachments(writeTemp.pkID)
+	if err == nil {
+		for _, i := range attachments {
+			matrixClient.SendText(roomID, "Attaching file: "+i.name)
+		}
+	} else {
+		matrixClient.SendText(roomID, "coulnd't attach files: "+err.Error())
+	}
+
+	m := buildMail(roomID, writeTemp, account)
+	outboxID, err := queueMail(string(roomID), account, m, getReceivers(writeTemp), writeTemp.subject, time.Now().Unix())
+	if err != nil {
+		WriteLog(critical, "#46 queueMail: "+err.Error())
+		matrixClient.SendText(roomID, "An server-error occured Errorcode: #46\r\n"+err.Error())
+		return
+	}
+	deleteWritingTempByID(writeTemp.pkID)
+	matrixClient.SendText(roomID, "Sending...")
+	go deliverOutboxMail(outboxID)
+}
+
+func startOutboxScheduler() {
+	go func() {
+		for {
+			processScheduledDrafts()
+			processOutbox()
+			time.Sleep(outboxCheckInterval)
+		}
+	}()
+}
+
+//processOutbox sends the due mails. Mails still being delivered since the last check are skipped
+func processOutbox() {
+	mails, err := getDueOutboxMails(time.Now().Unix())
+	if err != nil {
+		WriteLog(critical, "#70 getDueOutboxMails: "+err.Error())
+		return
+	}
+	for _, mail := range mails {
+		go deliverOutboxMail(mail.pkID)
+	}
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+//claimOutboxMail returns false if the mail is already being delivered
+func claimOutboxMail(pkID int64) bool {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	if deliveringMails[pkID] {
+		return false
+	}
+	deliveringMails[pkID] = true
+	return true
+}
+
+func releaseOutboxMail(pkID int64) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	delete(deliveringMails, pkID)
+}
+
+//deliverOutboxMail tries to send a queued email and reports the result in its room.
+//Commands run it in a goroutine, the smtp server mustn't block the sync
+func deliverOutboxMail(pkID int64) {
+	mail := sendOutboxMail(pkID)
+	if mail == nil {
+		return
+	}
+	//the mail is removed from the outbox already, a slow imap server doesn't hold it back
+	if imapAccID, _, _ := getRoomAccounts(mail.roomID); imapAccID != -1 {
+		if err := saveSentMail(mail.roomID, rawMail(mail.raw)); err != nil {
+			WriteLog(logError, "#66 saveSentMail: "+err.Error())
+			matrixClient.SendText(id.RoomID(mail.roomID), "Couldn't save the email to your sent folder: "+err.Error())
+		}
+	}
+}
+
+//sendOutboxMail sends a queued email over smtp. Returns the mail if it was sent
+func sendOutboxMail(pkID int64) *outboxMail {
+	if !claimOutboxMail(pkID) {
+		return nil
+	}
+	defer releaseOutboxMail(pkID)
+
+	mail, err := getOutboxMail(pkID)
+	if err != nil {
+		//canceled or already sent
+		return nil
+	}
+	if mail.status != outboxQueued || mail.nextTry > time.Now().Unix() {
+		return nil
+	}
+	roomID := id.RoomID(mail.roomID)
+	outboxID := strconv.FormatInt(mail.pkID, 10)
+
+	account, err := getSMTPAccount(mail.roomID)
+	//retrying doesn't help if the account was removed
+	noAccount := err == sql.ErrNoRows
+	if noAccount {
+		err = errors.New("this room has no smtp account anymore")
+	}
+	if err == nil {
+		err = sendRawMail(account, mail.sender, strings.Split(mail.receiver, ","), rawMail(mail.raw), envelopeID(mail.messageID))
+	}
+	if err == nil {
+		err = deleteOutboxMail(mail.pkID)
+		if err != nil {
+			WriteLog(critical, "#71 deleteOutboxMail: "+err.Error())
+		}
+		resp, er := matrixClient.SendText(roomID, "Message \""+mail.subject+"\" sent successfully")
+		if er == nil && len(mail.messageID) > 0 {
+			sent := sentMail{mail.messageID, envelopeID(mail.messageID), resp.EventID.String(), mail.subject}
+			if err := insertSentMail(mail.roomID, sent); err != nil {
+				WriteLog(logError, "#104 insertSentMail: "+err.Error())
+			}
+		}
+		return mail
+	}
+
+	WriteLog(logError, "#53 sending outbox mail "+outboxID+": "+err.Error())
+	mail.attempts++
+	if noAccount || isPermanentSMTPError(err) || mail.attempts >= maxOutboxAttempts {
+		if er := updateOutboxMail(mail.pkID, mail.attempts, mail.nextTry, outboxFailed, err.Error()); er != nil {
+			WriteLog(critical, "#72 updateOutboxMail: "+er.Error())
+		}
+		matrixClient.SendText(roomID, "Couldn't send \""+mail.subject+"\": "+err.Error()+"\r\n"+
+			"Use '"+commandPrefix()+"outbox retry "+outboxID+"' to try again or '"+commandPrefix()+"outbox cancel "+outboxID+"' to discard it")
+		return nil
+	}
+
+	delay := retryDelay(mail.attempts)
+	if er := updateOutboxMail(mail.pkID, mail.attempts, time.Now().Add(delay).Unix(), outboxQueued, err.Error()); er != nil {
+		WriteLog(critical, "#72 updateOutboxMail: "+er.Error())
+	}
+	matrixClient.SendText(roomID, "Couldn't send \""+mail.subject+"\" yet: "+err.Error()+"\r\n"+
+		"Trying again in "+delay.String()+" (attempt "+strconv.Itoa(mail.attempts)+"/"+strconv.Itoa(maxOutboxAttempts)+"). Use "+commandPrefix()+"outbox to view queued emails")
+	return nil
+}
+
+func viewOutbox(roomID string, client *mautrix.Client) {
+	mails, err := getOutboxMails(roomID)
+	if err != nil {
+		WriteLog(critical, "#73 getOutboxMails: "+err.Error())
+		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #73")
+		return
+	}
+	if len(mails) == 0 {
+		client.SendText(id.RoomID(roomID), "Your outbox is empty")
+		return
+	}
+	msg := "Outbox:\n"
+	for _, mail := range mails {
+		msg += "#" + strconv.FormatInt(mail.pkID, 10) + " [" + mail.status + "] to " + mail.receiver + ": \"" + mail.subject + "\""
+		if mail.status == outboxQueued {
+			msg += " - next try " + time.Unix(mail.nextTry, 0).Format("2006-01-02 15:04")
+		}
+		if len(mail.lastError) > 0 {
+			msg += "\n> attempt " + strconv.Itoa(mail.attempts) + ": " + mail.lastError
+		}
+		msg += "\n"
+	}
+	client.SendText(id.RoomID(roomID), msg)
+}
+
+func handleOutboxCommand(roomID id.RoomID, args []string, client *mautrix.Client) {
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "list" || args[0] == "view")) {
+		viewOutbox(roomID.String(), client)
+		return
+	}
+	if len(args) != 2 {
+		client.SendText(roomID, "Usage: "+commandPrefix()+"outbox <list/retry/cancel> <id>")
+		return
+	}
+	pkID, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+	if err != nil {
+		client.SendText(roomID, "The id must be a number!")
+		return
+	}
+	mail, err := getOutboxMail(pkID)
+	if err != nil || mail.roomID != roomID.String() {
+		client.SendText(roomID, "There is no email #"+args[1]+" in your outbox")
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "retry":
+		{
+			err := updateOutboxMail(mail.pkID, mail.attempts, time.Now().Unix(), outboxQueued, mail.lastError)
+			if err != nil {
+				WriteLog(critical, "#72 updateOutboxMail: "+err.Error())
+				client.SendText(roomID, "An server-error occured Errorcode: #72")
+				return
+			}
+			client.SendText(roomID, "Sending...")
+			go deliverOutboxMail(mail.pkID)
+		}
+	case "cancel", "rm", "delete":
+		{
+			err := deleteOutboxMail(mail.pkID)
+			if err != nil {
+				WriteLog(critical, "#71 deleteOutboxMail: "+err.Error())
+				client.SendText(roomID, "An server-error occured Errorcode: #71")
+				return
+			}
+			client.SendText(roomID, "Email canceled")
+		}
+	default:
+		{
+			client.SendText(roomID, "Usage: "+commandPrefix()+"outbox <list/retry/cancel> <id>")
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//isAdmin returns true if the user is in the admin list of the config
+func isAdmin(userID id.UserID) bool {
+	return contains(viper.GetStringSlice("admins"), userID.String())
+}
+
+//isAllowedUser returns true if the user may use the bridge: admins, users matching a pattern of 'allowed_users' and users of 'allowed_servers'
+func isAllowedUser(userID id.UserID) bool {
+	if isAdmin(userID) {
+		return true
+	}
+	for _, pattern := range viper.GetStringSlice("allowed_users") {
+		if matchUserPattern(pattern, userID.String()) {
+			return true
+		}
+	}
+	host, err := getHostFromMatrixID(userID.String())
+	return err == -1 && contains(viper.GetStringSlice("allowed_servers"), host)
+}
+
+//matchUserPattern matches a user id with a pattern in which * stands for any text, eg. @*:example.com
+func matchUserPattern(pattern, userID string) bool {
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	matched, err := regexp.MatchString(expr, userID)
+	return err == nil && matched
+}
+
+//managePowerLevel returns the power level needed for commands changing the bridge
+func managePowerLevel() int {
+	return viper.GetInt("managePowerLevel")
+}
+
+//getPowerLevel returns the power level of a user in a room
+func getPowerLevel(roomID id.RoomID, userID id.UserID) (int, error) {
+	var powerLevels event.PowerLevelsEventContent
+	err := matrixClient.StateEvent(roomID, event.StatePowerLevels, "", &powerLevels)
+	if err != nil {
+		return 0, err
+	}
+	return powerLevels.GetUserLevel(userID), nil
+}
+
+//hasPermission returns true if the user may use commands of the given level.
+//Admins may use every command. Commands changing the bridge need the power level 'managePowerLevel',
+//the login data can only be changed by the user who created the bridge
+func hasPermission(roomID id.RoomID, userID id.UserID, level permissionLevel) bool {
+	if level == permMember || isAdmin(userID) {
+		return true
+	}
+	powerLevel, err := getPowerLevel(roomID, userID)
+	if err != nil {
+		WriteLog(logError, "#142 getPowerLevel: "+err.Error())
+		return false
+	}
+	if powerLevel < managePowerLevel() {
+		return false
+	}
+	if level == permCredentials {
+		setupUser, err := getSetupUser(roomID.String())
+		if err != nil {
+			WriteLog(logError, "#140 getSetupUser: "+err.Error())
+			return false
+		}
+		//bridges created before the setup user was saved can be changed by every manager
+		return len(setupUser) == 0 || setupUser == userID.String()
+	}
+	return true
+}
+
+//permissionDenied tells the user who may use a command
+func permissionDenied(roomID id.RoomID, cmd *command) string {
+	text := "You aren't allowed to use " + commandPrefix() + cmd.name + ". "
+	if cmd.permission == permCredentials {
+		if setupUser, err := getSetupUser(roomID.String()); err == nil && len(setupUser) > 0 {
+			return text + "Only " + setupUser + " (with power level " + strconv.Itoa(managePowerLevel()) + ") or an admin of the bridge can change the login data"
+		}
+	}
+	return text + "You need the power level " + strconv.Itoa(managePowerLevel()) + " in this room"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+//dispositionNotification is a parsed read receipt (MDN, RFC 8098)
+type dispositionNotification struct {
+	originalMessageID, disposition string
+}
+
+//parseDispositionPart reads the message/disposition-notification part of a read receipt.
+//Returns false if the part doesn't belong to the receipt
+func parseDispositionPart(notification *dispositionNotification, contentType string, body io.Reader) bool {
+	switch strings.ToLower(contentType) {
+	case "message/disposition-notification", "message/global-disposition-notification":
+		{
+			data, _ := readAllLimited(body)
+			for _, block := range readHeaderBlocks(data) {
+				if messageID := block.Get("Original-Message-Id"); len(messageID) > 0 {
+					notification.originalMessageID = strings.Trim(messageID, " ")
+				}
+				if disposition := block.Get("Disposition"); len(disposition) > 0 {
+					notification.disposition = strings.ToLower(typedValue(disposition))
+				}
+			}
+		}
+	case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+		{
+			//some clients only return the headers of the email
+			data, _ := readAllLimited(body)
+			blocks := readHeaderBlocks(data)
+			if len(blocks) > 0 && len(notification.originalMessageID) == 0 {
+				notification.originalMessageID = strings.Trim(blocks[0].Get("Message-Id"), " ")
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+//handleReadReceipt reacts with ✓ to the message confirming the email which was read.
+//Returns false if the receipt doesn't belong to an email sent from the room
+func handleReadReceipt(roomID string, notification *dispositionNotification) bool {
+	sent, err := getSentMail(roomID, "", notification.originalMessageID)
+	if err != nil {
+		return false
+	}
+	//'deleted' and the like don't mean the email was read
+	if strings.Contains(notification.disposition, "displayed") {
+		if _, err := matrixClient.SendReaction(id.RoomID(roomID), id.EventID(sent.eventID), "✓"); err != nil {
+			WriteLog(logError, "#106 reacting to read receipt: "+err.Error())
+		}
+	}
+	return true
+}
+
+//buildReadReceipt creates a read receipt for an email
+func buildReadReceipt(account *smtpAccount, to *mail.Address, originalMessageID, subject string, date time.Time) ([]byte, string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	text := "Your email \"" + subject + "\""
+	if !date.IsZero() {
+		text += " from " + date.Format(time.RFC1123Z)
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte(text + " to " + account.username + " has been displayed.\r\n"))
+	qp.Close()
+
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/disposition-notification"}})
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write([]byte("Reporting-UA: Matrix-EmailBridge\r\n" +
+		"Final-Recipient: rfc822;" + account.username + "\r\n" +
+		"Original-Message-ID: " + originalMessageID + "\r\n" +
+		"Disposition: manual-action/MDN-sent-manually; displayed\r\n"))
+	w.Close()
+
+	messageID := newMessageID(account.username)
+	var raw bytes.Buffer
+	raw.WriteString("From: " + account.username + "\r\n" +
+		"To: " + to.String() + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", "Read: "+subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=disposition-notification; boundary=\"" + w.Boundary() + "\"\r\n\r\n")
+	raw.Write(body.Bytes())
+	return raw.Bytes(), messageID, nil
+}
+
+//sendReadReceipt sends the read receipt requested by a bridged email
+func sendReadReceipt(roomID string, ref *mailRef) (string, error) {
+	account, err := getSMTPAccount(roomID)
+	if err != nil {
+		return "", err
+	}
+	raw, err := fetchRawMail(roomID, ref)
+	if err != nil {
+		return "", err
+	}
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	header := mr.Header
+	receiptTo, err := header.AddressList("Disposition-Notification-To")
+	if err != nil || len(receiptTo) == 0 {
+		return "", errors.New("the sender didn't ask for a read receipt")
+	}
+	subject, _ := header.Subject()
+	date, _ := header.Date()
+
+	receipt, messageID, err := buildReadReceipt(account, receiptTo[0], header.Get("Message-Id"), subject, date)
+	if err != nil {
+		return "", err
+	}
+	outboxID, err := insertOutboxMail(roomID, account.username, receiptTo[0].Address, "Read: "+subject, messageID, receipt, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	go deliverOutboxMail(outboxID)
+	return receiptTo[0].Address, nil
+}
+
+//handleAckCommand sends a read receipt for the bridged email the message replies to
+func handleAckCommand(roomID id.RoomID, replyTo id.EventID, client *mautrix.Client) {
+	ref, err := getMailEvent(roomID.String(), replyTo.String())
+	if len(replyTo) == 0 || err != nil {
+		client.SendText(roomID, "Reply to a bridged email with "+commandPrefix()+"ack to send the read receipt its sender asked for")
+		return
+	}
+	receiver, err := sendReadReceipt(roomID.String(), ref)
+	if err != nil {
+		WriteLog(logError, "#107 sendReadReceipt: "+err.Error())
+		client.SendText(roomID, "Couldn't send the read receipt: "+err.Error())
+		return
+	}
+	client.SendText(roomID, "Read receipt queued for "+receiver)
+}
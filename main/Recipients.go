@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+//splitAddressList splits a list of recipients at commas and semicolons which aren't quoted or part of an address
+func splitAddressList(input string) []string {
+	var entries []string
+	var current strings.Builder
+	quoted, inAngle, escaped := false, false, false
+	for _, r := range input {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == '<' && !quoted:
+			inAngle = true
+		case r == '>' && !quoted:
+			inAngle = false
+		case (r == ',' || r == ';') && !quoted && !inAngle:
+			entries = append(entries, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	return append(entries, current.String())
+}
+
+//toASCIIAddress converts the domain of an internationalized email address (IDN) to punycode
+func toASCIIAddress(address string) (string, error) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", errors.New("missing @ or domain")
+	}
+	domain, err := idna.Lookup.ToASCII(address[i+1:])
+	if err != nil {
+		return "", errors.New("invalid domain: " + err.Error())
+	}
+	if !strings.Contains(domain, ".") {
+		return "", errors.New("invalid domain: " + domain)
+	}
+	return address[:i+1] + domain, nil
+}
+
+//parseAddress parses a single recipient like jane@example.com, "Doe, Jane" <jane@example.com> or a contact nickname
+func parseAddress(roomID, entry string) (*mail.Address, error) {
+	if !strings.ContainsAny(entry, "@<\" ") {
+		c, err := getContact(roomID, entry)
+		if err != nil {
+			return nil, errors.New("no email address and no contact with this nickname")
+		}
+		return &mail.Address{Name: c.name, Address: c.address}, nil
+	}
+	address, err := mail.ParseAddress(entry)
+	if err != nil {
+		return nil, err
+	}
+	address.Address, err = toASCIIAddress(address.Address)
+	if err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+//parseRecipients parses the recipients given to !write or !to. Entries are separated by commas (RFC 5322).
+//Entries which aren't a valid address get split by spaces, so 'a@example.com b@example.com' works as well.
+//Returns an error message for every invalid entry
+func parseRecipients(roomID, input string) ([]*mail.Address, []string) {
+	var recipients []*mail.Address
+	var errs []string
+	seen := map[string]bool{}
+	add := func(address *mail.Address) {
+		if !seen[strings.ToLower(address.Address)] {
+			seen[strings.ToLower(address.Address)] = true
+			recipients = append(recipients, address)
+		}
+	}
+
+	for _, entry := range splitAddressList(input) {
+		entry = strings.Trim(entry, " \t\r\n")
+		if len(entry) == 0 {
+			continue
+		}
+		address, err := parseAddress(roomID, entry)
+		if err == nil {
+			add(address)
+			continue
+		}
+		fields := strings.Fields(entry)
+		if len(fields) == 1 || strings.ContainsAny(entry, "<\"") {
+			errs = append(errs, "'"+entry+"': "+err.Error())
+			continue
+		}
+		for _, field := range fields {
+			address, err := parseAddress(roomID, field)
+			if err != nil {
+				errs = append(errs, "'"+field+"': "+err.Error())
+				continue
+			}
+			add(address)
+		}
+	}
+	if len(recipients) == 0 && len(errs) == 0 {
+		errs = append(errs, "no receiver given")
+	}
+	return recipients, errs
+}
+
+//formatRecipients formats recipients for humans
+func formatRecipients(recipients []*mail.Address) string {
+	list := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		name := recipient.Name
+		if strings.ContainsAny(name, ",;<>\"") {
+			name = `"` + strings.ReplaceAll(name, `"`, `\"`) + `"`
+		}
+		if len(name) > 0 {
+			list[i] = name + " <" + recipient.Address + ">"
+		} else {
+			list[i] = recipient.Address
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+//loadRecipients returns the recipients of an email. Emails written before recipients were saved separately get their comma separated receiver parsed
+func loadRecipients(writeTemp *emailTemp) ([]*mail.Address, error) {
+	recipients, err := getRecipients(writeTemp.pkID)
+	if err != nil || len(recipients) > 0 {
+		return recipients, err
+	}
+	for _, receiver := range strings.Split(writeTemp.receiver, ",") {
+		receiver = strings.Trim(receiver, " ")
+		if len(receiver) > 0 {
+			recipients = append(recipients, &mail.Address{Address: receiver})
+		}
+	}
+	return recipients, nil
+}
+
+//getReceivers returns the addresses an email gets sent to
+func getReceivers(writeTemp *emailTemp) []string {
+	recipients, err := loadRecipients(writeTemp)
+	if err != nil {
+		WriteLog(logError, "#102 loadRecipients: "+err.Error())
+	}
+	addresses := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		addresses[i] = recipient.Address
+	}
+	return addresses
+}
+
+//invalidRecipientsMessage tells the user which recipients couldn't be parsed
+func invalidRecipientsMessage(errs []string) string {
+	msg := "Invalid receiver"
+	if len(errs) > 1 {
+		msg += "s (" + strconv.Itoa(len(errs)) + ")"
+	}
+	return msg + ":\r\n" + strings.Join(errs, "\r\n") + "\r\n\r\nExample: " + commandPrefix() + "write jane@example.com, \"Doe, John\" <john@example.com>"
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func handlePingCommand(ctx *commandContext) {
+	roomData, err := getRoomInfo(ctx.roomID.String())
+	if err != nil {
+		WriteLog(logError, "#006 getRoomInfo: "+err.Error())
+		ctx.reply("An server-error occured")
+		return
+	}
+	ctx.reply(roomData)
+}
+
+//writeOptions are the arguments of '!write <--template name> <--receipt> <receivers> <markdown>'
+type writeOptions struct {
+	template  string
+	receipt   bool
+	receivers string
+	//markdown is nil if the receivers aren't followed by true/false
+	markdown *bool
+}
+
+//parseWriteArgs reads the options given before the receivers and the markdown flag after them
+func parseWriteArgs(args string) (*writeOptions, error) {
+	options := &writeOptions{}
+	for strings.HasPrefix(args, "--") {
+		s := strings.SplitN(args, " ", 2)
+		args = ""
+		if len(s) == 2 {
+			args = strings.Trim(s[1], " ")
+		}
+		switch s[0] {
+		case "--receipt":
+			options.receipt = true
+		case "--template":
+			{
+				s = strings.SplitN(args, " ", 2)
+				if len(s[0]) == 0 {
+					return nil, errors.New("Missing template name. Use --template <name>")
+				}
+				options.template = s[0]
+				args = ""
+				if len(s) == 2 {
+					args = strings.Trim(s[1], " ")
+				}
+			}
+		default:
+			return nil, errors.New("Unknown option " + s[0] + ". Use --template <name> or --receipt")
+		}
+	}
+
+	if s := strings.Fields(args); len(s) > 1 {
+		markdown, err := strconv.ParseBool(s[len(s)-1])
+		if err == nil {
+			options.markdown = &markdown
+			args = strings.TrimSuffix(strings.TrimRight(args, " "), s[len(s)-1])
+		}
+	}
+	options.receivers = strings.Trim(args, " ")
+	return options, nil
+}
+
+//handleWriteCommand handles '!write <--template name> <--receipt> <receivers> <markdown>'
+func handleWriteCommand(ctx *commandContext) {
+	roomID, client := ctx.roomID, ctx.client
+	options, err := parseWriteArgs(ctx.raw)
+	if err != nil {
+		client.SendText(roomID, err.Error())
+		return
+	}
+	var template *mailTemplate
+	if len(options.template) > 0 {
+		template, err = getTemplate(roomID.String(), options.template)
+		if err != nil {
+			client.SendText(roomID, "Template "+options.template+" not found. Use "+commandPrefix()+"template list to view your templates")
+			return
+		}
+	}
+	receipt, args := options.receipt, options.receivers
+
+	mrkdwn := 0
+	if (options.markdown == nil && viper.GetBool("markdownEnabledByDefault")) || (options.markdown != nil && *options.markdown) {
+		mrkdwn = 1
+	}
+	if len(args) == 0 {
+		client.SendText(roomID, "Usage: "+commandPrefix()+"write <emailaddress>")
+		return
+	}
+	recipients, errs := parseRecipients(roomID.String(), args)
+	if len(errs) > 0 {
+		client.SendText(roomID, invalidRecipientsMessage(errs))
+		return
+	}
+
+	hasTemp, err := isUserWritingEmail(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#39 isUserWritingEmail: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #39")
+		return
+	}
+	if hasTemp {
+		er := deleteWritingTemp(roomID.String())
+		if er != nil {
+			WriteLog(critical, "#40 deleteWritingTemp: "+er.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #40")
+			return
+		}
+	}
+
+	err = newWritingTemp(roomID.String(), recipients)
+	saveWritingtemp(roomID.String(), "markdown", strconv.Itoa(mrkdwn))
+	if receipt {
+		saveWritingtemp(roomID.String(), "receipt", "1")
+	}
+	if err != nil {
+		WriteLog(critical, "#42 newWritingTemp: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #42")
+		return
+	}
+	if template != nil {
+		account, err := getSMTPAccount(roomID.String())
+		if err != nil {
+			WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #52")
+			deleteWritingTemp(roomID.String())
+			return
+		}
+		saveWritingtemp(roomID.String(), "subject", fillTemplate(template.subject, roomID.String(), recipients, account.username))
+		writeTemp, err := getWritingTemp(roomID.String())
+		if err == nil {
+			err = setDraftBody(writeTemp.pkID, fillTemplate(template.body, roomID.String(), recipients, account.username))
+		}
+		if err != nil {
+			WriteLog(critical, "#89 setDraftBody: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #89")
+			deleteWritingTemp(roomID.String())
+			return
+		}
+		client.SendText(roomID, "Email to "+formatRecipients(recipients)+" created from template "+template.name+". You can add more lines or enter "+commandPrefix()+"send or "+commandPrefix()+"cancel")
+		return
+	}
+	client.SendText(roomID, "Writing an email to "+formatRecipients(recipients)+"\r\nNow send me the subject of your email")
+}
+
+func handleSetMailboxCommand(ctx *commandContext) {
+	if len(ctx.args) != 1 {
+		ctx.reply(ctx.usage())
+		return
+	}
+	roomID := ctx.roomID.String()
+	saveMailbox(roomID, ctx.args[0])
+	deleteMails(roomID)
+	stopMailChecker(roomID)
+	imapAccount, err := getIMAPAccount(roomID)
+	if err != nil {
+		WriteLog(critical, "#49 getIMAPAccount: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #49")
+		return
+	}
+	imapAccount.silence = true
+	go startMailListener(*imapAccount)
+	ctx.reply("Mailbox updated")
+}
+
+func handleSetSentFolderCommand(ctx *commandContext) {
+	sentFolder := ctx.raw
+	if strings.ToLower(sentFolder) == "auto" {
+		sentFolder = ""
+	}
+	err := saveSentFolder(ctx.roomID.String(), sentFolder)
+	if err != nil {
+		WriteLog(critical, "#69 saveSentFolder: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #69")
+		return
+	}
+	ctx.reply("Sent folder updated")
+}
+
+func handleTestCommand(ctx *commandContext) {
+	if strings.ToLower(ctx.args[0]) != "smtp" {
+		ctx.reply(ctx.usage())
+		return
+	}
+	go sendTestMail(ctx.roomID, ctx.client)
+}
+
+func handleSetHTMLCommand(ctx *commandContext) {
+	if len(ctx.args) != 1 {
+		ctx.reply(ctx.usage())
+		return
+	}
+	newMode := strings.ToLower(ctx.args[0])
+	newModeB := false
+	if newMode == "true" || newMode == "on" {
+		newModeB = true
+	} else if newMode != "false" && newMode != "off" {
+		ctx.reply("What?\r\non/off or true/false")
+		return
+	}
+	err := setHTMLenabled(ctx.roomID.String(), newModeB)
+	if err != nil {
+		WriteLog(critical, "#56 getMailbox: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #56")
+		return
+	}
+	ctx.reply("Successfully set HTML-rendering to " + newMode)
+}
+
+func handleLogoutCommand(ctx *commandContext) {
+	err := logOut(ctx.client, ctx.roomID.String(), false)
+	if err != nil {
+		ctx.reply("Error logging out: " + err.Error())
+	} else {
+		ctx.reply("Successfully logged out")
+	}
+}
+
+func handleLeaveCommand(ctx *commandContext) {
+	err := logOut(ctx.client, ctx.roomID.String(), true)
+	if err != nil {
+		ctx.reply("Error leaving: " + err.Error())
+	} else {
+		ctx.reply("Successfully unbridged")
+	}
+}
+
+func handleSetTimezoneCommand(ctx *commandContext) {
+	timezone := ctx.args[0]
+	if _, err := time.LoadLocation(timezone); err != nil {
+		ctx.reply("Unknown timezone: " + timezone)
+		return
+	}
+	err := saveRoomTimezone(ctx.roomID.String(), timezone)
+	if err != nil {
+		WriteLog(critical, "#77 saveRoomTimezone: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #77")
+		return
+	}
+	ctx.reply("Timezone set to " + timezone)
+}
+
+func handleSetUndoCommand(ctx *commandContext) {
+	if len(ctx.args) != 1 {
+		ctx.reply(ctx.usage() + " (0 disables the undo window)")
+		return
+	}
+	undoDelay, err := strconv.Atoi(ctx.args[0])
+	if err != nil || undoDelay < 0 {
+		ctx.reply("The delay must be a positive number!")
+		return
+	}
+	err = saveUndoDelay(ctx.roomID.String(), undoDelay)
+	if err != nil {
+		WriteLog(critical, "#78 saveUndoDelay: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #78")
+		return
+	}
+	ctx.reply("Undo window set to " + strconv.Itoa(undoDelay) + " seconds")
+}
+
+//handleBlocklistCommand handles '!blocklist <add/delete/clear/view> <email address>'
+func handleBlocklistCommand(ctx *commandContext) {
+	roomID, client := ctx.roomID, ctx.client
+	imapAccID, _, _ := getRoomAccounts(roomID.String())
+	sm := ctx.args
+	if len(sm) < 2 {
+		if len(sm) == 1 && (sm[0] == "view" || sm[0] == "list") {
+			viewBlocklist(roomID.String(), client)
+		} else if len(sm) == 1 && sm[0] == "clear" {
+			//clearing removes every entry at once, adding and removing single addresses is allowed to everyone
+			if !hasPermission(roomID, ctx.evt.Sender, permManage) {
+				client.SendText(roomID, permissionDenied(roomID, ctx.cmd))
+				return
+			}
+			err := clearBlocklist(imapAccID)
+			var msg string
+			if err != nil {
+				fmt.Println("Err:", err.Error())
+				msg = "Error clearing blocklist! View logs for more details!"
+			} else {
+				msg = "Blocklist is now clean!"
+			}
+			client.SendText(roomID, msg)
+		} else {
+			client.SendText(roomID, ctx.usage()+"\nDon't show any emails from a given email address.\nWildcards (like *@evilEmailAddress.com) are supported")
+		}
+		return
+	}
+	cmd := strings.ToLower(sm[0])
+	addr := sm[1]
+	if !strings.Contains(addr, "@") || !strings.Contains(addr, ".") || len(addr) < 6 {
+		client.SendText(roomID, "Error! "+addr+" is an invalid email address!")
+		return
+	}
+	switch cmd {
+	case "add":
+		{
+			//add item to blocklis
+			err := addEmailToBlocklist(imapAccID, addr)
+			var msg string
+			if err != nil {
+				fmt.Println("Err:", err.Error())
+				msg = "Error adding " + addr + " to blocklist! View logs for more details!"
+			} else {
+				msg = "Success adding " + addr + " to blocklist!"
+			}
+			client.SendText(roomID, msg)
+		}
+	case "remove", "delete", "rm":
+		{
+			err := removeEmailFromBlocklist(imapAccID, addr)
+			var msg string
+			if err != nil {
+				fmt.Println("Err:", err.Error())
+				msg = "Error deleting " + addr + " from blocklist! View logs for more details!"
+			} else {
+				msg = "Success deleting " + addr + " from blocklist!"
+			}
+			client.SendText(roomID, msg)
+		}
+	default:
+		client.SendText(roomID, ctx.usage())
+	}
+}
+
+func handleViewCommand(ctx *commandContext) {
+	roomID, client := ctx.roomID.String(), ctx.client
+	if len(ctx.args) == 0 {
+		viewViewHelp(roomID, client)
+		return
+	}
+	switch strings.ToLower(ctx.args[0]) {
+	case "mb", "mailbox":
+		viewMailbox(roomID, client)
+	case "mbs", "mailboxes":
+		viewMailboxes(roomID, client)
+	case "sf", "sentfolder":
+		viewSentFolder(roomID, client)
+	case "blocklist", "bl", "blocklists", "blo", "blocked":
+		viewBlocklist(roomID, client)
+	default:
+		viewViewHelp(roomID, client)
+	}
+}
+
+//handleVerifyCommand passes the answer of the user to the verification of its device
+func handleVerifyCommand(ctx *commandContext) {
+	answer := strings.ToLower(ctx.args[0])
+	if answer != "yes" && answer != "no" {
+		ctx.reply(ctx.usage())
+		return
+	}
+	if !answerVerification(ctx.roomID, ctx.evt.Sender, answer == "yes") {
+		ctx.reply("There is no verification waiting for you in this room")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//roomStateStore keeps the encryption settings and the members of the rooms in the db.
+//The olm machine needs them to know which rooms to encrypt and whom to share the keys with
+type roomStateStore struct{}
+
+func (roomStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return roomStateStore{}.GetEncryptionEvent(roomID) != nil
+}
+
+func (roomStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	content, err := getRoomEncryption(roomID.String())
+	if err != nil {
+		WriteLog(logError, "#108 getRoomEncryption: "+err.Error())
+		return nil
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	var encryption event.EncryptionEventContent
+	if err := json.Unmarshal([]byte(content), &encryption); err != nil {
+		return nil
+	}
+	return &encryption
+}
+
+func (roomStateStore) FindSharedRooms(userID id.UserID) []id.RoomID {
+	rooms, err := getEncryptedRoomsOfUser(userID.String())
+	if err != nil {
+		WriteLog(logError, "#109 getEncryptedRoomsOfUser: "+err.Error())
+		return nil
+	}
+	roomIDs := make([]id.RoomID, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = id.RoomID(room)
+	}
+	return roomIDs
+}
+
+//getJoinedMembers returns the users the keys of an encrypted room have to be shared with
+func getJoinedMembers(roomID id.RoomID) []id.UserID {
+	members, err := getRoomMembers(roomID.String())
+	if err != nil {
+		WriteLog(logError, "#110 getRoomMembers: "+err.Error())
+		return nil
+	}
+	userIDs := make([]id.UserID, len(members))
+	for i, member := range members {
+		userIDs[i] = id.UserID(member)
+	}
+	return userIDs
+}
+
+//trackRoomState saves m.room.encryption and m.room.member events
+func trackRoomState(evt *event.Event) {
+	var err error
+	switch evt.Type {
+	case event.StateEncryption:
+		err = setRoomEncryption(evt.RoomID.String(), string(evt.Content.VeryRaw))
+	case event.StateMember:
+		err = setRoomMember(evt.RoomID.String(), evt.GetStateKey(), string(evt.Content.AsMember().Membership))
+	}
+	if err != nil {
+		WriteLog(logError, "#111 trackRoomState: "+err.Error())
+	}
+}
+
+//loadRoomState fetches the encryption and the members of a room the bot just joined
+func loadRoomState(client *mautrix.Client, roomID id.RoomID) {
+	var encryption event.EncryptionEventContent
+	if err := client.StateEvent(roomID, event.StateEncryption, "", &encryption); err == nil {
+		content, _ := json.Marshal(&encryption)
+		if err := setRoomEncryption(roomID.String(), string(content)); err != nil {
+			WriteLog(logError, "#111 trackRoomState: "+err.Error())
+		}
+	}
+	members, err := client.JoinedMembers(roomID)
+	if err != nil {
+		WriteLog(warn, "Couldn't load the members of "+roomID.String()+": "+err.Error())
+		return
+	}
+	for userID := range members.Joined {
+		if err := setRoomMember(roomID.String(), userID.String(), string(event.MembershipJoin)); err != nil {
+			WriteLog(logError, "#111 trackRoomState: "+err.Error())
+		}
+	}
+}
+
+//checkRoomEncryption tells the users of an encrypted room if the bridge can't read their messages.
+//Returns false if the bridge refused the room and left it
+func checkRoomEncryption(client *mautrix.Client, roomID id.RoomID) bool {
+	if !(roomStateStore{}).IsEncrypted(roomID) || encryptionSupported(roomID) {
+		return true
+	}
+	if viper.GetBool("refuseUnsupportedEncryption") {
+		client.SendText(roomID, "This room is end-to-end encrypted, but this bridge can't handle its encryption. Leaving the room. Create an unencrypted room to bridge your emails")
+		if err := logOut(client, roomID.String(), true); err == nil {
+			WriteLog(info, "Left "+roomID.String()+" because its encryption isn't supported")
+		}
+		return false
+	}
+	client.SendText(roomID, "Warning: this room is end-to-end encrypted, but this bridge can't handle its encryption. It won't be able to read your messages")
+	return true
+}
+
+//createLinkedRoom creates a room for the members of a bridged room, eg. a conversation or a folder.
+//If encrypt is set, the room gets the encryption of the bridged room
+func createLinkedRoom(parentRoomID string, req *mautrix.ReqCreateRoom, encrypt bool) (id.RoomID, error) {
+	for _, member := range getJoinedMembers(id.RoomID(parentRoomID)) {
+		if member != matrixClient.UserID && !isGhost(member) {
+			req.Invite = append(req.Invite, member)
+		}
+	}
+	var encryption *event.EncryptionEventContent
+	if encrypt {
+		encryption = roomStateStore{}.GetEncryptionEvent(id.RoomID(parentRoomID))
+	}
+	if encryption != nil {
+		stateKey := ""
+		req.InitialState = append(req.InitialState, &event.Event{Type: event.StateEncryption, StateKey: &stateKey, Content: event.Content{Parsed: encryption}})
+	}
+	resp, err := matrixClient.CreateRoom(req)
+	if err != nil {
+		return "", err
+	}
+
+	//the first messages are sent before the sync brings the state of the room
+	if encryption != nil {
+		content, _ := json.Marshal(encryption)
+		setRoomEncryption(resp.RoomID.String(), string(content))
+	}
+	setRoomMember(resp.RoomID.String(), matrixClient.UserID.String(), string(event.MembershipJoin))
+	for _, userID := range req.Invite {
+		setRoomMember(resp.RoomID.String(), userID.String(), string(event.MembershipInvite))
+	}
+	return resp.RoomID, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomarkdown/markdown"
+	"gopkg.in/gomail.v2"
+	"maunium.net/go/mautrix/id"
+)
+
+//size limits of the smtp servers by host and port
+var sizeLimits = map[string]int64{}
+
+var sizeLimitMutex sync.Mutex
+
+//getSMTPSizeLimit returns the maximum email size announced by the smtp server (SIZE extension).
+//Returns 0 if the server has no limit or the email is delivered locally
+func getSMTPSizeLimit(account *smtpAccount) (int64, error) {
+	if smtpTransport(account) != transportSMTP {
+		return 0, nil
+	}
+	addr := account.host + ":" + strconv.Itoa(account.port)
+	sizeLimitMutex.Lock()
+	defer sizeLimitMutex.Unlock()
+	if limit, ok := sizeLimits[addr]; ok {
+		return limit, nil
+	}
+
+	c, err := dialSMTP(account)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var limit int64
+	if ok, param := c.Extension("SIZE"); ok && len(strings.Fields(param)) > 0 {
+		limit, _ = strconv.ParseInt(strings.Fields(param)[0], 10, 64)
+	}
+	c.Quit()
+	sizeLimits[addr] = limit
+	return limit, nil
+}
+
+//isPermanentSMTPError returns true if the server rejected the email with a 5xx reply.
+//4xx replies and network errors are temporary and worth a retry
+func isPermanentSMTPError(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 500 && tpErr.Code < 600
+	}
+	return false
+}
+
+//renderBody returns the html and the plain text part of an email. The html part is empty if markdown is disabled.
+//It's made of the formatted bodies of the messages. The plain text part gets converted from it
+func renderBody(roomID string, writeTemp *emailTemp) (htmlBody, plainBody string) {
+	signature := getSignature(roomID)
+	if !writeTemp.markdown {
+		return "", appendSignature(writeTemp.body, signature)
+	}
+
+	lines, err := loadDraftLines(writeTemp)
+	if err != nil {
+		WriteLog(logError, "#90 loadDraftLines: "+err.Error())
+		lines = toDraftLines(writeTemp.body)
+	}
+	var sb strings.Builder
+	for _, line := range lines {
+		lineHTML := line.html
+		if len(lineHTML) == 0 {
+			lineHTML = textToHTML(line.line)
+		}
+		if len(strings.Trim(lineHTML, " ")) == 0 {
+			lineHTML = "<br>"
+		}
+		sb.WriteString("<div>" + lineHTML + "</div>\r\n")
+	}
+	bodyHTML := sanitizeHTML(sb.String())
+	plainBody = appendSignature(htmlToText(bodyHTML), signature)
+
+	if len(strings.Trim(signature, " ")) > 0 {
+		signatureHTML := sanitizeHTML(string(markdown.ToHTML([]byte(signature), nil, nil)))
+		bodyHTML += "<div><br></div>\r\n<div>-- <br>" + signatureHTML + "</div>\r\n"
+	}
+	return bodyHTML, plainBody
+}
+
+//buildMail creates the email for a writing temp
+func buildMail(roomID id.RoomID, writeTemp *emailTemp, account *smtpAccount) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", account.username)
+	recipients, err := loadRecipients(writeTemp)
+	if err != nil {
+		WriteLog(logError, "#102 loadRecipients: "+err.Error())
+	}
+	to := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		to[i] = m.FormatAddress(recipient.Address, recipient.Name)
+	}
+	m.SetHeader("To", to...)
+	m.SetHeader("Subject", writeTemp.subject)
+	if writeTemp.receipt {
+		m.SetHeader("Disposition-Notification-To", account.username)
+	}
+
+	htmlBody, plainBody := renderBody(string(roomID), writeTemp)
+	//the last alternative is the preferred one, so the html part goes after the plain text
+	m.SetBody("text/plain", plainBody)
+	if len(htmlBody) > 0 {
+		m.AddAlternative("text/html", htmlBody)
+	}
+
+	attachments, err := getAttachments(writeTemp.pkID)
+	if err == nil {
+		for _, i := range attachments {
+			contentType := mime.FormatMediaType(i.mimeType, map[string]string{"name": i.name})
+			if len(contentType) == 0 {
+				contentType = "application/octet-stream"
+			}
+			m.Attach(tempDir+i.fileName, gomail.Rename(i.name), gomail.SetHeader(map[string][]string{"Content-Type": {contentType}}))
+		}
+	} else {
+		WriteLog(logError, "#88 getAttachments: "+err.Error())
+	}
+	return m
+}
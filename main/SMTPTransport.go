@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+//connection security of an smtp account. Empty means implicit TLS on port 465 and opportunistic STARTTLS otherwise
+const (
+	securityTLS           = "tls"
+	securitySTARTTLS      = "starttls"
+	securityOpportunistic = "opportunistic"
+	securityNone          = "none"
+)
+
+//sasl mechanisms. Empty means the mechanism gets picked from the ones the server offers
+const (
+	authPlain   = "plain"
+	authLogin   = "login"
+	authCRAMMD5 = "cram-md5"
+	authNone    = "none"
+)
+
+//ways to deliver an email. Empty means smtp.
+//sendmail and lmtp only work if the admin set 'sendmailPath' or 'lmtpSocket' in the config
+const (
+	transportSMTP     = "smtp"
+	transportSendmail = "sendmail"
+	transportLMTP     = "lmtp"
+)
+
+var securityOptions = []string{"auto", securityTLS, securitySTARTTLS, securityOpportunistic, securityNone}
+
+var authOptions = []string{"auto", authPlain, authLogin, authCRAMMD5, authNone}
+
+var transportOptions = []string{transportSMTP, transportSendmail, transportLMTP}
+
+const smtpTimeout = 10 * time.Second
+
+//smtpSecurity returns the connection security used for an account
+func smtpSecurity(account *smtpAccount) string {
+	if len(account.security) > 0 {
+		return account.security
+	}
+	if account.port == 465 {
+		return securityTLS
+	}
+	return securityOpportunistic
+}
+
+//smtpTransport returns the transport used for an account
+func smtpTransport(account *smtpAccount) string {
+	if len(account.transport) == 0 {
+		return transportSMTP
+	}
+	return account.transport
+}
+
+//isTransportAvailable returns false if sendmail or lmtp wasn't configured by the admin
+func isTransportAvailable(transport string) bool {
+	switch transport {
+	case transportSendmail:
+		return len(viper.GetString("sendmailPath")) > 0
+	case transportLMTP:
+		return len(viper.GetString("lmtpSocket")) > 0
+	}
+	return transport == transportSMTP
+}
+
+//checkTransport returns an error if the user can't send with the transport. sendmail and lmtp don't log in,
+//so they could send emails with any sender address. Only admins of the bridge may set them up
+func checkTransport(transport string, userID id.UserID) error {
+	if !isTransportAvailable(transport) {
+		return errors.New("The transport " + transport + " isn't configured on this bridge. Ask your admin to set it up")
+	}
+	if transport != transportSMTP && !isAdmin(userID) {
+		return errors.New("Only admins of the bridge can use the transport " + transport)
+	}
+	return nil
+}
+
+func smtpTLSConfig(account *smtpAccount) *tls.Config {
+	return &tls.Config{ServerName: account.host, InsecureSkipVerify: account.ignoreSSL}
+}
+
+//dialSMTP connects to the smtp server of an account and secures the connection as configured.
+//The client isn't authenticated yet. Errors tell which step failed
+func dialSMTP(account *smtpAccount) (*smtp.Client, error) {
+	addr := account.host + ":" + strconv.Itoa(account.port)
+	security := smtpSecurity(account)
+
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	if security == securityTLS {
+		tlsConn := tls.Client(conn, smtpTLSConfig(account))
+		tlsConn.SetDeadline(time.Now().Add(smtpTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	c, err := smtp.NewClient(conn, account.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("greeting: %w", err)
+	}
+	if err := c.Hello(localHostname()); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("EHLO: %w", err)
+	}
+
+	if security == securitySTARTTLS || security == securityOpportunistic {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && security == securitySTARTTLS {
+			c.Close()
+			return nil, errors.New("STARTTLS: the server doesn't support STARTTLS")
+		}
+		if ok {
+			if err := c.StartTLS(smtpTLSConfig(account)); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("STARTTLS: %w", err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		return "localhost"
+	}
+	return hostname
+}
+
+//smtpAuth returns the sasl mechanism used to log in and its name. Returns nil if no authentication is needed
+func smtpAuth(c *smtp.Client, account *smtpAccount) (smtp.Auth, string, error) {
+	if account.authMech == authNone {
+		return nil, "", nil
+	}
+	ok, mechanisms := c.Extension("AUTH")
+	offered := map[string]bool{}
+	for _, mechanism := range strings.Fields(strings.ToUpper(mechanisms)) {
+		offered[mechanism] = true
+	}
+
+	mechanism := account.authMech
+	if len(mechanism) == 0 {
+		//same order gomail uses
+		if !ok {
+			return nil, "", nil
+		}
+		switch {
+		case offered["CRAM-MD5"]:
+			mechanism = authCRAMMD5
+		case offered["LOGIN"] && !offered["PLAIN"]:
+			mechanism = authLogin
+		default:
+			mechanism = authPlain
+		}
+	} else if !offered[strings.ToUpper(mechanism)] {
+		return nil, "", errors.New("the server doesn't offer " + strings.ToUpper(mechanism) + " authentication")
+	}
+
+	switch mechanism {
+	case authCRAMMD5:
+		return smtp.CRAMMD5Auth(account.username, account.password), mechanism, nil
+	case authLogin:
+		return &loginAuth{account.username, account.password, account.host}, mechanism, nil
+	default:
+		return smtp.PlainAuth("", account.username, account.password, account.host), authPlain, nil
+	}
+}
+
+//loginAuth implements the LOGIN mechanism, which isn't part of net/smtp
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	//like PLAIN, credentials are only sent over encrypted connections
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username", "user":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected server challenge: " + string(fromServer))
+}
+
+//loginSMTP authenticates a client. Returns the mechanism used or an empty string if the server didn't need a login
+func loginSMTP(c *smtp.Client, account *smtpAccount) (string, error) {
+	auth, mechanism, err := smtpAuth(c, account)
+	if err != nil {
+		return "", fmt.Errorf("authentication: %w", err)
+	}
+	if auth == nil {
+		return "", nil
+	}
+	if err := c.Auth(auth); err != nil {
+		return mechanism, fmt.Errorf("authentication (%s): %w", strings.ToUpper(mechanism), err)
+	}
+	return mechanism, nil
+}
+
+//connectSMTP connects and logs in to the smtp server of an account
+func connectSMTP(account *smtpAccount) (*smtp.Client, error) {
+	c, err := dialSMTP(account)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := loginSMTP(c, account); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//extensions shown after checking an smtp account
+var smtpExtensions = []string{"STARTTLS", "AUTH", "SIZE", "8BITMIME", "SMTPUTF8", "PIPELINING", "CHUNKING", "DSN", "ENHANCEDSTATUSCODES"}
+
+//checkSMTPAccount connects and logs in like sending an email does, to find wrong data before it gets saved.
+//Returns a description of the server
+func checkSMTPAccount(account *smtpAccount) (string, error) {
+	switch smtpTransport(account) {
+	case transportSendmail:
+		{
+			path := viper.GetString("sendmailPath")
+			stat, err := os.Stat(path)
+			if err != nil {
+				return "", err
+			}
+			if stat.IsDir() || stat.Mode()&0111 == 0 {
+				return "", errors.New(path + " isn't executable")
+			}
+			return "Emails are delivered by sendmail (" + path + ")", nil
+		}
+	case transportLMTP:
+		{
+			conn, err := net.DialTimeout("unix", viper.GetString("lmtpSocket"), smtpTimeout)
+			if err != nil {
+				return "", err
+			}
+			conn.Close()
+			return "Emails are delivered by LMTP", nil
+		}
+	}
+
+	c, err := dialSMTP(account)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	mechanism, err := loginSMTP(c, account)
+	if err != nil {
+		return "", err
+	}
+
+	description := "Connection: unencrypted"
+	if _, ok := c.TLSConnectionState(); ok {
+		description = "Connection: STARTTLS"
+		if smtpSecurity(account) == securityTLS {
+			description = "Connection: implicit TLS"
+		}
+	}
+	if len(mechanism) > 0 {
+		description += "\r\nLogin: " + strings.ToUpper(mechanism)
+	} else {
+		description += "\r\nLogin: none"
+	}
+	var capabilities []string
+	for _, extension := range smtpExtensions {
+		if ok, param := c.Extension(extension); ok {
+			capabilities = append(capabilities, strings.Trim(extension+" "+param, " "))
+		}
+	}
+	if len(capabilities) > 0 {
+		description += "\r\nServer capabilities: " + strings.Join(capabilities, ", ")
+	}
+	c.Quit()
+	return description, nil
+}
+
+//sendTestMail sends an email to the smtp account itself, without going through the outbox
+func sendTestMail(roomID id.RoomID, client *mautrix.Client) {
+	account, err := getSMTPAccount(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #52")
+		return
+	}
+	m := gomail.NewMessage()
+	m.SetHeader("From", account.username)
+	m.SetHeader("To", account.username)
+	m.SetHeader("Subject", "Test email from your Matrix email bridge")
+	m.SetBody("text/plain", "This email was sent with "+commandPrefix()+"test smtp from the Matrix room "+roomID.String()+".\r\nYour SMTP settings work.")
+	client.SendText(roomID, "Sending a test email to "+account.username+"...")
+	err = sendRawMail(account, account.username, []string{account.username}, m, "")
+	if err != nil {
+		WriteLog(info, "test email of "+account.username+" failed: "+err.Error())
+		client.SendText(roomID, "Sending the test email failed: "+err.Error())
+		return
+	}
+	client.SendText(roomID, "Test email sent to "+account.username+". Check your inbox!")
+}
+
+//sendRawMail sends an already rendered email using the transport of the given account.
+//If envelopeID isn't empty and the smtp server supports it, failed and delayed deliveries get reported (DSN, RFC 3461)
+func sendRawMail(account *smtpAccount, from string, to []string, msg io.WriterTo, envelopeID string) error {
+	transport := smtpTransport(account)
+	if !isTransportAvailable(transport) {
+		return errors.New("the transport " + transport + " isn't configured on this bridge")
+	}
+	for _, address := range append([]string{from}, to...) {
+		if err := checkEnvelopeAddress(address); err != nil {
+			return err
+		}
+	}
+	switch transport {
+	case transportSendmail:
+		return sendmailSend(viper.GetString("sendmailPath"), from, to, msg)
+	case transportLMTP:
+		return lmtpSend(viper.GetString("lmtpSocket"), from, to, msg)
+	}
+
+	c, err := connectSMTP(account)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("DSN"); ok && len(envelopeID) > 0 {
+		err = sendEnvelopeDSN(c, from, to, envelopeID)
+	} else {
+		err = sendEnvelope(c, from, to)
+	}
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func sendEnvelope(c *smtp.Client, from string, to []string) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, receiver := range to {
+		if err := c.Rcpt(receiver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkEnvelopeAddress refuses addresses which would end the MAIL or RCPT command early.
+//Those commands are written by hand for DSN and LMTP, there is no check of net/smtp
+func checkEnvelopeAddress(address string) error {
+	if strings.ContainsAny(address, "\r\n<>") {
+		return &textproto.Error{Code: 501, Msg: "invalid address " + strconv.Quote(address)}
+	}
+	return nil
+}
+
+//sendEnvelopeDSN sends MAIL and RCPT with the DSN parameters. Only the headers of the email are returned in a bounce
+func sendEnvelopeDSN(c *smtp.Client, from string, to []string, envelopeID string) error {
+	params := " RET=HDRS ENVID=" + xtext(envelopeID)
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		params += " SMTPUTF8"
+	}
+	if err := textCmd(c.Text, 250, "MAIL FROM:<%s>%s", from, params); err != nil {
+		return err
+	}
+	for _, receiver := range to {
+		if err := textCmd(c.Text, 25, "RCPT TO:<%s> NOTIFY=FAILURE,DELAY ORCPT=rfc822;%s", receiver, xtext(receiver)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//xtext encodes a DSN parameter (RFC 3461)
+func xtext(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if b < 33 || b > 126 || b == '+' || b == '=' {
+			sb.WriteString(fmt.Sprintf("+%02X", b))
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+//textCmd sends a command and reads its reply
+func textCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	cmdID, err := text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(cmdID)
+	defer text.EndResponse(cmdID)
+	_, _, err = text.ReadResponse(expectCode)
+	return err
+}
+
+//sendmailSend pipes an email into a sendmail compatible binary
+func sendmailSend(path, from string, to []string, msg io.WriterTo) error {
+	var stdin bytes.Buffer
+	if _, err := msg.WriteTo(&stdin); err != nil {
+		return err
+	}
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = &stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	msgText := "sendmail exited with " + strconv.Itoa(exitErr.ExitCode())
+	if output := strings.Trim(stderr.String(), " \r\n"); len(output) > 0 {
+		msgText += ": " + output
+	}
+	switch exitErr.ExitCode() {
+	//EX_OSERR, EX_IOERR and EX_TEMPFAIL are worth a retry
+	case 71, 74, 75:
+		return errors.New(msgText)
+	}
+	return &textproto.Error{Code: 554, Msg: msgText}
+}
+
+//lmtpSend delivers an email to an LMTP server listening on a unix socket (RFC 2033)
+func lmtpSend(socket, from string, to []string, msg io.WriterTo) error {
+	conn, err := net.DialTimeout("unix", socket, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return err
+	}
+	if err := textCmd(text, 250, "LHLO %s", localHostname()); err != nil {
+		return err
+	}
+	if err := textCmd(text, 250, "MAIL FROM:<%s>", from); err != nil {
+		return err
+	}
+	for _, receiver := range to {
+		if err := textCmd(text, 25, "RCPT TO:<%s>", receiver); err != nil {
+			return err
+		}
+	}
+	if err := textCmd(text, 354, "DATA"); err != nil {
+		return err
+	}
+	w := text.DotWriter()
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	//LMTP replies once for every receiver
+	var firstErr error
+	for range to {
+		if _, _, err := text.ReadResponse(250); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	textCmd(text, 221, "QUIT")
+	return firstErr
+}
+
+//viewSMTPSettings shows how the emails of a room get delivered
+func viewSMTPSettings(roomID id.RoomID, account *smtpAccount, client *mautrix.Client) {
+	security, auth := account.security, account.authMech
+	if len(security) == 0 {
+		security = "auto (" + smtpSecurity(account) + ")"
+	}
+	if len(auth) == 0 {
+		auth = "auto"
+	}
+	client.SendText(roomID, "SMTP settings:\r\n"+
+		"security: "+security+"\r\n"+
+		"auth: "+auth+"\r\n"+
+		"transport: "+smtpTransport(account)+"\r\n\r\n"+
+		"Use "+commandPrefix()+"setsmtp <security/auth/transport> <value> to change them")
+}
+
+//handleSetSMTPCommand handles '!setsmtp <security/auth/transport> <value>'
+func handleSetSMTPCommand(roomID id.RoomID, sender id.UserID, args []string, client *mautrix.Client) {
+	account, err := getSMTPAccount(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #52")
+		return
+	}
+	if len(args) == 0 {
+		viewSMTPSettings(roomID, account, client)
+		return
+	}
+	if len(args) != 2 {
+		client.SendText(roomID, "Usage: "+commandPrefix()+"setsmtp <security/auth/transport> <value>\r\n"+
+			"security: "+strings.Join(securityOptions, ", ")+"\r\n"+
+			"auth: "+strings.Join(authOptions, ", ")+"\r\n"+
+			"transport: "+strings.Join(transportOptions, ", "))
+		return
+	}
+	setting, value := strings.ToLower(args[0]), strings.ToLower(args[1])
+	var options []string
+	switch setting {
+	case "security":
+		options = securityOptions
+	case "auth":
+		options = authOptions
+	case "transport":
+		options = transportOptions
+	default:
+		client.SendText(roomID, "Unknown setting "+setting+". Use security, auth or transport")
+		return
+	}
+	if !contains(options, value) {
+		client.SendText(roomID, "Invalid "+setting+". Use one of: "+strings.Join(options, ", "))
+		return
+	}
+	if setting == "transport" {
+		if err := checkTransport(value, sender); err != nil {
+			client.SendText(roomID, err.Error())
+			return
+		}
+	}
+	if value == "auto" {
+		value = ""
+	}
+	err = saveSMTPSetting(roomID.String(), setting, value)
+	if err != nil {
+		WriteLog(critical, "#103 saveSMTPSetting: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #103")
+		return
+	}
+	//the size limit depends on the connection
+	sizeLimitMutex.Lock()
+	delete(sizeLimits, account.host+":"+strconv.Itoa(account.port))
+	sizeLimitMutex.Unlock()
+	client.SendText(roomID, "SMTP "+setting+" updated")
+}
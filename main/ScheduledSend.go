@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const scheduleTimeLayout = "2006-01-02 15:04 MST"
+
+//layouts accepted by !send at
+var sendTimeLayouts = []string{"2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+//prevents sending a scheduled email while it gets undone
+var draftMutex sync.Mutex
+
+//getRoomLocation returns the timezone of a room. Uses the local timezone if none is set
+func getRoomLocation(roomID string) *time.Location {
+	timezone, err := getRoomTimezone(roomID)
+	if err != nil || len(timezone) == 0 {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		WriteLog(warn, "invalid timezone "+timezone+" for room "+roomID)
+		return time.Local
+	}
+	return loc
+}
+
+//parseDelay parses a duration like 2h or 1h30m. Days (2d or 1d12h) are supported as well
+func parseDelay(value string) (time.Duration, error) {
+	var delay time.Duration
+	if i := strings.Index(value, "d"); i > 0 {
+		days, err := strconv.Atoi(value[:i])
+		if err != nil {
+			return 0, errors.New("Couldn't parse '" + value + "'")
+		}
+		delay = time.Duration(days) * 24 * time.Hour
+		value = value[i+1:]
+	}
+	if len(value) > 0 {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, errors.New("Couldn't parse '" + value + "'")
+		}
+		delay += d
+	}
+	return delay, nil
+}
+
+//parseSendTime parses the arguments of '!send at <time>' and '!send in <duration>'
+func parseSendTime(args string, loc *time.Location, now time.Time) (time.Time, error) {
+	args = strings.Trim(args, " ")
+	if strings.HasPrefix(args, "in ") {
+		delay, err := parseDelay(strings.Trim(args[3:], " "))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if delay <= 0 {
+			return time.Time{}, errors.New("The delay must be positive")
+		}
+		return now.Add(delay), nil
+	}
+
+	if strings.HasPrefix(args, "at ") {
+		value := strings.Trim(args[3:], " ")
+		if t, err := time.ParseInLocation("15:04", value, loc); err == nil {
+			local := now.In(loc)
+			sendAt := time.Date(local.Year(), local.Month(), local.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+			if !sendAt.After(now) {
+				sendAt = sendAt.AddDate(0, 0, 1)
+			}
+			return sendAt, nil
+		}
+		for _, layout := range sendTimeLayouts {
+			if sendAt, err := time.ParseInLocation(layout, value, loc); err == nil {
+				if !sendAt.After(now) {
+					return time.Time{}, errors.New(value + " is in the past")
+				}
+				return sendAt, nil
+			}
+		}
+		return time.Time{}, errors.New("Couldn't parse '" + value + "'")
+	}
+	return time.Time{}, errors.New("What? Use 'at' or 'in'")
+}
+
+//scheduleDraft sends the email currently written at the given time. undoable is set if it only waits for the undo delay
+func scheduleDraft(writeTemp *emailTemp, sendAt time.Time, undoable bool) error {
+	err := scheduleWritingTemp(writeTemp.pkID, sendAt.Unix(), undoable)
+	if err != nil {
+		return err
+	}
+	pkID := writeTemp.pkID
+	time.AfterFunc(time.Until(sendAt), func() {
+		sendScheduledDraft(pkID)
+	})
+	return nil
+}
+
+func sendScheduledDraft(pkID int) {
+	draftMutex.Lock()
+	defer draftMutex.Unlock()
+
+	writeTemp, err := getWritingTempByID(pkID)
+	if err != nil {
+		//canceled or already sent
+		return
+	}
+	if writeTemp.sendAt == 0 || writeTemp.sendAt > time.Now().Unix() {
+		return
+	}
+	sendDraft(id.RoomID(writeTemp.roomID), writeTemp)
+}
+
+//processScheduledDrafts sends all due emails, even if they were scheduled before a restart
+func processScheduledDrafts() {
+	temps, err := getDueWritingTemps(time.Now().Unix())
+	if err != nil {
+		WriteLog(critical, "#79 getDueWritingTemps: "+err.Error())
+		return
+	}
+	for _, temp := range temps {
+		sendScheduledDraft(temp.pkID)
+	}
+}
+
+//undoSend cancels the email sent last if it still waits for the undo delay. It gets restored to be written again.
+//Emails scheduled with !send at/in are canceled with !scheduled cancel instead
+func undoSend(roomID id.RoomID, client *mautrix.Client) {
+	draftMutex.Lock()
+	defer draftMutex.Unlock()
+
+	last, err := getUndoableWritingTemp(roomID.String())
+	if err == sql.ErrNoRows {
+		client.SendText(roomID, "There is no email to undo")
+		return
+	}
+	if err != nil {
+		WriteLog(critical, "#80 getUndoableWritingTemp: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #80")
+		return
+	}
+
+	err = scheduleWritingTemp(last.pkID, 0, false)
+	if err != nil {
+		WriteLog(critical, "#75 scheduleWritingTemp: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #75")
+		return
+	}
+	client.SendText(roomID, "Sending \""+last.subject+"\" canceled. You can continue writing it. Enter "+commandPrefix()+"send or "+commandPrefix()+"cancel when you're done")
+}
+
+func viewScheduled(roomID string, client *mautrix.Client) {
+	temps, err := getScheduledWritingTemps(roomID)
+	if err != nil {
+		WriteLog(critical, "#80 getScheduledWritingTemps: "+err.Error())
+		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #80")
+		return
+	}
+	if len(temps) == 0 {
+		client.SendText(id.RoomID(roomID), "There are no scheduled emails")
+		return
+	}
+	loc := getRoomLocation(roomID)
+	msg := "Scheduled emails:\n"
+	for _, temp := range temps {
+		msg += "#" + strconv.Itoa(temp.pkID) + " " + time.Unix(temp.sendAt, 0).In(loc).Format(scheduleTimeLayout) + " to " + strings.Join(getReceivers(&temp), ", ") + ": \"" + temp.subject + "\"\n"
+	}
+	client.SendText(id.RoomID(roomID), msg)
+}
+
+func handleScheduledCommand(roomID id.RoomID, args []string, client *mautrix.Client) {
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "list" || args[0] == "view")) {
+		viewScheduled(roomID.String(), client)
+		return
+	}
+	if len(args) != 2 || (args[0] != "cancel" && args[0] != "rm" && args[0] != "delete") {
+		client.SendText(roomID, "Usage: "+commandPrefix()+"scheduled <list/cancel> <id>")
+		return
+	}
+	pkID, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	if err != nil {
+		client.SendText(roomID, "The id must be a number!")
+		return
+	}
+
+	draftMutex.Lock()
+	defer draftMutex.Unlock()
+	temp, err := getWritingTempByID(pkID)
+	if err != nil || temp.roomID != roomID.String() || temp.sendAt == 0 {
+		client.SendText(roomID, "There is no scheduled email #"+args[1])
+		return
+	}
+	err = deleteWritingTempByID(pkID)
+	if err != nil {
+		WriteLog(critical, "#81 deleteWritingTempByID: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #81")
+		return
+	}
+	client.SendText(roomID, "Scheduled email \""+temp.subject+"\" canceled")
+}
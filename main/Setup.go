@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//handleSetupCommand handles '!setup imap/smtp, host:port, username, password, <mailbox>, ignoreSSL'
+func handleSetupCommand(ctx *commandContext) {
+	roomID, client := ctx.roomID, ctx.client
+	s := strings.Split(ctx.raw, ",")
+	if len(s) < 4 || len(s) > 6 {
+		client.SendText(roomID, "Wrong syntax :/\r\nExample: \r\n"+commandPrefix()+"setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n"+
+			commandPrefix()+"setup smtp, host.com:587, mail@host.com, w0rdp4ss, false\r\n\r\nUse "+commandPrefix()+"login to be asked for each value")
+	} else {
+		accountType := s[0]
+		if strings.ToLower(accountType) != "imap" && strings.ToLower(accountType) != "smtp" {
+			client.SendText(roomID, "What? you can setup 'imap' and 'smtp', not \""+accountType+"\"")
+			return
+		}
+		host := strings.ReplaceAll(s[1], " ", "")
+		username := strings.ReplaceAll(s[2], " ", "")
+		password := strings.ReplaceAll(s[3], " ", "")
+		ignoreSSlCert := false
+		mailbox := "INBOX"
+		if len(s) >= 5 {
+			mailbox = strings.ReplaceAll(s[4], " ", "")
+		}
+		var err error
+		imapAccID, smtpAccID, erro := getRoomAccounts(string(roomID))
+		if erro != nil {
+			client.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #37")
+			WriteLog(critical, "#37 checking getRoomAccounts: "+erro.Error())
+			return
+		}
+		if accountType == "imap" {
+			if len(s) == 6 {
+				ignoreSSlCert, err = strconv.ParseBool(strings.ReplaceAll(s[5], " ", ""))
+				if err != nil {
+					fmt.Println(err.Error())
+					ignoreSSlCert = false
+				}
+			}
+			if imapAccID != -1 {
+				client.SendText(roomID, "IMAP account already existing. Create a new room if you want to use a different account!")
+				return
+			}
+			if !checkAccountNotInUse(client, roomID, "imap", username) {
+				return
+			}
+
+			go func() {
+				if !strings.Contains(host, ":") {
+					host += ":993"
+				}
+
+				account := &imapAccountount{host: host, username: username, password: password, mailbox: mailbox, ignoreSSL: ignoreSSlCert}
+				mclient, err := loginMail(account)
+				if mclient != nil && err == nil {
+					mclient.Logout()
+					createIMAPBridge(client, roomID, ctx.evt.Sender, account)
+				} else {
+					client.SendText(roomID, "Error creating bridge! Errorcode: #04\r\nReason: "+err.Error())
+					WriteLog(logError, "#04 creating bridge: "+err.Error())
+				}
+			}()
+		} else if accountType == "smtp" {
+			if smtpAccID != -1 {
+				client.SendText(roomID, "SMTP account already existing. Create a new room if you want to use a different account!")
+				return
+			}
+			if !checkAccountNotInUse(client, roomID, "smtp", username) {
+				return
+			}
+
+			go func() {
+				if len(s) == 5 {
+					ignoreSSlCert, err = strconv.ParseBool(strings.ReplaceAll(s[4], " ", ""))
+					if err != nil {
+						fmt.Println(err.Error())
+						ignoreSSlCert = false
+					}
+				}
+				port := 587
+				transport := strings.ToLower(host)
+				if transport == transportSendmail || transport == transportLMTP {
+					//local delivery doesn't need a host
+					if err := checkTransport(transport, ctx.evt.Sender); err != nil {
+						client.SendText(roomID, err.Error())
+						return
+					}
+					host = "localhost"
+				} else if !strings.Contains(host, ":") {
+					client.SendText(roomID, "No port specified! Using 587")
+				} else {
+					hostsplit := strings.Split(host, ":")
+					host = hostsplit[0]
+					port, err = strconv.Atoi(strings.Trim(hostsplit[1], " "))
+					if err != nil {
+						client.SendText(roomID, "The port must be a number!")
+						return
+					}
+				}
+
+				//log in before saving anything, so wrong data is noticed now and not at the first !send
+				account := &smtpAccount{host: host, port: port, username: username, password: password, ignoreSSL: ignoreSSlCert}
+				if transport == transportSendmail || transport == transportLMTP {
+					account.transport = transport
+				}
+				client.SendText(roomID, "Checking your SMTP account...")
+				serverInfo, err := checkSMTPAccount(account)
+				if err != nil {
+					WriteLog(info, "smtp setup of "+username+" failed: "+err.Error())
+					client.SendText(roomID, "Couldn't log in to your SMTP server. Nothing was saved.\r\nReason: "+err.Error())
+					return
+				}
+				createSMTPBridge(client, roomID, ctx.evt.Sender, account, serverInfo)
+			}()
+		} else {
+			client.SendText(roomID, "Not implemented yet!")
+		}
+	}
+}
+
+//checkAccountNotInUse tells the user if the email account is bridged to another room already
+func checkAccountNotInUse(client *mautrix.Client, roomID id.RoomID, accountType, username string) bool {
+	if accountType == "imap" {
+		isInUse, err := isImapAccountAlreadyInUse(username)
+		if err != nil {
+			client.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #03")
+			WriteLog(critical, "#03 checking isImapAccountAlreadyInUse: "+err.Error())
+			return false
+		}
+		if isInUse {
+			client.SendText(roomID, "This email is already in Use! You cannot use your email twice!")
+			return false
+		}
+		return true
+	}
+	isInUse, err := isSMTPAccountAlreadyInUse(username)
+	if err != nil {
+		client.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #24")
+		WriteLog(critical, "#24 checking isSMTPAccountAlreadyInUse: "+err.Error())
+		return false
+	}
+	if isInUse {
+		client.SendText(roomID, "This smtp-username is already in Use! You cannot use your email twice!")
+		return false
+	}
+	return true
+}
+
+//createIMAPBridge saves a checked imap account for the room and starts its mail listener
+func createIMAPBridge(client *mautrix.Client, roomID id.RoomID, userID id.UserID, account *imapAccountount) bool {
+	defaultMailSyncInterval := viper.GetInt("defaultmailCheckInterval")
+	has, er := hasRoom(string(roomID))
+	if er != nil {
+		client.SendText(roomID, "An error occured! contact your admin! Errorcode: #25")
+		WriteLog(critical, "checking imapAcc #25: "+er.Error())
+		return false
+	}
+	var newRoomID int64
+	if !has {
+		newRoomID = insertNewRoom(string(roomID), userID.String(), defaultMailSyncInterval)
+		if newRoomID == -1 {
+			client.SendText(roomID, "An error occured! contact your admin! Errorcode: #26")
+			WriteLog(critical, "checking insertNewRoom #26")
+			return false
+		}
+	} else {
+		id, err := getRoomPKID(roomID.String())
+		if err != nil {
+			WriteLog(critical, "checking getRoomPKID #27: "+err.Error())
+			client.SendText(roomID, "An error occured! contact your admin! Errorcode: #27")
+			return false
+		}
+		newRoomID = int64(id)
+	}
+	imapID, succes := insertimapAccountount(account.host, account.username, account.password, account.mailbox, account.security, account.ignoreSSL)
+	if !succes {
+		client.SendText(roomID, "sth went wrong. Contact your admin")
+		return false
+	}
+	err := saveImapAcc(string(roomID), int(imapID))
+	if err != nil {
+		WriteLog(critical, "saveImapAcc #35 : "+err.Error())
+		client.SendText(roomID, "sth went wrong. Contact you admin! Errorcode: #35")
+		return false
+	}
+	client.SendText(roomID, "Bridge created successfully!\r\nIMAP:\r\n"+
+		"host: "+account.host+"\r\n"+
+		"username: "+account.username+"\r\n"+
+		"mailbox: "+account.mailbox+"\r\n"+
+		"ignoreSSL: "+strconv.FormatBool(account.ignoreSSL))
+
+	account.roomID = roomID.String()
+	account.roomPKID = int(newRoomID)
+	account.mailCheckInterval = defaultMailSyncInterval
+	account.silence = true
+	go startMailListener(*account)
+	WriteLog(success, "Created new bridge and started maillistener\r\n")
+	return true
+}
+
+//createSMTPBridge saves a checked smtp account for the room
+func createSMTPBridge(client *mautrix.Client, roomID id.RoomID, userID id.UserID, account *smtpAccount, serverInfo string) bool {
+	has, er := hasRoom(roomID.String())
+	if er != nil {
+		client.SendText(roomID, "An error occured! contact your admin! Errorcode: #28")
+		WriteLog(critical, "checking imapAcc #28: "+er.Error())
+		return false
+	}
+	if !has {
+		newRoomID := insertNewRoom(roomID.String(), userID.String(), viper.GetInt("defaultmailCheckInterval"))
+		if newRoomID == -1 {
+			client.SendText(roomID, "An error occured! contact your admin! Errorcode: #29")
+			WriteLog(critical, "checking insertNewRoom #29: ")
+			return false
+		}
+	}
+	smtpID, err := insertSMTPAccountount(account.host, account.port, account.username, account.password, account.ignoreSSL)
+	if err != nil {
+		client.SendText(roomID, "sth went wrong. Contact your admin")
+		return false
+	}
+	err = saveSMTPAcc(roomID.String(), int(smtpID))
+	if err != nil {
+		WriteLog(critical, "saveSMTPAcc #36 : "+err.Error())
+		client.SendText(roomID, "sth went wrong. Contact you admin! Errorcode: #34")
+		return false
+	}
+	settings := map[string]string{"transport": account.transport, "security": account.security}
+	for setting, value := range settings {
+		if len(value) == 0 {
+			continue
+		}
+		err = saveSMTPSetting(roomID.String(), setting, value)
+		if err != nil {
+			WriteLog(critical, "#103 saveSMTPSetting: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #103")
+			return false
+		}
+	}
+
+	client.SendText(roomID, "SMTP data saved.\r\nSMTP:\r\n"+
+		"host: "+account.host+"\r\n"+
+		"port: "+strconv.Itoa(account.port)+"\r\n"+
+		"username: "+account.username+"\r\n"+
+		"ignoreSSL: "+strconv.FormatBool(account.ignoreSSL)+"\r\n\r\n"+
+		serverInfo+"\r\n\r\nUse "+commandPrefix()+"test smtp to send a test email to yourself")
+	return true
+}
+
+//redactCredentials removes a message containing a password.
+//Returns false if the bot isn't allowed to, the user is asked to delete it then
+func redactCredentials(client *mautrix.Client, evt *event.Event) bool {
+	_, err := client.RedactEvent(evt.RoomID, evt.ID, mautrix.ReqRedact{Reason: "contains credentials"})
+	if err != nil {
+		WriteLog(warn, "Couldn't redact credentials in "+evt.RoomID.String()+": "+err.Error())
+		client.SendText(evt.RoomID, "I couldn't remove your message containing the password. Please delete it yourself or allow me to remove messages")
+		return false
+	}
+	return true
+}
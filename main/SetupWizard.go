@@ -0,0 +1,626 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//wizardTimeout is how long a setup wizard waits for an answer
+const wizardTimeout = 15 * time.Minute
+
+//setupWizard asks for the login data of an account one value at a time
+type setupWizard struct {
+	userID      id.UserID
+	accountType string
+	//field is set if only this value of an existing account is changed
+	field string
+	step  int
+	//checking is set while an answer is validated, other answers are refused meanwhile
+	checking   bool
+	lastAnswer time.Time
+
+	host, security, username, password, mailbox, transport string
+	port                                                   int
+	portGiven, ignoreSSL                                   bool
+	//imap and smtp are the accounts being changed
+	imap       imapAccountount
+	smtp       smtpAccount
+	serverInfo string
+}
+
+//wizardStep asks for one value of an account
+type wizardStep struct {
+	field    string
+	question func(w *setupWizard) string
+	//secret answers are redacted
+	secret bool
+	//skip returns true if the account doesn't need the value
+	skip func(w *setupWizard) bool
+	//apply validates the answer and saves it in the wizard
+	apply func(w *setupWizard, answer string) error
+}
+
+var (
+	setupWizards     = make(map[id.RoomID]*setupWizard)
+	setupWizardMutex sync.Mutex
+)
+
+var wizardSteps []*wizardStep
+
+func init() {
+	wizardSteps = []*wizardStep{
+		{field: "host", question: hostQuestion, apply: applyHost},
+		{field: "port", question: func(w *setupWizard) string {
+			return "Which port does " + w.host + " use? Send default for " + strconv.Itoa(defaultPort(w))
+		}, skip: func(w *setupWizard) bool {
+			return len(w.transport) > 0 || (w.portGiven && len(w.field) == 0)
+		}, apply: applyPort},
+		{field: "security", question: func(w *setupWizard) string {
+			if w.accountType == "imap" {
+				return "How is the connection secured? Send tls (usually port 993) or starttls (usually port 143). default is " + defaultIMAPSecurity(w.port)
+			}
+			return "How is the connection secured? Send " + strings.Join(securityOptions, ", ") + ". auto uses TLS on port 465 and STARTTLS if the server offers it"
+		}, skip: isLocalTransport, apply: applySecurity},
+		{field: "certificate", question: func(w *setupWizard) string {
+			return "Should I check the certificate of the server? Send yes, or no if the server uses a self-signed certificate"
+		}, skip: func(w *setupWizard) bool {
+			return isLocalTransport(w) || w.security == securityNone
+		}, apply: applyCertificate},
+		{field: "username", question: func(w *setupWizard) string {
+			return "What's the username of the account? Usually it's your email address"
+		}, apply: applyUsername},
+		{field: "password", question: func(w *setupWizard) string {
+			return "What's the password? I remove your message right after reading it"
+		}, secret: true, skip: isLocalTransport, apply: applyPassword},
+		{field: "mailbox", question: func(w *setupWizard) string {
+			return "Which mailbox should be bridged? Send default for INBOX"
+		}, skip: func(w *setupWizard) bool {
+			return w.accountType != "imap"
+		}, apply: applyMailbox},
+	}
+}
+
+//wizardFields returns the names of the values which can be changed with !set
+func wizardFields() []string {
+	var fields []string
+	for _, step := range wizardSteps {
+		fields = append(fields, step.field)
+	}
+	return fields
+}
+
+func isLocalTransport(w *setupWizard) bool {
+	return len(w.transport) > 0
+}
+
+func isDefaultAnswer(answer string) bool {
+	return strings.EqualFold(answer, "default")
+}
+
+func defaultPort(w *setupWizard) int {
+	if w.accountType == "imap" {
+		return 993
+	}
+	return 587
+}
+
+func defaultIMAPSecurity(port int) string {
+	if port == 143 {
+		return securitySTARTTLS
+	}
+	return securityTLS
+}
+
+func hostQuestion(w *setupWizard) string {
+	if w.accountType == "imap" {
+		return "Which IMAP server do you want to receive emails from? eg. imap.example.com"
+	}
+	question := "Which SMTP server do you want to send emails with? eg. smtp.example.com"
+	for _, transport := range []string{transportSendmail, transportLMTP} {
+		if checkTransport(transport, w.userID) == nil {
+			question += "\r\nSend " + transport + " to deliver them with the mail server of the bridge"
+		}
+	}
+	return question
+}
+
+func applyHost(w *setupWizard, answer string) error {
+	host := strings.ToLower(answer)
+	if w.accountType == "smtp" && (host == transportSendmail || host == transportLMTP) {
+		if err := checkTransport(host, w.userID); err != nil {
+			return err
+		}
+		w.host, w.transport = "localhost", host
+		return nil
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return errors.New("The port must be a number between 1 and 65535")
+		}
+		host, w.port, w.portGiven = h, port, true
+	}
+	if len(host) == 0 || strings.ContainsAny(host, " /@:") {
+		return errors.New("That doesn't look like a server. Send its name, eg. mail.example.com")
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return errors.New("I can't find the server " + host + ". Check the name and send it again")
+	}
+	w.host, w.transport = host, ""
+	return nil
+}
+
+func applyPort(w *setupWizard, answer string) error {
+	port := defaultPort(w)
+	if !isDefaultAnswer(answer) {
+		var err error
+		port, err = strconv.Atoi(answer)
+		if err != nil || port < 1 || port > 65535 {
+			return errors.New("The port must be a number between 1 and 65535")
+		}
+	}
+	address := net.JoinHostPort(w.host, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", address, smtpTimeout)
+	if err != nil {
+		return errors.New("I can't connect to " + address + ": " + err.Error() + "\r\nSend another port or " + commandPrefix() + "cancel")
+	}
+	conn.Close()
+	w.port = port
+	return nil
+}
+
+func applySecurity(w *setupWizard, answer string) error {
+	security := strings.ToLower(answer)
+	options := securityOptions
+	if w.accountType == "imap" {
+		options = imapSecurityOptions
+		if isDefaultAnswer(security) {
+			security = defaultIMAPSecurity(w.port)
+		}
+	} else if isDefaultAnswer(security) {
+		security = "auto"
+	}
+	if !contains(options, security) {
+		return errors.New("Send one of: " + strings.Join(options, ", "))
+	}
+	if security == "auto" {
+		security = ""
+	}
+	w.security = security
+	return nil
+}
+
+func applyCertificate(w *setupWizard, answer string) error {
+	switch strings.ToLower(answer) {
+	case "yes", "y", "true", "on", "default":
+		w.ignoreSSL = false
+	case "no", "n", "false", "off":
+		w.ignoreSSL = true
+	default:
+		return errors.New("Send yes or no")
+	}
+	return nil
+}
+
+func applyUsername(w *setupWizard, answer string) error {
+	if len(answer) == 0 || strings.ContainsAny(answer, " \t\r\n") {
+		return errors.New("The username can't contain spaces")
+	}
+	//the username is the sender address of local transports
+	if isLocalTransport(w) {
+		if err := checkTransport(w.transport, w.userID); err != nil {
+			return err
+		}
+	}
+	w.username = answer
+	return nil
+}
+
+func applyPassword(w *setupWizard, answer string) error {
+	w.password = answer
+	//a single changed value is checked together with the rest of the account
+	if len(w.field) > 0 {
+		return nil
+	}
+	if w.accountType == "smtp" {
+		serverInfo, err := checkSMTPAccount(w.smtpAccount())
+		if err != nil {
+			return errors.New("Couldn't log in to your SMTP server: " + err.Error() + "\r\nSend the password again or " + commandPrefix() + "cancel to start over")
+		}
+		w.serverInfo = serverInfo
+		return nil
+	}
+	mClient, err := loginMail(w.imapAccount())
+	if err != nil {
+		return errors.New("Couldn't log in to your IMAP server: " + err.Error() + "\r\nSend the password again or " + commandPrefix() + "cancel to start over")
+	}
+	mClient.Logout()
+	return nil
+}
+
+func applyMailbox(w *setupWizard, answer string) error {
+	mailbox := answer
+	if isDefaultAnswer(mailbox) {
+		mailbox = "INBOX"
+	}
+	w.mailbox = mailbox
+	if len(w.field) > 0 {
+		return nil
+	}
+	return checkMailbox(w.imapAccount())
+}
+
+//checkMailbox returns an error listing the folders of the account if its mailbox doesn't exist
+func checkMailbox(account *imapAccountount) error {
+	mClient, err := loginMail(account)
+	if err != nil {
+		return errors.New("Couldn't log in to your IMAP server: " + err.Error())
+	}
+	defer mClient.Logout()
+	if _, err := mClient.Select(account.mailbox, true); err == nil {
+		return nil
+	}
+	folders, err := listFolders(mClient)
+	if err != nil {
+		return errors.New("The mailbox " + account.mailbox + " doesn't exist")
+	}
+	return errors.New("The mailbox " + account.mailbox + " doesn't exist. Your mailboxes:\r\n" + strings.Join(folders, "\r\n"))
+}
+
+//imapAccount returns the imap account with the values of the wizard
+func (w *setupWizard) imapAccount() *imapAccountount {
+	account := w.imap
+	account.host = net.JoinHostPort(w.host, strconv.Itoa(w.port))
+	account.username, account.password, account.mailbox = w.username, w.password, w.mailbox
+	account.security, account.ignoreSSL = w.security, w.ignoreSSL
+	return &account
+}
+
+//smtpAccount returns the smtp account with the values of the wizard
+func (w *setupWizard) smtpAccount() *smtpAccount {
+	account := w.smtp
+	account.host, account.port = w.host, w.port
+	account.username, account.password = w.username, w.password
+	account.security, account.transport, account.ignoreSSL = w.security, w.transport, w.ignoreSSL
+	return &account
+}
+
+//currentStep returns the step waiting for an answer
+func (w *setupWizard) currentStep() *wizardStep {
+	return wizardSteps[w.step]
+}
+
+//nextStep moves to the next step the account needs. Returns false if there is none
+func (w *setupWizard) nextStep() bool {
+	for w.step++; w.step < len(wizardSteps); w.step++ {
+		if skip := wizardSteps[w.step].skip; skip == nil || !skip(w) {
+			return true
+		}
+	}
+	return false
+}
+
+//getSetupWizard returns the running wizard of a room, nil if there is none or it timed out
+func getSetupWizard(roomID id.RoomID) *setupWizard {
+	w, ok := setupWizards[roomID]
+	if !ok {
+		return nil
+	}
+	if time.Since(w.lastAnswer) > wizardTimeout {
+		delete(setupWizards, roomID)
+		return nil
+	}
+	return w
+}
+
+func askWizardStep(client *mautrix.Client, roomID id.RoomID, w *setupWizard) {
+	w.lastAnswer = time.Now()
+	client.SendText(roomID, w.currentStep().question(w))
+}
+
+//handleLoginCommand handles '!login <imap/smtp>' which sets up an account step by step
+func handleLoginCommand(ctx *commandContext) {
+	imapAccID, smtpAccID, err := getRoomAccounts(ctx.roomID.String())
+	if err != nil {
+		WriteLog(critical, "#37 checking getRoomAccounts: "+err.Error())
+		ctx.reply("Something went wrong! Contact the admin. Errorcode: #37")
+		return
+	}
+	accountType := "imap"
+	if len(ctx.args) > 0 {
+		accountType = strings.ToLower(ctx.args[0])
+	} else if imapAccID != -1 {
+		accountType = "smtp"
+	}
+	switch {
+	case imapAccID != -1 && smtpAccID != -1:
+		ctx.reply("This room is bridged already. Use " + commandPrefix() + "set <imap/smtp> <" + strings.Join(wizardFields(), "/") + "> to change a value of the login data")
+		return
+	case accountType != "imap" && accountType != "smtp":
+		ctx.reply(ctx.usage())
+		return
+	case accountType == "imap" && imapAccID != -1, accountType == "smtp" && smtpAccID != -1:
+		ctx.reply(strings.ToUpper(accountType) + " account already existing. Create a new room if you want to use a different account!\r\n" +
+			"Use " + commandPrefix() + "set " + accountType + " <" + strings.Join(wizardFields(), "/") + "> to change a value of its login data")
+		return
+	}
+
+	setupWizardMutex.Lock()
+	defer setupWizardMutex.Unlock()
+	if w := getSetupWizard(ctx.roomID); w != nil && w.userID != ctx.evt.Sender {
+		ctx.reply(w.userID.String() + " is setting up this room right now")
+		return
+	}
+	w := &setupWizard{userID: ctx.evt.Sender, accountType: accountType, step: -1}
+	w.nextStep()
+	setupWizards[ctx.roomID] = w
+	intro := "Let's set up your IMAP account, which receives the emails."
+	if accountType == "smtp" {
+		intro = "Let's set up your SMTP account, which sends the emails."
+	}
+	ctx.reply(intro + " Send " + commandPrefix() + "cancel to stop.\r\nYou can also set up an account in a single message, see " + commandPrefix() + "help setup")
+	askWizardStep(ctx.client, ctx.roomID, w)
+}
+
+//hasSecretValue returns true if !set is given the value of a secret step, eg. the password
+func hasSecretValue(ctx *commandContext) bool {
+	if len(ctx.args) < 3 {
+		return false
+	}
+	for _, step := range wizardSteps {
+		if step.field == strings.ToLower(ctx.args[1]) {
+			return step.secret
+		}
+	}
+	return false
+}
+
+//setCommandValue returns the new value given to '!set <imap/smtp> <field> <value>'.
+//The value is the rest of the first line, it may contain spaces
+func setCommandValue(raw string, args []string) string {
+	value := strings.SplitN(raw, "\n", 2)[0]
+	for _, arg := range args[:2] {
+		value = strings.TrimSpace(strings.TrimPrefix(value, arg))
+	}
+	return value
+}
+
+//handleSetCommand handles '!set <imap/smtp> <value> <new value>'. Without a new value the bridge asks for it
+func handleSetCommand(ctx *commandContext) {
+	accountType, field := strings.ToLower(ctx.args[0]), strings.ToLower(ctx.args[1])
+	value := setCommandValue(ctx.raw, ctx.args)
+	if accountType != "imap" && accountType != "smtp" {
+		ctx.reply(ctx.usage())
+		return
+	}
+
+	w := &setupWizard{userID: ctx.evt.Sender, accountType: accountType, field: field, step: -1}
+	for i, step := range wizardSteps {
+		if step.field == field {
+			w.step = i
+		}
+	}
+	if w.step == -1 {
+		ctx.reply("Unknown value " + field + ". You can change: " + strings.Join(wizardFields(), ", "))
+		return
+	}
+	if !loadWizardAccount(ctx, w) {
+		return
+	}
+	if skip := w.currentStep().skip; skip != nil && skip(w) {
+		ctx.reply("Your " + accountType + " account doesn't use a " + field)
+		return
+	}
+
+	setupWizardMutex.Lock()
+	defer setupWizardMutex.Unlock()
+	if running := getSetupWizard(ctx.roomID); running != nil && running.userID != ctx.evt.Sender {
+		ctx.reply(running.userID.String() + " is setting up this room right now")
+		return
+	}
+	setupWizards[ctx.roomID] = w
+	if len(value) == 0 {
+		askWizardStep(ctx.client, ctx.roomID, w)
+		return
+	}
+	w.checking = true
+	w.lastAnswer = time.Now()
+	go answerWizard(ctx.client, ctx.roomID, w, value)
+}
+
+//loadWizardAccount fills the wizard with the values of the existing account
+func loadWizardAccount(ctx *commandContext, w *setupWizard) bool {
+	imapAccID, smtpAccID, err := getRoomAccounts(ctx.roomID.String())
+	if err != nil {
+		WriteLog(critical, "#48 getRoomAccounts: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #48")
+		return false
+	}
+	if (w.accountType == "imap" && imapAccID == -1) || (w.accountType == "smtp" && smtpAccID == -1) {
+		ctx.reply("This room has no " + w.accountType + " account. Use " + commandPrefix() + "login " + w.accountType + " to set it up")
+		return false
+	}
+
+	if w.accountType == "imap" {
+		account, err := getIMAPAccount(ctx.roomID.String())
+		if err != nil {
+			WriteLog(critical, "#49 getIMAPAccount: "+err.Error())
+			ctx.reply("An server-error occured Errorcode: #49")
+			return false
+		}
+		w.imap = *account
+		w.host, w.port = account.host, 993
+		if host, port, err := net.SplitHostPort(account.host); err == nil {
+			w.host = host
+			w.port, _ = strconv.Atoi(port)
+		}
+		w.username, w.password, w.mailbox = account.username, account.password, account.mailbox
+		w.security, w.ignoreSSL = account.security, account.ignoreSSL
+		return true
+	}
+	account, err := getSMTPAccount(ctx.roomID.String())
+	if err != nil {
+		WriteLog(critical, "#52 getSMTPAccount: "+err.Error())
+		ctx.reply("An server-error occured Errorcode: #52")
+		return false
+	}
+	w.smtp = *account
+	w.host, w.port = account.host, account.port
+	w.username, w.password = account.username, account.password
+	w.security, w.transport, w.ignoreSSL = account.security, account.transport, account.ignoreSSL
+	if w.transport == transportSMTP {
+		w.transport = ""
+	}
+	return true
+}
+
+//handleWizardMessage takes the message as answer if its sender runs a setup wizard in the room.
+//Returns false if the message isn't an answer
+func handleWizardMessage(client *mautrix.Client, evt *event.Event) bool {
+	setupWizardMutex.Lock()
+	defer setupWizardMutex.Unlock()
+	w := getSetupWizard(evt.RoomID)
+	if w == nil || w.userID != evt.Sender {
+		return false
+	}
+	content := evt.Content.AsMessage()
+	if w.currentStep().secret {
+		redactCredentials(client, evt)
+	}
+	answer := strings.TrimSpace(content.Body)
+	if answer == commandPrefix()+"cancel" {
+		delete(setupWizards, evt.RoomID)
+		client.SendText(evt.RoomID, "Canceled. Nothing was saved")
+		return true
+	}
+	if content.MsgType != event.MsgText {
+		client.SendText(evt.RoomID, "Send me the answer as text")
+		return true
+	}
+	if w.checking {
+		client.SendText(evt.RoomID, "I'm still checking your last answer, wait a moment")
+		return true
+	}
+	w.checking = true
+	w.lastAnswer = time.Now()
+	go answerWizard(client, evt.RoomID, w, answer)
+	return true
+}
+
+//answerWizard validates an answer and asks the next question or saves the account
+func answerWizard(client *mautrix.Client, roomID id.RoomID, w *setupWizard, answer string) {
+	err := w.currentStep().apply(w, answer)
+	if err == nil && w.currentStep().field == "username" && w.username != w.imap.username && w.username != w.smtp.username {
+		if !checkAccountNotInUse(client, roomID, w.accountType, w.username) {
+			err = errors.New("Send another username or " + commandPrefix() + "cancel")
+		}
+	}
+
+	setupWizardMutex.Lock()
+	defer setupWizardMutex.Unlock()
+	w.checking = false
+	if setupWizards[roomID] != w {
+		//canceled meanwhile
+		return
+	}
+	if err != nil {
+		client.SendText(roomID, err.Error())
+		w.lastAnswer = time.Now()
+		return
+	}
+	if len(w.field) == 0 && w.nextStep() {
+		askWizardStep(client, roomID, w)
+		return
+	}
+	delete(setupWizards, roomID)
+	if len(w.field) > 0 {
+		go saveWizardField(client, roomID, w)
+		return
+	}
+	go finishWizard(client, roomID, w)
+}
+
+//finishWizard creates the account. After the imap account the smtp account is set up
+func finishWizard(client *mautrix.Client, roomID id.RoomID, w *setupWizard) {
+	if w.accountType == "imap" {
+		if !createIMAPBridge(client, roomID, w.userID, w.imapAccount()) {
+			return
+		}
+		_, smtpAccID, err := getRoomAccounts(roomID.String())
+		if err != nil || smtpAccID != -1 {
+			return
+		}
+		setupWizardMutex.Lock()
+		defer setupWizardMutex.Unlock()
+		if getSetupWizard(roomID) != nil {
+			return
+		}
+		next := &setupWizard{userID: w.userID, accountType: "smtp", step: -1}
+		next.nextStep()
+		setupWizards[roomID] = next
+		client.SendText(roomID, "Now the SMTP account, which sends your emails. Send "+commandPrefix()+"cancel if you only want to receive emails")
+		askWizardStep(client, roomID, next)
+		return
+	}
+
+	account := w.smtpAccount()
+	if isLocalTransport(w) {
+		//local transports have no password step, which checks the other accounts
+		serverInfo, err := checkSMTPAccount(account)
+		if err != nil {
+			client.SendText(roomID, "Couldn't deliver with "+w.transport+". Nothing was saved.\r\nReason: "+err.Error())
+			return
+		}
+		w.serverInfo = serverInfo
+	}
+	createSMTPBridge(client, roomID, w.userID, account, w.serverInfo)
+}
+
+//saveWizardField checks the account with the changed value and saves it.
+//The bridge keeps running, only the imap connection is restarted
+func saveWizardField(client *mautrix.Client, roomID id.RoomID, w *setupWizard) {
+	if w.accountType == "imap" {
+		account := w.imapAccount()
+		if err := checkMailbox(account); err != nil {
+			client.SendText(roomID, "Nothing was changed.\r\n"+err.Error())
+			return
+		}
+		if err := updateIMAPAccount(roomID.String(), account); err != nil {
+			WriteLog(critical, "#138 updateIMAPAccount: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #138")
+			return
+		}
+		if w.field == "mailbox" {
+			deleteMails(roomID.String())
+		}
+		stopMailChecker(roomID.String())
+		account.silence = true
+		go startMailListener(*account)
+		client.SendText(roomID, "IMAP "+w.field+" updated")
+		return
+	}
+
+	account := w.smtpAccount()
+	if _, err := checkSMTPAccount(account); err != nil {
+		client.SendText(roomID, "Couldn't log in to your SMTP server with the new "+w.field+". Nothing was changed.\r\nReason: "+err.Error())
+		return
+	}
+	if err := updateSMTPAccount(account); err != nil {
+		WriteLog(critical, "#139 updateSMTPAccount: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #139")
+		return
+	}
+	//the size limit depends on the connection
+	sizeLimitMutex.Lock()
+	delete(sizeLimits, w.smtp.host+":"+strconv.Itoa(w.smtp.port))
+	sizeLimitMutex.Unlock()
+	client.SendText(roomID, "SMTP "+w.field+" updated")
+}
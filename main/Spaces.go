@@ -0,0 +1,273 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//spaceChild links a room to a space, its state key is the id of the room
+var spaceChild = event.Type{Type: "m.space.child", Class: event.StateEventType}
+
+//archivedPrefix is put in front of the name of a room whose folder was deleted
+const archivedPrefix = "[archived] "
+
+//listFolders returns the folders of the imap account which can contain emails
+func listFolders(mClient *client.Client) ([]string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 20)
+	done := make(chan error, 1)
+	go func() {
+		done <- mClient.List("", "*", mailboxes)
+	}()
+
+	var folders []string
+	for m := range mailboxes {
+		selectable := true
+		for _, attr := range m.Attributes {
+			if strings.EqualFold(attr, imap.NoSelectAttr) {
+				selectable = false
+			}
+		}
+		if selectable {
+			folders = append(folders, m.Name)
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func handleSpaceCommand(roomID id.RoomID, args []string, client *mautrix.Client) {
+	if accountRoomID(roomID.String()) != roomID.String() {
+		client.SendText(roomID, "Use this command in the bridged room of the account")
+		return
+	}
+	spaceID, err := getSpaceID(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#129 getSpaceID: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #129")
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		if len(spaceID) > 0 {
+			client.SendText(roomID, "This account already has a space: https://matrix.to/#/"+spaceID)
+			return
+		}
+		spaceID, err := createAccountSpace(roomID.String())
+		if err != nil {
+			WriteLog(critical, "#130 createAccountSpace: "+err.Error())
+			client.SendText(roomID, "An server-error occured Errorcode: #130")
+			return
+		}
+		client.SendText(roomID, "Created a space for this account: https://matrix.to/#/"+spaceID.String()+"\r\nEvery folder gets its own room in it. This room keeps showing the emails of the mailbox it is bridged to")
+		restartMailListener(roomID.String())
+	case "sync":
+		if len(spaceID) == 0 {
+			client.SendText(roomID, "This account has no space. Create one with "+commandPrefix()+"space on")
+			return
+		}
+		restartMailListener(roomID.String())
+		client.SendText(roomID, "Syncing the folders")
+	case "off":
+		if len(spaceID) == 0 {
+			client.SendText(roomID, "This account has no space")
+			return
+		}
+		removeAccountSpace(roomID.String(), spaceID)
+		client.SendText(roomID, "Removed the space. The folder rooms don't get emails anymore")
+	default:
+		client.SendText(roomID, "Usage: "+commandPrefix()+"space <on/sync/off>")
+	}
+}
+
+//createAccountSpace creates the space of a bridged room and adds the room to it
+func createAccountSpace(roomID string) (id.RoomID, error) {
+	account, err := getIMAPAccount(roomID)
+	if err != nil {
+		return "", err
+	}
+	spaceID, err := createLinkedRoom(roomID, &mautrix.ReqCreateRoom{
+		Name:            account.username,
+		Topic:           "The folders of " + account.username,
+		Preset:          "private_chat",
+		CreationContent: map[string]interface{}{"type": "m.space"},
+	}, false)
+	if err != nil {
+		return "", err
+	}
+	if err := saveSpaceID(roomID, spaceID.String()); err != nil {
+		return "", err
+	}
+	if err := setSpaceChild(spaceID.String(), roomID, true); err != nil {
+		WriteLog(warn, "Couldn't add "+roomID+" to its space: "+err.Error())
+	}
+	return spaceID, nil
+}
+
+//removeAccountSpace leaves the space and the folder rooms of a bridged room
+func removeAccountSpace(roomID, spaceID string) {
+	folders, err := getFolderRooms(roomID)
+	if err != nil {
+		WriteLog(logError, "#131 getFolderRooms: "+err.Error())
+	}
+	for _, folder := range folders {
+		matrixClient.LeaveRoom(id.RoomID(folder.roomID))
+	}
+	matrixClient.LeaveRoom(id.RoomID(spaceID))
+	if err := deleteFolderRooms(roomID); err != nil {
+		WriteLog(logError, "#132 deleteFolderRooms: "+err.Error())
+	}
+	if err := saveSpaceID(roomID, ""); err != nil {
+		WriteLog(logError, "#133 saveSpaceID: "+err.Error())
+	}
+}
+
+//setSpaceChild adds a room to a space or removes it
+func setSpaceChild(spaceID, roomID string, add bool) error {
+	content := map[string]interface{}{}
+	if add {
+		content["via"] = []string{matrixDomain()}
+	}
+	_, err := matrixClient.SendStateEvent(id.RoomID(spaceID), spaceChild, roomID, content)
+	return err
+}
+
+//restartMailListener reconnects the imap account of a room, which syncs its space
+func restartMailListener(roomID string) {
+	stopMailChecker(roomID)
+	account, err := getIMAPAccount(roomID)
+	if err != nil {
+		WriteLog(critical, "#49 getIMAPAccount: "+err.Error())
+		return
+	}
+	go startMailListener(*account)
+}
+
+//syncSpace creates rooms for new folders and archives the rooms of deleted ones
+func syncSpace(mClient *client.Client, account *imapAccountount) {
+	spaceID, err := getSpaceID(account.roomID)
+	if err != nil {
+		WriteLog(logError, "#129 getSpaceID: "+err.Error())
+		return
+	}
+	if len(spaceID) == 0 {
+		return
+	}
+	folders, err := listFolders(mClient)
+	if err != nil {
+		WriteLog(logError, "#47 getMailboxes: "+err.Error())
+		return
+	}
+	rooms, err := getFolderRooms(account.roomID)
+	if err != nil {
+		WriteLog(logError, "#131 getFolderRooms: "+err.Error())
+		return
+	}
+
+	existing := make(map[string]folderRoom)
+	for _, room := range rooms {
+		existing[room.mailbox] = room
+		if !room.archived && !contains(folders, room.mailbox) {
+			archiveFolderRoom(spaceID, room, true)
+		}
+	}
+	for _, folder := range folders {
+		//the emails of the bridged mailbox stay in the bridged room
+		if folder == account.mailbox {
+			continue
+		}
+		room, ok := existing[folder]
+		if !ok {
+			if err := createFolderRoom(spaceID, account, folder); err != nil {
+				WriteLog(logError, "#134 createFolderRoom: "+err.Error())
+			}
+		} else if room.archived {
+			archiveFolderRoom(spaceID, room, false)
+		}
+	}
+}
+
+func createFolderRoom(spaceID string, account *imapAccountount, folder string) error {
+	roomID, err := createLinkedRoom(account.roomID, &mautrix.ReqCreateRoom{
+		Name:   folder,
+		Topic:  "Emails in the folder " + folder + " of " + account.username,
+		Preset: "private_chat",
+	}, true)
+	if err != nil {
+		return err
+	}
+	_, err = insertFolderRoom(&folderRoom{parentRoomID: account.roomID, mailbox: folder, roomID: roomID.String()})
+	if err != nil {
+		return err
+	}
+	return setSpaceChild(spaceID, roomID.String(), true)
+}
+
+//archiveFolderRoom removes the room of a deleted folder from the space, or adds it again if the folder is back
+func archiveFolderRoom(spaceID string, room folderRoom, archive bool) {
+	if err := setFolderRoomArchived(room.pkID, archive); err != nil {
+		WriteLog(logError, "#135 setFolderRoomArchived: "+err.Error())
+		return
+	}
+	name := room.mailbox
+	if archive {
+		name = archivedPrefix + room.mailbox
+	}
+	roomID := id.RoomID(room.roomID)
+	if _, err := matrixClient.SendStateEvent(roomID, event.StateRoomName, "", &event.RoomNameEventContent{Name: name}); err != nil {
+		WriteLog(warn, "Couldn't rename "+room.roomID+": "+err.Error())
+	}
+	if err := setSpaceChild(spaceID, room.roomID, !archive); err != nil {
+		WriteLog(warn, "Couldn't update the space "+spaceID+": "+err.Error())
+	}
+	if archive {
+		matrixClient.SendText(roomID, "The folder "+room.mailbox+" was deleted on the server. This room doesn't get new emails anymore")
+	} else {
+		matrixClient.SendText(roomID, "The folder "+room.mailbox+" is back. New emails are posted here again")
+	}
+}
+
+//fetchFolderMails posts the new emails of the folders into their rooms.
+//The emails a folder contained when its room was created are only marked as seen
+func fetchFolderMails(mClient *client.Client, account *imapAccountount) {
+	rooms, err := getFolderRooms(account.roomID)
+	if err != nil {
+		WriteLog(logError, "#131 getFolderRooms: "+err.Error())
+		return
+	}
+	for _, room := range rooms {
+		if room.archived || room.mailbox == account.mailbox {
+			continue
+		}
+		messages := make(chan *imap.Message, 1)
+		section, uidValidity, errCode := getMails(mClient, room.mailbox, messages)
+		if section != nil {
+			for msg := range messages {
+				mailID := msg.Envelope.Subject + strconv.Itoa(int(msg.InternalDate.Unix()))
+				if has, err := dbContainsMail(mailID, account.roomPKID); !has && err == nil {
+					insertEmail(mailID, account.roomPKID)
+					if room.synced {
+						handleMail(msg, section, *account, mailRef{mailbox: room.mailbox, uid: msg.Uid, uidValidity: uidValidity})
+					}
+				} else if err != nil {
+					WriteLog(logError, "#11 dbContains mail: "+err.Error())
+				}
+			}
+		} else if errCode != 1 {
+			continue
+		}
+		if !room.synced {
+			if err := setFolderRoomSynced(room.pkID); err != nil {
+				WriteLog(logError, "#136 setFolderRoomSynced: "+err.Error())
+			}
+		}
+	}
+}
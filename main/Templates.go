@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const signatureSeparator = "\r\n\r\n-- \r\n"
+
+//getSignature returns the signature of a room. Falls back to the signature of its smtp account
+func getSignature(roomID string) string {
+	roomSignature, accountSignature, err := getSignatures(roomID)
+	if err != nil {
+		WriteLog(logError, "#82 getSignatures: "+err.Error())
+		return ""
+	}
+	if len(strings.Trim(roomSignature, " ")) > 0 {
+		return roomSignature
+	}
+	return accountSignature
+}
+
+//appendSignature adds the signature below an email body
+func appendSignature(body, signature string) string {
+	if len(strings.Trim(signature, " ")) == 0 {
+		return body
+	}
+	return strings.TrimRight(body, "\r\n") + signatureSeparator + strings.ReplaceAll(signature, "\n", "\r\n")
+}
+
+//fillTemplate replaces the placeholders {{to}}, {{name}}, {{from}} and {{date}}
+func fillTemplate(text, roomID string, recipients []*mail.Address, from string) string {
+	name := ""
+	if len(recipients) > 0 {
+		name = recipients[0].Name
+		if len(name) == 0 {
+			name = strings.Split(recipients[0].Address, "@")[0]
+		}
+	}
+	placeholders := map[string]string{
+		"to":   formatRecipients(recipients),
+		"name": name,
+		"from": from,
+		"date": time.Now().In(getRoomLocation(roomID)).Format("2006-01-02"),
+	}
+	for key, value := range placeholders {
+		text = strings.ReplaceAll(text, "{{"+key+"}}", value)
+	}
+	return text
+}
+
+//handleSignatureCommand handles '!signature <view/set/setaccount/clear> <signature>', message is the text after the command
+func handleSignatureCommand(roomID id.RoomID, message string, client *mautrix.Client) {
+	args := strings.SplitN(message, " ", 2)
+	signature := ""
+	if len(args) == 2 {
+		signature = strings.Trim(args[1], " \r\n")
+	}
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "", "view", "show":
+		{
+			roomSignature, accountSignature, err := getSignatures(roomID.String())
+			if err != nil {
+				WriteLog(critical, "#82 getSignatures: "+err.Error())
+				client.SendText(roomID, "An server-error occured Errorcode: #82")
+				return
+			}
+			if len(roomSignature) == 0 {
+				roomSignature = "not set"
+			}
+			if len(accountSignature) == 0 {
+				accountSignature = "not set"
+			}
+			client.SendText(roomID, "Room signature:\r\n"+roomSignature+"\r\n\r\nAccount signature (used if the room has none):\r\n"+accountSignature)
+			return
+		}
+	case "set":
+		err = saveRoomSignature(roomID.String(), signature)
+	case "setaccount":
+		err = saveAccountSignature(roomID.String(), signature)
+	case "clear", "rm":
+		if signature == "account" {
+			err = saveAccountSignature(roomID.String(), "")
+		} else {
+			err = saveRoomSignature(roomID.String(), "")
+		}
+	default:
+		{
+			client.SendText(roomID, "Usage: "+commandPrefix()+"signature <view/set/setaccount/clear> <signature (markdown)>")
+			return
+		}
+	}
+	if err != nil {
+		WriteLog(critical, "#84 saving signature: "+err.Error())
+		client.SendText(roomID, "An server-error occured Errorcode: #84")
+		return
+	}
+	client.SendText(roomID, "Signature updated")
+}
+
+func viewTemplates(roomID string, client *mautrix.Client) {
+	templates, err := getTemplates(roomID)
+	if err != nil {
+		WriteLog(critical, "#85 getTemplates: "+err.Error())
+		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #85")
+		return
+	}
+	if len(templates) == 0 {
+		client.SendText(id.RoomID(roomID), "No templates saved. Use "+commandPrefix()+"template save <name> while writing an email to create one")
+		return
+	}
+	msg := "Templates:\n"
+	for _, template := range templates {
+		msg += "> " + template.name + ": \"" + template.subject + "\"\n"
+	}
+	client.SendText(id.RoomID(roomID), msg+"\nUse "+commandPrefix()+"write --template <name> <email> to write an email using a template")
+}
+
+//handleTemplateCommand handles !template outside of email writing.
+//'!template add <name>' takes the subject from the second line and the body from the following lines
+func handleTemplateCommand(roomID id.RoomID, message string, client *mautrix.Client) {
+	lines := strings.Split(strings.ReplaceAll(message, "\r\n", "\n"), "\n")
+	sm := strings.Fields(lines[0])
+	if len(sm) == 0 || (len(sm) == 1 && (sm[0] == "list" || sm[0] == "view")) {
+		viewTemplates(roomID.String(), client)
+		return
+	}
+	if len(sm) != 2 {
+		client.SendText(roomID, "Usage: "+commandPrefix()+"template <list/show/add/rm> <name>")
+		return
+	}
+	name := sm[1]
+	switch strings.ToLower(sm[0]) {
+	case "show":
+		{
+			template, err := getTemplate(roomID.String(), name)
+			if err != nil {
+				client.SendText(roomID, "Template "+name+" not found")
+				return
+			}
+			client.SendText(roomID, "Subject: "+template.subject+"\r\n\r\n"+template.body)
+		}
+	case "add":
+		{
+			if len(lines) < 3 {
+				client.SendText(roomID, "Usage:\r\n"+commandPrefix()+"template add <name>\r\n<subject>\r\n<body>\r\n\r\nPlaceholders: {{to}}, {{name}}, {{from}}, {{date}}")
+				return
+			}
+			err := saveTemplate(roomID.String(), name, strings.Trim(lines[1], " "), strings.Join(lines[2:], "\r\n")+"\r\n")
+			if err != nil {
+				WriteLog(critical, "#86 saveTemplate: "+err.Error())
+				client.SendText(roomID, "An server-error occured Errorcode: #86")
+				return
+			}
+			client.SendText(roomID, "Template "+name+" saved")
+		}
+	case "rm", "delete", "remove":
+		{
+			err := deleteTemplate(roomID.String(), name)
+			if err != nil {
+				WriteLog(critical, "#87 deleteTemplate: "+err.Error())
+				client.SendText(roomID, "An server-error occured Errorcode: #87")
+				return
+			}
+			client.SendText(roomID, "Template "+name+" deleted")
+		}
+	default:
+		{
+			client.SendText(roomID, "Usage: "+commandPrefix()+"template <list/show/add/rm> <name>")
+		}
+	}
+}